@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/carlosroman/numbers-log/internal/pkg/server"
+	"math"
+	"os"
+)
+
+// runCoverage reports how much of each block of numbers the files or an
+// mmap bitset file hold, without a running server, and returns the exit
+// code.
+func runCoverage(args []string) int {
+	fs := flag.NewFlagSet("coverage", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s coverage [flags] [file...]\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Counts the numbers of the files, numbers one per line or snapshots, or of\nthe -mmap-file bitset from -from to -to, and in each block of -block numbers.")
+		fs.PrintDefaults()
+	}
+	from := fs.Uint("from", 0, "first number of the range")
+	to := fs.Uint("to", 999999999, "last number of the range")
+	block := fs.Uint("block", server.DefaultCoverageBlock, "numbers of each block")
+	asJSON := fs.Bool("json", false, "print the report as JSON, as served by the admin server")
+	mmapFile := fs.String("mmap-file", "", "bitset file of the mmap checker to report on instead of files")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if (fs.NArg() == 0) == (*mmapFile == "") {
+		fs.Usage()
+		return 2
+	}
+	if *from > math.MaxUint32 || *to > math.MaxUint32 || *block > math.MaxUint32 {
+		fmt.Fprintf(os.Stderr, "invalid range %09d-%09d of blocks of %v\n", *from, *to, *block)
+		return 2
+	}
+
+	nc, closeChecker, err := loadOffline(fs.Args(), *mmapFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer closeChecker()
+
+	c, err := server.CoverageOf(nc, uint32(*from), uint32(*to), uint32(*block))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if *asJSON {
+		if err := json.NewEncoder(os.Stdout).Encode(c); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+	printCoverage(c)
+	return 0
+}
+
+// printCoverage prints the totals of c followed by every block with numbers
+// seen, as empty blocks are usually the majority.
+func printCoverage(c server.Coverage) {
+	total := uint64(c.To) - uint64(c.From) + 1
+	fmt.Printf("Seen %v of %v numbers from %09d to %09d, %.2f%%\n", c.Seen, total, c.From, c.To, float64(c.Seen)*100/float64(total))
+	fmt.Printf("%v blocks of %v: %v full, %v empty\n", len(c.Blocks), c.BlockSize, c.Full, c.Empty)
+	for _, b := range c.Blocks {
+		if b.Seen == 0 {
+			continue
+		}
+		full := ""
+		if b.Seen == uint64(b.End)-uint64(b.Start)+1 {
+			full = " full"
+		}
+		fmt.Printf("%09d-%09d %10v %7.2f%%%s\n", b.Start, b.End, b.Seen, b.Fill*100, full)
+	}
+}
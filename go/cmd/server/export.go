@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/carlosroman/numbers-log/internal/pkg/server"
+	"os"
+)
+
+// runExport lists the numbers of seed files, snapshots or an mmap bitset
+// file in ascending order, without a running server, and returns the exit
+// code.
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s export [flags] [file...]\n\n", os.Args[0])
+		fmt.Fprintln(fs.Output(), "Lists every number of the files, numbers one per line or snapshots, or of\nthe -mmap-file bitset, once and in ascending order.")
+		fs.PrintDefaults()
+	}
+	format := fs.String("format", "text", "how numbers are written: text (one per line), csv or binary (delta encoded snapshot)")
+	out := fs.String("out", "", "file the numbers are written to instead of the standard output")
+	mmapFile := fs.String("mmap-file", "", "bitset file of the mmap checker to list instead of files")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	f, err := server.ParseExportFormat(*format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if (fs.NArg() == 0) == (*mmapFile == "") {
+		fs.Usage()
+		return 2
+	}
+
+	nc, closeChecker, err := loadOffline(fs.Args(), *mmapFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer closeChecker()
+
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	n, err := server.Export(nc, w, f)
+	if *out != "" {
+		if errClose := w.Close(); err == nil {
+			err = errClose
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Exported %v numbers\n", n)
+	return 0
+}
+
+// loadOffline loads the numbers of files, seed files or snapshots, into a
+// new checker or opens the bitset file of the mmap checker, and returns a
+// function closing the checker. Files loaded into an mmap checker would be
+// added to its file, so only one of the two can be given. Progress goes to
+// the standard error, as the standard output may hold the numbers.
+func loadOffline(files []string, mmapFile string) (server.NumberChecker, func(), error) {
+	if mmapFile != "" {
+		if _, err := os.Stat(mmapFile); err != nil {
+			return nil, nil, err
+		}
+		mc, err := server.NewMmapChecker(mmapFile, server.NewRecorder())
+		if err != nil {
+			return nil, nil, err
+		}
+		return mc, func() {
+			if err := mc.Close(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}, nil
+	}
+	// The paged checker only takes memory for the ranges in the files.
+	nc, err := server.NewNumberCheckerWith(server.CheckerConfig{Kind: "paged"}, server.NewRecorder())
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, file := range files {
+		summary, err := server.LoadSeed(nc, file, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, e := range summary.Errors {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", file, e)
+		}
+		fmt.Fprintln(os.Stderr, summary)
+	}
+	return nc, func() {}, nil
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyHandover relays SIGUSR2, which asks the server to hand its
+// listeners over to a successor, to c.
+func notifyHandover(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
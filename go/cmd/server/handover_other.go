@@ -0,0 +1,10 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+// notifyHandover does nothing as there is no SIGUSR2 on Windows, so the
+// listeners are never handed over.
+func notifyHandover(c chan<- os.Signal) {}
@@ -1,29 +1,477 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"github.com/carlosroman/numbers-log/internal/pkg/server"
+	"io"
+	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "export":
+			os.Exit(runExport(os.Args[2:]))
+		case "coverage":
+			os.Exit(runCoverage(os.Args[2:]))
+		}
+	}
+	overflow := flag.String("overflow", "queue", "policy once the connection limit is reached: queue, reject or wait")
+	overflowWait := flag.Duration("overflow-wait", 5*time.Second, "maximum time a connection waits for a slot with the wait policy")
+	overflowWaiting := flag.Int("overflow-max-waiting", server.DefaultMaxWaiting, "connections that can wait for a slot at once with the wait policy, the others are rejected")
+	accessRules := flag.String("access-rules", "", "file with allow/deny rules and per address connection limits, reloaded on SIGHUP")
+	rate := flag.Float64("rate", 0, "numbers per second accepted across all connections, 0 disables the limit")
+	rateBurst := flag.Int("rate-burst", 1000, "burst size of the global rate limit")
+	connRate := flag.Float64("conn-rate", 0, "numbers per second accepted from each connection, 0 disables the limit")
+	connRateBurst := flag.Int("conn-rate-burst", 100, "burst size of the per connection rate limit")
+	throttle := flag.String("throttle", "backpressure", "what to do with numbers above the rate: backpressure or reject")
+	trustedProxies := flag.String("trusted-proxies", "", "comma separated addresses or CIDRs of load balancers that send a PROXY protocol header")
+	state := flag.String("state", "numbers.state", "file the dedup set is saved to when handing over to a new process on SIGUSR2")
+	acceptors := flag.Int("acceptors", 1, "number of SO_REUSEPORT listeners, each with its own accept loop")
+	maxConnections := flag.Int("max-connections", 5, "maximum number of producers connected at the same time")
+	backend := flag.String("backend", "goroutine", "connection handling: goroutine (one per connection) or epoll (Linux only)")
+	epollWorkers := flag.Int("epoll-workers", 4, "number of workers serving connections with the epoll backend")
+	pipelined := flag.Bool("pipeline", false, "check and write numbers in stages fed by bounded queues instead of on each connection, not with -max-namespaces")
+	queueSize := flag.Int("queue-size", 65536, "numbers waiting to be checked with -pipeline")
+	writeQueueSize := flag.Int("write-queue-size", 65536, "unique numbers waiting to be written with -pipeline")
+	dedupBatch := flag.Int("dedup-batch", 256, "most numbers checked at once with -pipeline")
+	writeBatch := flag.Int("write-batch", 1024, "most numbers written at once with -pipeline")
+	queueFull := flag.String("queue-full", "block", "what to do with numbers once the queue is full: block or drop")
+	keys := flag.String("keys", "number", "what producers send: number (nine digits), uint64, uuid or string, the last three kept in -shards hash sets")
+	checkerKind := flag.String("checker", "bool", "how seen numbers are kept: bool, paged, list, map, sharded, roaring, adaptive, mmap, bloom or window; all but map, sharded, bloom and window count ranges on the admin server")
+	window := flag.Duration("window", 24*time.Hour, "how long the window checker remembers a number after it was last seen")
+	windowGenerations := flag.Int("window-generations", server.DefaultWindowGenerations, "generations the window is split into, a number is forgotten up to a generation after the window")
+	mmapFile := flag.String("mmap-file", "numbers.bitset", "bitset file of the mmap checker, kept across restarts")
+	mmapSync := flag.Duration("mmap-sync", 10*time.Second, "how often the mmap checker flushes its file to disk, 0 only flushes on exit")
+	bloomExpected := flag.Int("bloom-expected", server.DefaultBloomExpected, "unique numbers the bloom checker is sized for")
+	bloomRate := flag.Float64("bloom-fp-rate", server.DefaultBloomFalsePositiveRate, "share of unique numbers the bloom checker may report as duplicates once it holds -bloom-expected numbers")
+	seeds := flag.String("seed", "", "comma separated files of numbers, one per line or as a snapshot, that are duplicates from the start; NAME=FILE seeds the namespace NAME")
+	count := flag.String("count", "", "count how often duplicates are received to report the most repeated: exact (memory grows with every number repeated, without bound) or sketch (fixed memory), empty disables counting")
+	topN := flag.Int("top", server.DefaultTopNumbers, "how many of the most repeated numbers are reported with -count")
+	estimate := flag.Bool("estimate", false, "estimate the distinct numbers accepted per client, per hour and per prefix")
+	estimatePrecision := flag.Int("estimate-precision", server.DefaultSketchPrecision, "sketches have 2^precision registers of a byte, from 4 to 16, with a standard error of 1.04/sqrt(2^precision)")
+	estimateHours := flag.Int("estimate-hours", server.DefaultEstimateHours, "hourly estimates kept for roll ups")
+	estimateClients := flag.Int("estimate-clients", server.DefaultEstimateClients, "clients estimated on their own, the numbers of any others are estimated together")
+	estimatePrefix := flag.Int("estimate-prefix-digits", 1, "leading digits the estimates per prefix are split by, from 1 to 3")
+	denseThreshold := flag.Int("dense-threshold", server.DefaultDenseThreshold, "numbers from which a chunk of the adaptive checker becomes a bitset")
+	shards := flag.Int("shards", server.DefaultShards, "number of shards of the sharded checker")
+	maxNamespaces := flag.Int("max-namespaces", 0, "namespaces producers can declare, each with its own checker and log, 0 disables namespaces, not with -pipeline")
+	namespaceDir := flag.String("namespace-dir", server.DefaultNamespaceDir, "directory of the log, bitset and handover files of each namespace")
+	namespaceListen := flag.String("namespace-listen", "", "comma separated NAME=HOST:PORT listeners whose connections are all in the namespace NAME")
+	flag.Parse()
+
+	policy, err := server.ParseOverflowPolicy(*overflow)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	mode, err := server.ParseThrottleMode(*throttle)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	proxies, err := server.ParseTrustedProxies(*trustedProxies)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	full, err := server.ParseQueueMode(*queueFull)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	bound, err := server.ParseNamespaceListeners(*namespaceListen)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if *maxNamespaces <= 0 && len(bound) > 0 {
+		fmt.Println("-namespace-listen needs -max-namespaces")
+		os.Exit(2)
+	}
+	if *maxNamespaces > 0 && *pipelined {
+		fmt.Println("-pipeline cannot be used with -max-namespaces")
+		os.Exit(2)
+	}
 
 	rec := server.NewRecorder()
-	nc := server.NewNumberChecker(rec)
-	wr := server.GetWriter("numbers.log")
+	var ks server.KeySet
+	if *keys != "number" {
+		numberOnly := map[string]bool{"checker": true, "pipeline": true, "estimate": true, "seed": true, "count": true, "max-namespaces": true, "namespace-listen": true}
+		flag.Visit(func(f *flag.Flag) {
+			if numberOnly[f.Name] {
+				fmt.Printf("-%s only applies to -keys number\n", f.Name)
+				os.Exit(2)
+			}
+		})
+		if ks, err = server.NewKeySet(*keys, *shards, rec); err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+	}
+	cfg := server.CheckerConfig{
+		Kind:              *checkerKind,
+		Shards:            *shards,
+		DenseThreshold:    *denseThreshold,
+		Path:              *mmapFile,
+		SyncInterval:      *mmapSync,
+		ExpectedNumbers:   *bloomExpected,
+		FalsePositiveRate: *bloomRate,
+		Window:            *window,
+		Generations:       *windowGenerations,
+		Count:             *count,
+		TopN:              *topN,
+	}
+	nc, err := newNumberChecker(ks == nil, cfg, rec)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	var nss server.Namespaces
+	if *maxNamespaces > 0 {
+		// Restores the namespaces handed over along with the default one.
+		nss, err = server.NewNamespaces(server.NamespaceConfig{
+			Max:      *maxNamespaces,
+			Dir:      *namespaceDir,
+			Checker:  cfg,
+			Handover: server.IsHandover(),
+		})
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+	}
+	closeChecker := func() {
+		if c, ok := nc.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				fmt.Println(err)
+			}
+		}
+		if nss != nil {
+			if err := nss.Close(); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+	var wr server.Writer
+	if server.IsHandover() {
+		wr = server.GetAppendWriter("numbers.log")
+		var n uint64
+		if ks != nil {
+			n, err = server.LoadKeys(ks, *state)
+		} else {
+			n, err = server.LoadSnapshot(nc, *state)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		fmt.Printf("Restored %v numbers from %s\n", n, *state)
+		if err := os.Remove(*state); err != nil {
+			fmt.Println(err)
+		}
+	} else {
+		wr = server.GetWriter("numbers.log")
+		// A successor gets the seeded numbers with the snapshot.
+		for _, seed := range strings.Split(*seeds, ",") {
+			if seed == "" {
+				continue
+			}
+			// NAME=FILE seeds a namespace instead of the default checker.
+			name, file := "", seed
+			if i := strings.IndexByte(seed, '='); i >= 0 {
+				name, file = seed[:i], seed[i+1:]
+			}
+			progress := func(p server.SeedProgress) {
+				fmt.Printf("Seeding %s: %v%%, %v loaded, %v skipped\n", p.File, percent(p.Read, p.Size), p.Loaded, p.Skipped)
+			}
+			var summary server.SeedSummary
+			switch {
+			case name == "":
+				summary, err = server.LoadSeed(nc, file, progress)
+			case nss == nil:
+				err = fmt.Errorf("seeding namespace %s needs -max-namespaces", name)
+			default:
+				summary, err = nss.Seed(name, file, progress)
+			}
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(2)
+			}
+			for _, e := range summary.Errors {
+				fmt.Printf("%s: %s\n", file, e)
+			}
+			fmt.Println(summary)
+		}
+	}
 	defer func() {
 		if err := wr.Sync(); err != nil {
 			os.Exit(3)
 		}
 	}()
-	h := server.NewHandler(nc, wr)
-	s := server.NewServer(5, "localhost", 4000, h, 10*time.Second)
+	ac, err := server.NewAccessControl(*accessRules, rec)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := ac.Reload(); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}()
+	reg := server.NewRegistry()
+	h := server.NewHandler(nc, wr, reg)
+	if ks != nil {
+		h.SetKeys(ks)
+	}
+	if nss != nil {
+		h.SetNamespaces(nss)
+	}
+	h.SetRateLimit(
+		server.RateLimit{Rate: *rate, Burst: *rateBurst},
+		server.RateLimit{Rate: *connRate, Burst: *connRateBurst},
+		mode, rec)
+	var est server.Estimator
+	if *estimate {
+		est, err = server.NewEstimator(server.EstimatorConfig{
+			Precision:    *estimatePrecision,
+			Hours:        *estimateHours,
+			Clients:      *estimateClients,
+			PrefixDigits: *estimatePrefix,
+		}, rec)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		h.SetEstimator(est)
+	}
+	var p server.Pipeline
+	if *pipelined {
+		p = server.NewPipeline(nc, wr, server.PipelineConfig{
+			NumberQueue: *queueSize,
+			WriteQueue:  *writeQueueSize,
+			DedupBatch:  *dedupBatch,
+			WriteBatch:  *writeBatch,
+			Full:        full,
+		})
+		h.SetPipeline(p)
+	}
+	hc, stopBackend, err := server.NewBackend(*backend, h, *epollWorkers)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	defer stopBackend()
+	a := server.NewAdmin("localhost", 4001, reg)
+	a.SetAccessControl(ac)
+	if nc != nil {
+		a.SetChecker(nc)
+	}
+	if p != nil {
+		a.SetPipeline(p)
+	}
+	if est != nil {
+		a.SetEstimator(est)
+	}
+	if nss != nil {
+		a.SetNamespaces(nss)
+	}
+	if err := a.Start(); err != nil {
+		os.Exit(2)
+	}
+	// The admin requests read the checker, so they have to be done before
+	// it is closed.
+	stopAdmin := func() {
+		if err := a.Stop(); err != nil {
+			fmt.Println(err)
+		}
+	}
+	s := server.NewServer(*maxConnections, "localhost", 4000, hc, 10*time.Second)
+	s.SetOverflowPolicy(policy, *overflowWait, rec)
+	s.SetMaxWaiting(*overflowWaiting)
+	s.SetAccessControl(ac)
+	s.SetProxyProtocol(proxies)
+	listeners, err := server.ListenersFromEnv()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	// The producers connected to the previous process are handed over
+	// after its listeners.
+	connsFile := *state + ".conns"
+	conns, err := server.ConnsFromEnv(connsFile, len(listeners))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	s.ResumeConns(conns...)
+	if len(listeners) > 0 {
+		// The namespace listeners are handed over after the others, in
+		// -namespace-listen order.
+		if err := bindInherited(nss, bound, listeners); err != nil {
+			fmt.Println(err)
+			os.Exit(2)
+		}
+		s.SetListeners(listeners...)
+	} else {
+		s.SetAcceptors(*acceptors)
+		for _, b := range bound {
+			ln, err := net.Listen("tcp", b.Addr)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(2)
+			}
+			if ln, err = nss.Bind(ln, b.Name); err != nil {
+				fmt.Println(err)
+				os.Exit(2)
+			}
+			s.AddListeners(ln)
+		}
+	}
 	if err := s.Start(); err != nil {
 		os.Exit(2)
 	}
-	if err := s.Process(); err != nil {
+
+	handover := make(chan []*os.File, 1)
+	usr2 := make(chan os.Signal, 1)
+	notifyHandover(usr2)
+	go func() {
+		probes := []string{*state, connsFile}
+		if nss != nil {
+			probes = append(probes, filepath.Join(*namespaceDir, ".handover"))
+		}
+		for range usr2 {
+			// Nothing is stopped unless the successor can be started with
+			// the state, otherwise this process keeps serving.
+			if err := server.CheckHandover(probes...); err != nil {
+				fmt.Printf("Cannot hand over: %v\n", err)
+				continue
+			}
+			files, err := s.ListenerFiles()
+			if err != nil {
+				fmt.Printf("Cannot hand over: %v\n", err)
+				continue
+			}
+			handover <- files
+			if err := s.Pause(); err != nil {
+				fmt.Println(err)
+			}
+			return
+		}
+	}()
+
+	// Interrupting the server stops it the same way as terminate.
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		if err := s.Shutdown(); err != nil {
+			fmt.Println(err)
+		}
+	}()
+
+	err = s.Process()
+	if p != nil {
+		// Every handler has returned, so the queued numbers can be flushed.
+		p.Stop()
+	}
+	if err != nil {
+		fmt.Println(err)
+		stopAdmin()
+		closeChecker()
+		if err := wr.Sync(); err != nil {
+			fmt.Println(err)
+		}
 		os.Exit(1)
 	}
+	select {
+	case files := <-handover:
+		// The listening sockets stay open through files, so producers queue
+		// in the backlog until the successor starts accepting. The paused
+		// producers wait for the successor to read from them again.
+		stopAdmin()
+		if err := wr.Sync(); err != nil {
+			fmt.Println(err)
+		}
+		if ks != nil {
+			err = server.SaveKeys(ks, *state)
+		} else {
+			err = server.SaveSnapshot(nc, *state)
+		}
+		if err == nil && nss != nil {
+			err = nss.Save()
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(4)
+		}
+		closeChecker()
+		conns, err := server.SaveConns(s.PausedConns(), connsFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(4)
+		}
+		p, err := server.StartSuccessor(files, conns)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(4)
+		}
+		fmt.Printf("Handed over to process %v\n", p.Pid)
+	default:
+		stopAdmin()
+		closeChecker()
+	}
 	fmt.Println("Done")
 }
+
+// newNumberChecker creates the checker of nine digit numbers, or none when
+// producers send other keys.
+func newNumberChecker(numbers bool, cfg server.CheckerConfig, r server.Recorder) (server.NumberChecker, error) {
+	if !numbers {
+		return nil, nil
+	}
+	return server.NewNumberCheckerWith(cfg, r)
+}
+
+func percent(n, total int64) int64 {
+	if total == 0 {
+		return 100
+	}
+	return n * 100 / total
+}
+
+// bindInherited binds the last listeners handed over to the namespaces of
+// bound, whose ports they have to match.
+func bindInherited(nss server.Namespaces, bound []server.NamespaceListener, listeners []net.Listener) error {
+	if len(bound) == 0 {
+		return nil
+	}
+	first := len(listeners) - len(bound)
+	if first < 1 {
+		return fmt.Errorf("got %v listeners, expected %v namespace listeners after the others", len(listeners), len(bound))
+	}
+	for i, b := range bound {
+		ln := listeners[first+i]
+		_, port, _ := net.SplitHostPort(b.Addr)
+		if tcp, ok := ln.Addr().(*net.TCPAddr); ok && port != "0" && port != fmt.Sprint(tcp.Port) {
+			return fmt.Errorf("listener %v handed over for namespace %s, expected %s", ln.Addr(), b.Name, b.Addr)
+		}
+		bl, err := nss.Bind(ln, b.Name)
+		if err != nil {
+			return err
+		}
+		listeners[first+i] = bl
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// AccessRules are the allow/deny lists and connection limits applied to
+// every accepted connection.
+//
+// Rules are read one per line:
+//
+//	allow 10.0.0.0/8
+//	deny 10.1.2.3
+//	limit-ip 5
+//	limit 192.168.0.0/16 20
+//
+// A connection is denied when its address matches a deny rule, or when
+// allow rules exist and none match. limit-ip caps the connections from any
+// single address and limit caps the connections from a whole CIDR.
+type AccessRules struct {
+	Allow  []*net.IPNet
+	Deny   []*net.IPNet
+	PerIP  int
+	Limits []CIDRLimit
+}
+
+type CIDRLimit struct {
+	Network *net.IPNet
+	Max     int
+}
+
+func ParseAccessRules(r io.Reader) (*AccessRules, error) {
+	rules := &AccessRules{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		var err error
+		switch {
+		case fields[0] == "allow" && len(fields) == 2:
+			var n *net.IPNet
+			if n, err = parseNetwork(fields[1]); err == nil {
+				rules.Allow = append(rules.Allow, n)
+			}
+		case fields[0] == "deny" && len(fields) == 2:
+			var n *net.IPNet
+			if n, err = parseNetwork(fields[1]); err == nil {
+				rules.Deny = append(rules.Deny, n)
+			}
+		case fields[0] == "limit-ip" && len(fields) == 2:
+			rules.PerIP, err = strconv.Atoi(fields[1])
+		case fields[0] == "limit" && len(fields) == 3:
+			var n *net.IPNet
+			var max int
+			if n, err = parseNetwork(fields[1]); err == nil {
+				if max, err = strconv.Atoi(fields[2]); err == nil {
+					rules.Limits = append(rules.Limits, CIDRLimit{Network: n, Max: max})
+				}
+			}
+		default:
+			err = fmt.Errorf("unknown rule %q", scanner.Text())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", line, err)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// parseNetwork accepts either a CIDR or a single address.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+type AccessControl interface {
+	Reload() error
+	admit(addr net.Addr) (release func(), err error)
+}
+
+// NewAccessControl loads the rules from file, an empty file name allows
+// every connection until rules are loaded.
+func NewAccessControl(file string, r Recorder) (AccessControl, error) {
+	ac := &accessControl{
+		file:   file,
+		rules:  &AccessRules{},
+		active: make(map[string]int),
+		r:      r,
+	}
+	if file == "" {
+		return ac, nil
+	}
+	return ac, ac.Reload()
+}
+
+type accessControl struct {
+	file   string
+	r      Recorder
+	mu     sync.Mutex
+	rules  *AccessRules
+	active map[string]int
+}
+
+// Reload re-reads the rules file. Connections that are already open are
+// kept, the new rules apply from the next accepted connection.
+func (a *accessControl) Reload() error {
+	if a.file == "" {
+		return nil
+	}
+	f, err := os.Open(a.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rules, err := ParseAccessRules(f)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rules = rules
+	return nil
+}
+
+func (a *accessControl) admit(addr net.Addr) (release func(), err error) {
+	ip := addrIP(addr)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.check(ip); err != nil {
+		a.r.markDenied()
+		return nil, err
+	}
+
+	var keys []string
+	if ip != nil {
+		keys = append(keys, ip.String())
+		for _, l := range a.rules.Limits {
+			if l.Network.Contains(ip) {
+				keys = append(keys, l.Network.String())
+			}
+		}
+	}
+	for _, k := range keys {
+		a.active[k]++
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			for _, k := range keys {
+				if a.active[k]--; a.active[k] <= 0 {
+					delete(a.active, k)
+				}
+			}
+		})
+	}, nil
+}
+
+func (a *accessControl) check(ip net.IP) error {
+	if ip == nil {
+		if len(a.rules.Allow) > 0 {
+			return fmt.Errorf("address is not in the allow list")
+		}
+		return nil
+	}
+	for _, n := range a.rules.Deny {
+		if n.Contains(ip) {
+			return fmt.Errorf("address matches deny rule %s", n)
+		}
+	}
+	if len(a.rules.Allow) > 0 && !containsIP(a.rules.Allow, ip) {
+		return fmt.Errorf("address is not in the allow list")
+	}
+	if a.rules.PerIP > 0 && a.active[ip.String()] >= a.rules.PerIP {
+		return fmt.Errorf("address has reached the limit of %v connections", a.rules.PerIP)
+	}
+	for _, l := range a.rules.Limits {
+		if l.Network.Contains(ip) && a.active[l.Network.String()] >= l.Max {
+			return fmt.Errorf("network %s has reached the limit of %v connections", l.Network, l.Max)
+		}
+	}
+	return nil
+}
+
+func addrIP(addr net.Addr) net.IP {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseAccessRules(t *testing.T) {
+	rules, err := ParseAccessRules(strings.NewReader(`
+# office and lab
+allow 10.0.0.0/8
+allow 192.168.1.7
+deny 10.1.2.3
+limit-ip 2
+limit 10.2.0.0/16 3
+`))
+	require.NoError(t, err)
+	require.Len(t, rules.Allow, 2)
+	assert.Equal(t, "10.0.0.0/8", rules.Allow[0].String())
+	assert.Equal(t, "192.168.1.7/32", rules.Allow[1].String())
+	require.Len(t, rules.Deny, 1)
+	assert.Equal(t, "10.1.2.3/32", rules.Deny[0].String())
+	assert.Equal(t, 2, rules.PerIP)
+	require.Len(t, rules.Limits, 1)
+	assert.Equal(t, "10.2.0.0/16", rules.Limits[0].Network.String())
+	assert.Equal(t, 3, rules.Limits[0].Max)
+}
+
+func TestParseAccessRules_errors(t *testing.T) {
+	tests := []string{
+		"allow",
+		"allow not-an-ip",
+		"deny 10.0.0.0/33",
+		"limit-ip many",
+		"limit 10.0.0.0/8",
+		"block 10.0.0.1",
+	}
+	for _, tt := range tests {
+		t.Run(tt, func(t *testing.T) {
+			_, err := ParseAccessRules(strings.NewReader(tt))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestAccessControl_admit(t *testing.T) {
+	mr := &mockRecorder{}
+	mr.On("markDenied").Return()
+	ac := newTestAccessControl(t, `
+allow 10.0.0.0/8
+deny 10.1.2.3
+limit-ip 2
+limit 10.2.0.0/16 3
+`, mr)
+
+	_, err := ac.admit(tcpAddr("10.1.2.3"))
+	assert.Error(t, err, "expected deny rule to match")
+	_, err = ac.admit(tcpAddr("172.16.0.1"))
+	assert.Error(t, err, "expected address outside the allow list to be denied")
+	_, err = ac.admit(pipeAddr{})
+	assert.Error(t, err, "expected address without an IP to be denied")
+
+	r1, err := ac.admit(tcpAddr("10.0.0.1"))
+	require.NoError(t, err)
+	_, err = ac.admit(tcpAddr("10.0.0.1"))
+	require.NoError(t, err)
+	_, err = ac.admit(tcpAddr("10.0.0.1"))
+	assert.Error(t, err, "expected per address limit")
+	r1()
+	r1()
+	_, err = ac.admit(tcpAddr("10.0.0.1"))
+	assert.NoError(t, err, "expected release to free a slot exactly once")
+	_, err = ac.admit(tcpAddr("10.0.0.1"))
+	assert.Error(t, err)
+
+	for _, ip := range []string{"10.2.0.1", "10.2.0.2", "10.2.1.1"} {
+		_, err = ac.admit(tcpAddr(ip))
+		require.NoError(t, err)
+	}
+	_, err = ac.admit(tcpAddr("10.2.2.2"))
+	assert.Error(t, err, "expected network limit")
+
+	mr.AssertNumberOfCalls(t, "markDenied", 6)
+}
+
+func TestAccessControl_noRules(t *testing.T) {
+	ac, err := NewAccessControl("", &noopRecorder{})
+	require.NoError(t, err)
+	assert.NoError(t, ac.Reload())
+	for i := 0; i < 10; i++ {
+		_, err := ac.admit(tcpAddr("10.0.0.1"))
+		assert.NoError(t, err)
+	}
+	_, err = ac.admit(pipeAddr{})
+	assert.NoError(t, err)
+}
+
+func TestAccessControl_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "Access")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "rules")
+	require.NoError(t, ioutil.WriteFile(file, []byte("deny 10.0.0.1\n"), 0600))
+
+	ac, err := NewAccessControl(file, &noopRecorder{})
+	require.NoError(t, err)
+	_, err = ac.admit(tcpAddr("10.0.0.1"))
+	assert.Error(t, err)
+
+	require.NoError(t, ioutil.WriteFile(file, []byte("deny 10.0.0.2\n"), 0600))
+	require.NoError(t, ac.Reload())
+	_, err = ac.admit(tcpAddr("10.0.0.1"))
+	assert.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile(file, []byte("deny\n"), 0600))
+	assert.Error(t, ac.Reload())
+	_, err = ac.admit(tcpAddr("10.0.0.2"))
+	assert.Error(t, err, "expected a failed reload to keep the previous rules")
+
+	_, err = NewAccessControl(filepath.Join(dir, "missing"), &noopRecorder{})
+	assert.Error(t, err)
+}
+
+func newTestAccessControl(t *testing.T, rules string, r Recorder) *accessControl {
+	parsed, err := ParseAccessRules(strings.NewReader(rules))
+	require.NoError(t, err)
+	ac, err := NewAccessControl("", r)
+	require.NoError(t, err)
+	a := ac.(*accessControl)
+	a.rules = parsed
+	return a
+}
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
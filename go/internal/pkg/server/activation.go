@@ -0,0 +1,113 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+const (
+	// listenFdsStart is the first file descriptor passed by systemd.
+	listenFdsStart = 3
+	// HandoverEnv is set for a process started by StartSuccessor.
+	HandoverEnv = "NUMBERS_LOG_HANDOVER"
+)
+
+// ListenersFromEnv returns the listeners passed in with systemd socket
+// activation (LISTEN_FDS/LISTEN_PID) or by a previous process handing over.
+// It returns no listeners when none were passed.
+func ListenersFromEnv() ([]net.Listener, error) {
+	fds := os.Getenv("LISTEN_FDS")
+	if fds == "" {
+		return nil, nil
+	}
+	// A successor started by StartSuccessor cannot know its own pid before
+	// it starts, so LISTEN_PID is only checked when set.
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+	for _, env := range []string{"LISTEN_FDS", "LISTEN_PID", "LISTEN_FDNAMES"} {
+		if err := os.Unsetenv(env); err != nil {
+			return nil, err
+		}
+	}
+
+	listeners := make([]net.Listener, 0, n)
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "listener"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			for _, opened := range listeners {
+				_ = opened.Close()
+			}
+			return nil, fmt.Errorf("file descriptor %v is not a listener: %w", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// IsHandover reports whether the process was started by StartSuccessor.
+func IsHandover() bool {
+	return os.Getenv(HandoverEnv) == "1"
+}
+
+// CheckHandover makes sure a successor can be started and the given state
+// files written, before anything is stopped for a handover. Probed files
+// that did not exist are removed.
+func CheckHandover(files ...string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(exe); err != nil {
+		return err
+	} else if info.Mode()&0111 == 0 {
+		return fmt.Errorf("%s is not executable", exe)
+	}
+	for _, file := range files {
+		_, statErr := os.Stat(file)
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if os.IsNotExist(statErr) {
+			if err := os.Remove(file); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// StartSuccessor starts a new copy of the running executable with the same
+// arguments, passing it the listening sockets followed by the producer
+// connections saved with SaveConns.
+func StartSuccessor(listeners, conns []*os.File) (*os.Process, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(append([]*os.File(nil), listeners...), conns...)
+	cmd.Env = append(os.Environ(),
+		"LISTEN_FDS="+strconv.Itoa(len(listeners)),
+		HandoverConnsEnv+"="+strconv.Itoa(len(conns)),
+		HandoverEnv+"=1")
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return cmd.Process, nil
+}
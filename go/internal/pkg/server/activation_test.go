@@ -0,0 +1,87 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestListenersFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		fds     string
+		pid     string
+		wantErr bool
+	}{
+		{name: "NotActivated"},
+		{name: "OtherProcess", fds: "1", pid: "1"},
+		{name: "InvalidCount", fds: "many", pid: strconv.Itoa(os.Getpid()), wantErr: true},
+		{name: "NotAListener", fds: "1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnv(t, "LISTEN_FDS", tt.fds)
+			setEnv(t, "LISTEN_PID", tt.pid)
+			if tt.name == "NotAListener" {
+				// fd 3 is not a socket, or not open at all.
+				f, err := os.Open(os.DevNull)
+				assert.NoError(t, err)
+				defer f.Close()
+				if f.Fd() != listenFdsStart {
+					t.Skip("fd 3 is already in use")
+				}
+			}
+			listeners, err := ListenersFromEnv()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Empty(t, listeners)
+		})
+	}
+}
+
+func TestIsHandover(t *testing.T) {
+	setEnv(t, HandoverEnv, "")
+	assert.False(t, IsHandover())
+	setEnv(t, HandoverEnv, "1")
+	assert.True(t, IsHandover())
+}
+
+func TestCheckHandover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "handover")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	existing := filepath.Join(dir, "existing.state")
+	require.NoError(t, ioutil.WriteFile(existing, []byte("kept"), 0644))
+	missing := filepath.Join(dir, "numbers.state")
+
+	assert.NoError(t, CheckHandover(existing, missing))
+	assert.NoFileExists(t, missing, "expected the probe to be removed")
+	b, err := ioutil.ReadFile(existing)
+	require.NoError(t, err)
+	assert.Equal(t, "kept", string(b))
+
+	assert.Error(t, CheckHandover(filepath.Join(dir, "missing", "numbers.state")))
+}
+
+func setEnv(t *testing.T, key, value string) {
+	old, ok := os.LookupEnv(key)
+	t.Cleanup(func() {
+		if ok {
+			_ = os.Setenv(key, old)
+		} else {
+			_ = os.Unsetenv(key)
+		}
+	})
+	if value == "" {
+		assert.NoError(t, os.Unsetenv(key))
+		return
+	}
+	assert.NoError(t, os.Setenv(key, value))
+}
@@ -0,0 +1,327 @@
+package server
+
+import (
+	"fmt"
+	"go.uber.org/atomic"
+	"math/bits"
+	"sort"
+	"sync"
+	syncatomic "sync/atomic"
+	"unsafe"
+)
+
+const (
+	// adaptiveChunkBits is how many low bits of a number pick its place
+	// within a chunk.
+	adaptiveChunkBits = 16
+	adaptiveChunkSize = 1 << adaptiveChunkBits
+	adaptiveChunks    = (numberSpace + adaptiveChunkSize - 1) / adaptiveChunkSize
+	adaptiveDenseSize = adaptiveChunkSize / 8
+	// DefaultDenseThreshold is the number of values from which a sorted
+	// list of them takes more memory than a bitset of the whole chunk.
+	DefaultDenseThreshold = adaptiveDenseSize / 2
+	// adaptiveChunkOverhead is the memory of a chunk besides its values.
+	adaptiveChunkOverhead = int(unsafe.Sizeof(adaptiveChunk{}))
+)
+
+// AdaptiveStats is the representation mix of an adaptive checker.
+type AdaptiveStats struct {
+	SparseChunks int64 `json:"sparseChunks"`
+	DenseChunks  int64 `json:"denseChunks"`
+	Bytes        int64 `json:"bytes"`
+}
+
+// checkerStats is implemented by the checkers that can tell how they are
+// holding up.
+type checkerStats interface {
+	Stats() AdaptiveStats
+}
+
+// adaptiveChecker splits the numbers into chunks of 65536. A chunk is only
+// allocated once a number falls in it and starts as a sorted list of the
+// values seen, which is replaced by a bitset once it holds threshold
+// values. Each chunk has its own lock, so a chunk being migrated only holds
+// up the numbers that fall in it, and only for as long as it takes to set
+// threshold bits.
+type adaptiveChecker struct {
+	chunks    []unsafe.Pointer // *adaptiveChunk
+	threshold int
+	r         Recorder
+
+	sparse atomic.Int64
+	dense  atomic.Int64
+	bytes  atomic.Int64
+}
+
+type adaptiveChunk struct {
+	mu     sync.Mutex
+	sparse []uint16
+	dense  *[adaptiveDenseSize / 8]uint64
+	// dropped is set once a reset took the chunk out of the checker.
+	dropped bool
+}
+
+func newAdaptiveChecker(r Recorder, threshold int) *adaptiveChecker {
+	if threshold <= 0 {
+		threshold = DefaultDenseThreshold
+	}
+	c := &adaptiveChecker{
+		chunks:    make([]unsafe.Pointer, adaptiveChunks),
+		threshold: threshold,
+		r:         r,
+	}
+	c.bytes.Store(int64(adaptiveChunks) * int64(unsafe.Sizeof(unsafe.Pointer(nil))))
+	return c
+}
+
+// chunk returns the chunk of n, allocating it when absent.
+func (c *adaptiveChecker) chunk(n uint32) *adaptiveChunk {
+	slot := &c.chunks[n>>adaptiveChunkBits]
+	if p := syncatomic.LoadPointer(slot); p != nil {
+		return (*adaptiveChunk)(p)
+	}
+	ch := &adaptiveChunk{}
+	if !syncatomic.CompareAndSwapPointer(slot, nil, unsafe.Pointer(ch)) {
+		return (*adaptiveChunk)(syncatomic.LoadPointer(slot))
+	}
+	c.sparse.Inc()
+	c.bytes.Add(int64(adaptiveChunkOverhead))
+	return ch
+}
+
+// mark adds the low bits of n to the chunk and reports whether they were
+// new. The chunk lock has to be held.
+func (c *adaptiveChecker) mark(ch *adaptiveChunk, n uint32) bool {
+	x := uint16(n)
+	if ch.dropped {
+		// The number counts as checked before the reset.
+		return !ch.contains(x)
+	}
+	if ch.dense != nil {
+		w, bit := x/64, uint64(1)<<(x%64)
+		if ch.dense[w]&bit != 0 {
+			return false
+		}
+		ch.dense[w] |= bit
+		return true
+	}
+	i := sort.Search(len(ch.sparse), func(i int) bool {
+		return ch.sparse[i] >= x
+	})
+	if i < len(ch.sparse) && ch.sparse[i] == x {
+		return false
+	}
+	if len(ch.sparse)+1 >= c.threshold {
+		c.migrate(ch)
+		ch.dense[x/64] |= uint64(1) << (x % 64)
+		return true
+	}
+	before := cap(ch.sparse)
+	ch.sparse = append(ch.sparse, 0)
+	copy(ch.sparse[i+1:], ch.sparse[i:])
+	ch.sparse[i] = x
+	if grown := cap(ch.sparse) - before; grown > 0 {
+		c.bytes.Add(int64(2 * grown))
+	}
+	return true
+}
+
+// contains reports whether the chunk holds x. The chunk lock has to be held.
+func (ch *adaptiveChunk) contains(x uint16) bool {
+	if ch.dense != nil {
+		return ch.dense[x/64]&(uint64(1)<<(x%64)) != 0
+	}
+	i := sort.Search(len(ch.sparse), func(i int) bool {
+		return ch.sparse[i] >= x
+	})
+	return i < len(ch.sparse) && ch.sparse[i] == x
+}
+
+// migrate replaces the sorted list of a chunk with a bitset. The chunk lock
+// has to be held.
+func (c *adaptiveChecker) migrate(ch *adaptiveChunk) {
+	dense := new([adaptiveDenseSize / 8]uint64)
+	for _, x := range ch.sparse {
+		dense[x/64] |= uint64(1) << (x % 64)
+	}
+	c.bytes.Add(int64(adaptiveDenseSize - 2*cap(ch.sparse)))
+	ch.dense = dense
+	ch.sparse = nil
+	c.sparse.Dec()
+	c.dense.Inc()
+}
+
+func (c *adaptiveChecker) IsUnique(n uint32) (unique bool) {
+	ch := c.chunk(n)
+	ch.mu.Lock()
+	unique = c.mark(ch, n)
+	ch.mu.Unlock()
+	c.record(unique)
+	return unique
+}
+
+// IsUniqueBatch locks each chunk once for all of its numbers in the batch.
+func (c *adaptiveChecker) IsUniqueBatch(ns []uint32, out []bool) {
+	order := batchOrder(ns)
+	for start := 0; start < len(order); {
+		key := order[start] >> (32 + adaptiveChunkBits)
+		ch := c.chunk(uint32(order[start] >> 32))
+		ch.mu.Lock()
+		end := start
+		for ; end < len(order) && order[end]>>(32+adaptiveChunkBits) == key; end++ {
+			out[uint32(order[end])] = c.mark(ch, uint32(order[end]>>32))
+		}
+		ch.mu.Unlock()
+		start = end
+	}
+	for _, unique := range out[:len(ns)] {
+		c.record(unique)
+	}
+}
+
+func (c *adaptiveChecker) record(unique bool) {
+	if unique {
+		c.r.markUnique()
+		c.r.setMemory(uint64(c.bytes.Load()))
+	} else {
+		c.r.markDuplicate()
+	}
+}
+
+// Reset drops every chunk.
+func (c *adaptiveChecker) Reset() {
+	for i := range c.chunks {
+		p := syncatomic.SwapPointer(&c.chunks[i], nil)
+		if p == nil {
+			continue
+		}
+		ch := (*adaptiveChunk)(p)
+		ch.mu.Lock()
+		ch.dropped = true
+		if ch.dense != nil {
+			c.dense.Dec()
+			c.bytes.Sub(int64(adaptiveChunkOverhead + adaptiveDenseSize))
+		} else {
+			c.sparse.Dec()
+			c.bytes.Sub(int64(adaptiveChunkOverhead + 2*cap(ch.sparse)))
+		}
+		ch.mu.Unlock()
+	}
+	c.r.markReset()
+	c.r.setMemory(uint64(c.bytes.Load()))
+}
+
+// Forget removes n from its chunk, which keeps its representation.
+func (c *adaptiveChecker) Forget(n uint32) (forgotten bool) {
+	p := syncatomic.LoadPointer(&c.chunks[n>>adaptiveChunkBits])
+	if p == nil {
+		return false
+	}
+	ch := (*adaptiveChunk)(p)
+	x := uint16(n)
+	ch.mu.Lock()
+	if !ch.dropped && ch.contains(x) {
+		forgotten = true
+		if ch.dense != nil {
+			ch.dense[x/64] &^= uint64(1) << (x % 64)
+		} else {
+			i := sort.Search(len(ch.sparse), func(i int) bool {
+				return ch.sparse[i] >= x
+			})
+			ch.sparse = append(ch.sparse[:i], ch.sparse[i+1:]...)
+		}
+	}
+	ch.mu.Unlock()
+	if forgotten {
+		c.r.markForgotten()
+	}
+	return forgotten
+}
+
+// Stats returns the current representation mix and memory footprint.
+func (c *adaptiveChecker) Stats() AdaptiveStats {
+	return AdaptiveStats{
+		SparseChunks: c.sparse.Load(),
+		DenseChunks:  c.dense.Load(),
+		Bytes:        c.bytes.Load(),
+	}
+}
+
+func (c *adaptiveChecker) GetReport() string {
+	s := c.Stats()
+	return c.r.getReport() + fmt.Sprintf(". Chunks: %v sparse, %v dense", s.SparseChunks, s.DenseChunks)
+}
+
+func (c *adaptiveChecker) walk(fn func(n uint32) bool) {
+	var seen []uint32
+	for i := range c.chunks {
+		p := syncatomic.LoadPointer(&c.chunks[i])
+		if p == nil {
+			continue
+		}
+		ch := (*adaptiveChunk)(p)
+		hi := uint32(i) << adaptiveChunkBits
+		seen = seen[:0]
+		ch.mu.Lock()
+		if ch.dense != nil {
+			for w, word := range ch.dense {
+				for ; word != 0; word &= word - 1 {
+					seen = append(seen, hi|uint32(w*64+bits.TrailingZeros64(word)))
+				}
+			}
+		} else {
+			for _, x := range ch.sparse {
+				seen = append(seen, hi|uint32(x))
+			}
+		}
+		ch.mu.Unlock()
+		for _, n := range seen {
+			if !fn(n) {
+				return
+			}
+		}
+	}
+}
+
+func (c *adaptiveChecker) countRange(from, to uint32) (count uint64) {
+	for i := from >> adaptiveChunkBits; i <= to>>adaptiveChunkBits; i++ {
+		p := syncatomic.LoadPointer(&c.chunks[i])
+		if p == nil {
+			continue
+		}
+		ch := (*adaptiveChunk)(p)
+		lo, hi := uint32(0), uint32(adaptiveChunkSize-1)
+		if i == from>>adaptiveChunkBits {
+			lo = from % adaptiveChunkSize
+		}
+		if i == to>>adaptiveChunkBits {
+			hi = to % adaptiveChunkSize
+		}
+		ch.mu.Lock()
+		if ch.dense != nil {
+			count += countBits(ch.dense[:], lo, hi)
+		} else {
+			start := sort.Search(len(ch.sparse), func(j int) bool {
+				return uint32(ch.sparse[j]) >= lo
+			})
+			end := sort.Search(len(ch.sparse), func(j int) bool {
+				return uint32(ch.sparse[j]) > hi
+			})
+			count += uint64(end - start)
+		}
+		ch.mu.Unlock()
+	}
+	return count
+}
+
+func (c *adaptiveChecker) restore(n uint32) (restored bool) {
+	ch := c.chunk(n)
+	ch.mu.Lock()
+	restored = c.mark(ch, n)
+	ch.mu.Unlock()
+	if restored {
+		c.r.markRestored()
+		c.r.setMemory(uint64(c.bytes.Load()))
+	}
+	return restored
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestAddOkayAdaptive(t *testing.T) {
+	mr := &mockRecorder{}
+	mr.On("markUnique").Return()
+	mr.On("setMemory", mock.Anything).Return()
+	testAddOkay(t, newAdaptiveChecker(mr, 0))
+}
+
+func TestAddDuplicateAdaptive(t *testing.T) {
+	mr := &mockRecorder{}
+	mr.On("markUnique").Return()
+	mr.On("markDuplicate").Return()
+	mr.On("setMemory", mock.Anything).Return()
+	testAddDuplicate(t, newAdaptiveChecker(mr, 0))
+}
+
+func TestAdaptiveChecker_migrate(t *testing.T) {
+	r := NewRecorder()
+	c := newAdaptiveChecker(r, 100)
+	assert.Equal(t, AdaptiveStats{Bytes: int64(adaptiveChunks) * 8}, c.Stats())
+
+	base := uint32(5 << adaptiveChunkBits)
+	for i := uint32(0); i < 99; i++ {
+		assert.True(t, c.IsUnique(base+i*3))
+	}
+	sparse := c.Stats()
+	assert.Equal(t, int64(1), sparse.SparseChunks)
+	assert.Zero(t, sparse.DenseChunks)
+	assert.Less(t, sparse.Bytes, int64(adaptiveChunks)*8+adaptiveDenseSize)
+
+	// The hundredth number turns the chunk into a bitset.
+	assert.True(t, c.IsUnique(base+1))
+	dense := c.Stats()
+	assert.Zero(t, dense.SparseChunks)
+	assert.Equal(t, int64(1), dense.DenseChunks)
+	assert.Equal(t, int64(adaptiveChunks)*8+int64(adaptiveChunkOverhead)+adaptiveDenseSize, dense.Bytes)
+	assert.Equal(t, uint64(dense.Bytes), r.(*recorder).m.Load())
+
+	for i := uint32(0); i < 99; i++ {
+		assert.False(t, c.IsUnique(base+i*3), "number %v", base+i*3)
+	}
+	assert.False(t, c.IsUnique(base+1))
+	assert.True(t, c.IsUnique(base+2))
+
+	var walked []uint32
+	c.walk(func(n uint32) bool {
+		walked = append(walked, n)
+		return true
+	})
+	assert.Len(t, walked, 101)
+	assert.Equal(t, []uint32{base, base + 1, base + 2, base + 3}, walked[:4])
+	assert.Contains(t, c.GetReport(), ". Chunks: 0 sparse, 1 dense")
+}
+
+func TestAdaptiveChecker_reset(t *testing.T) {
+	r := NewRecorder()
+	c := newAdaptiveChecker(r, 3)
+	for _, n := range []uint32{1, 2, 3, 70000} {
+		c.IsUnique(n)
+	}
+	assert.True(t, c.Forget(2), "forgotten from a dense chunk")
+	assert.True(t, c.IsUnique(2))
+	assert.Equal(t, int64(1), c.Stats().DenseChunks)
+
+	dropped := (*adaptiveChunk)(c.chunks[0])
+	c.Reset()
+	assert.Equal(t, AdaptiveStats{Bytes: int64(adaptiveChunks) * 8}, c.Stats())
+	assert.Equal(t, uint64(c.Stats().Bytes), r.(*recorder).m.Load())
+	// A number checked against a chunk as it is dropped counts as checked
+	// before the reset.
+	assert.False(t, c.mark(dropped, 1))
+	assert.True(t, c.mark(dropped, 9))
+	assert.Equal(t, AdaptiveStats{Bytes: int64(adaptiveChunks) * 8}, c.Stats())
+}
+
+func TestAdaptiveChecker_concurrent(t *testing.T) {
+	c := newAdaptiveChecker(&noopRecorder{}, 64)
+	rnd := rand.New(rand.NewSource(42))
+	// A few chunks, so most of them go past the threshold while being used.
+	ns := make([]uint32, 4000)
+	for i := range ns {
+		ns[i] = uint32(rnd.Intn(4))<<adaptiveChunkBits | uint32(rnd.Intn(2000))
+	}
+	var (
+		mu     sync.Mutex
+		unique = make(map[uint32]int)
+		wg     sync.WaitGroup
+	)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			batch := make([]bool, 16)
+			for i := g * 16; i < len(ns); i += 8 * 16 {
+				end := i + 16
+				if end > len(ns) {
+					end = len(ns)
+				}
+				c.IsUniqueBatch(ns[i:end], batch)
+				for j, u := range batch[:end-i] {
+					if u {
+						mu.Lock()
+						unique[ns[i+j]]++
+						mu.Unlock()
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	seen := make(map[uint32]bool)
+	for _, n := range ns {
+		seen[n] = true
+	}
+	require.Len(t, unique, len(seen))
+	for n, count := range unique {
+		assert.Equal(t, 1, count, "number %v", n)
+	}
+	stats := c.Stats()
+	assert.Equal(t, int64(4), stats.SparseChunks+stats.DenseChunks)
+	assert.NotZero(t, stats.DenseChunks)
+}
+
+func BenchmarkAdaptiveChecker(b *testing.B) {
+	c := newAdaptiveChecker(&noopRecorder{}, 0)
+	rnd := rand.New(rand.NewSource(42))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.IsUnique(uint32(rnd.Intn(numberSpace)))
+	}
+	s := c.Stats()
+	b.ReportMetric(float64(s.Bytes), "bytes")
+	b.ReportMetric(float64(s.DenseChunks), "dense")
+}
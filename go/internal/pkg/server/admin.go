@@ -0,0 +1,479 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type admin struct {
+	host     string
+	port     int
+	reg      Registry
+	mux      *http.ServeMux
+	server   *http.Server
+	listener net.Listener
+	access   AccessControl
+	pipeline Pipeline
+	checker  NumberChecker
+	est      Estimator
+	ns       Namespaces
+	// inflight are the requests being served, which may read the checker.
+	inflight sync.WaitGroup
+}
+
+// adminStopTimeout is how long Stop lets requests finish before closing
+// their connections.
+const adminStopTimeout = 5 * time.Second
+
+// ForgetResult is how many of the numbers sent to forget had been seen.
+type ForgetResult struct {
+	Forgotten int `json:"forgotten"`
+	Unseen    int `json:"unseen"`
+}
+
+// RangeCount is how many numbers of a range have been seen.
+type RangeCount struct {
+	From uint32 `json:"from"`
+	To   uint32 `json:"to"`
+	Seen uint64 `json:"seen"`
+}
+
+func NewAdmin(host string, port int, registry Registry) *admin {
+	a := &admin{
+		host: host,
+		port: port,
+		reg:  registry,
+		mux:  http.NewServeMux(),
+	}
+	a.mux.HandleFunc("/connections", a.connections)
+	a.mux.HandleFunc("/connections/disconnect", a.disconnect)
+	a.server = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.inflight.Add(1)
+		defer a.inflight.Done()
+		a.mux.ServeHTTP(w, r)
+	})}
+	return a
+}
+
+// SetAccessControl exposes reloading of the access rules.
+func (a *admin) SetAccessControl(ac AccessControl) {
+	a.access = ac
+	a.mux.HandleFunc("/access/reload", a.reloadAccess)
+}
+
+// SetPipeline exposes the depth of the pipeline queues.
+func (a *admin) SetPipeline(p Pipeline) {
+	a.pipeline = p
+	a.mux.HandleFunc("/pipeline", a.pipelineDepths)
+}
+
+// SetChecker exposes resetting nc and forgetting numbers, exporting the
+// numbers seen, along with its memory footprint and representation mix when
+// it keeps track of them and range counts when it can count ranges.
+func (a *admin) SetChecker(nc NumberChecker) {
+	a.checker = nc
+	a.mux.HandleFunc("/checker/reset", a.resetChecker)
+	a.mux.HandleFunc("/checker/forget", a.forgetNumbers)
+	a.mux.HandleFunc("/checker/export", a.exportNumbers)
+	if _, ok := nc.(*countingChecker); ok {
+		a.mux.HandleFunc("/checker/top", a.topNumbers)
+	}
+	if _, ok := baseChecker(nc).(rangeCounter); ok {
+		a.mux.HandleFunc("/checker/count", a.countRange)
+		a.mux.HandleFunc("/checker/coverage", a.coverage)
+	}
+	if _, ok := baseChecker(nc).(checkerStats); ok {
+		a.mux.HandleFunc("/checker", a.checkerStats)
+	}
+}
+
+// SetEstimator exposes the distinct count estimates and their roll ups.
+func (a *admin) SetEstimator(est Estimator) {
+	a.est = est
+	a.mux.HandleFunc("/estimates", a.estimates)
+	a.mux.HandleFunc("/estimates/rollup", a.rollUp)
+}
+
+// SetNamespaces exposes the numbers received by each namespace and makes
+// the checker endpoints act on the one of the namespace parameter.
+func (a *admin) SetNamespaces(ns Namespaces) {
+	a.ns = ns
+	a.mux.HandleFunc("/namespaces", a.namespaces)
+}
+
+func (a *admin) Start() (err error) {
+	a.listener, err = net.Listen("tcp", fmt.Sprintf("%s:%v", a.host, a.port))
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := a.server.Serve(a.listener); err != nil && err != http.ErrServerClosed {
+			fmt.Println(err)
+		}
+	}()
+	return nil
+}
+
+// Stop stops serving and returns once every request has, so the checker
+// can be closed. Requests still running after adminStopTimeout have their
+// connections closed.
+func (a *admin) Stop() (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), adminStopTimeout)
+	defer cancel()
+	if err = a.server.Shutdown(ctx); err == context.DeadlineExceeded {
+		err = a.server.Close()
+	}
+	a.inflight.Wait()
+	return err
+}
+
+func (a *admin) connections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, a.reg.Connections())
+}
+
+func (a *admin) disconnect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid connection id", http.StatusBadRequest)
+		return
+	}
+	if !a.reg.Disconnect(id) {
+		http.Error(w, "connection not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *admin) reloadAccess(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := a.access.Reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *admin) pipelineDepths(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, a.pipeline.Depths())
+}
+
+func (a *admin) checkerStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nc, ok := a.checkerOf(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, baseChecker(nc).(checkerStats).Stats())
+}
+
+func (a *admin) namespaces(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, a.ns.Stats())
+}
+
+func (a *admin) topNumbers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nc, ok := a.checkerOf(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, nc.(*countingChecker).Top())
+}
+
+func (a *admin) resetChecker(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nc, ok := a.checkerOf(w, r)
+	if !ok {
+		return
+	}
+	nc.Reset()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// maxForgetBody is the largest upload of numbers to forget, about 1.5
+// million numbers.
+const maxForgetBody = 16 << 20
+
+// forgetNumbers forgets the numbers given as number parameters or, without
+// any, the numbers of the body, one per line. Nothing is forgotten unless
+// every number is valid.
+func (a *admin) forgetNumbers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nc, ok := a.checkerOf(w, r)
+	if !ok {
+		return
+	}
+	if !canForget(nc) {
+		http.Error(w, errForgetUnsupported.Error(), http.StatusNotImplemented)
+		return
+	}
+	var ns []uint32
+	if values := r.URL.Query()["number"]; len(values) > 0 {
+		for _, v := range values {
+			n, err := parseNumber(v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			ns = append(ns, n)
+		}
+	} else {
+		// The whole body is read first, so an upload cut short by the limit
+		// is not reported as an invalid last line.
+		var lines []string
+		s := bufio.NewScanner(http.MaxBytesReader(w, r.Body, maxForgetBody))
+		for s.Scan() {
+			lines = append(lines, strings.TrimSpace(s.Text()))
+		}
+		if err := s.Err(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for i, v := range lines {
+			if v == "" {
+				continue
+			}
+			n, err := parseNumber(v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("line %v: %v", i+1, err), http.StatusBadRequest)
+				return
+			}
+			ns = append(ns, n)
+		}
+	}
+	var result ForgetResult
+	for _, n := range ns {
+		if nc.Forget(n) {
+			result.Forgotten++
+		} else {
+			result.Unseen++
+		}
+	}
+	writeJSON(w, result)
+}
+
+func (a *admin) estimates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, a.est.Estimates())
+}
+
+// rollUp merges the hourly sketches that started from the from parameter
+// and before the to parameter, both RFC 3339 times, every hour kept by
+// default.
+func (a *admin) rollUp(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var from, to time.Time
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		v := r.URL.Query().Get(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid %s %q", p.name, v), http.StatusBadRequest)
+			return
+		}
+		*p.t = t
+	}
+	if to.IsZero() {
+		to = time.Now().Add(time.Hour)
+	}
+	writeJSON(w, a.est.RollUp(from, to))
+}
+
+// countRange counts the numbers seen from the from parameter to the to
+// parameter, both included, the whole number space by default.
+func (a *admin) countRange(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	from, to, err := rangeParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	nc, ok := a.checkerOf(w, r)
+	if !ok {
+		return
+	}
+	seen, err := CountRange(nc, from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, RangeCount{From: from, To: to, Seen: seen})
+}
+
+// coverage reports how much of each block of the block parameter, a
+// million numbers by default, is seen in the range of the from and to
+// parameters.
+func (a *admin) coverage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	from, to, err := rangeParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	block := uint64(DefaultCoverageBlock)
+	if v := r.URL.Query().Get("block"); v != "" {
+		if block, err = strconv.ParseUint(v, 10, 32); err != nil {
+			http.Error(w, fmt.Sprintf("invalid block size %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	nc, ok := a.checkerOf(w, r)
+	if !ok {
+		return
+	}
+	c, err := CoverageOf(nc, from, to, uint32(block))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, c)
+}
+
+// rangeParams parses the from and to parameters, which default to the
+// first and last number.
+func rangeParams(r *http.Request) (from, to uint32, err error) {
+	to = maxNumber
+	for _, p := range []struct {
+		name string
+		n    *uint32
+	}{{"from", &from}, {"to", &to}} {
+		v := r.URL.Query().Get(p.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid %s %q", p.name, v)
+		}
+		*p.n = uint32(n)
+	}
+	return from, to, nil
+}
+
+// exportContentTypes is the content type served for each ExportFormat.
+var exportContentTypes = map[ExportFormat]string{
+	ExportText:   "text/plain; charset=utf-8",
+	ExportCSV:    "text/csv; charset=utf-8",
+	ExportBinary: "application/octet-stream",
+}
+
+// exportNumbers streams the numbers seen in ascending order, in the format
+// given by the format parameter, text by default.
+func (a *admin) exportNumbers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	format := ExportText
+	if v := r.URL.Query().Get("format"); v != "" {
+		var err error
+		if format, err = ParseExportFormat(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	nc, ok := a.checkerOf(w, r)
+	if !ok {
+		return
+	}
+	if _, ok := baseChecker(nc).(snapshotter); !ok {
+		http.Error(w, errExportUnsupported.Error(), http.StatusNotImplemented)
+		return
+	}
+	w.Header().Set("Content-Type", exportContentTypes[format])
+	if _, err := Export(nc, w, format); err != nil {
+		// The status has been sent, the client sees a truncated body.
+		fmt.Println(err)
+	}
+}
+
+// checkerOf returns the checker of the namespace parameter, the default
+// checker without one. It replies with an error and returns false when the
+// namespace was not created.
+func (a *admin) checkerOf(w http.ResponseWriter, r *http.Request) (NumberChecker, bool) {
+	name := r.URL.Query().Get("namespace")
+	if name == "" {
+		return a.checker, true
+	}
+	if a.ns == nil {
+		http.Error(w, "namespaces are disabled", http.StatusNotFound)
+		return nil, false
+	}
+	n := a.ns.lookup(name)
+	if n == nil {
+		http.Error(w, fmt.Sprintf("namespace %q not found", name), http.StatusNotFound)
+		return nil, false
+	}
+	return n.nc, true
+}
+
+// parseNumber parses a number as producers send it, nine digits.
+func parseNumber(v string) (uint32, error) {
+	n, err := strconv.ParseUint(v, 10, 32)
+	if len(v) != 9 || err != nil {
+		return 0, fmt.Errorf("invalid number %q", v)
+	}
+	return uint32(n), nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,417 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminConnections(t *testing.T) {
+	r := NewRegistry()
+	s, c := net.Pipe()
+	defer s.Close()
+	defer c.Close()
+	cs := r.add(c, func() {})
+	cs.received.Add(5)
+	a := NewAdmin("127.0.0.1", 0, r)
+
+	rec := httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/connections", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var conns []ConnectionInfo
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&conns))
+	require.Len(t, conns, 1)
+	assert.Equal(t, uint64(5), conns[0].Received)
+
+	rec = httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/connections", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestAdminDisconnect(t *testing.T) {
+	r := NewRegistry()
+	s, c := net.Pipe()
+	defer s.Close()
+	defer c.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	r.add(c, cancel)
+	a := NewAdmin("127.0.0.1", 0, r)
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		code   int
+	}{
+		{name: "WrongMethod", method: http.MethodGet, target: "/connections/disconnect?id=1", code: http.StatusMethodNotAllowed},
+		{name: "BadID", method: http.MethodPost, target: "/connections/disconnect?id=abc", code: http.StatusBadRequest},
+		{name: "NotFound", method: http.MethodPost, target: "/connections/disconnect?id=2", code: http.StatusNotFound},
+		{name: "Disconnected", method: http.MethodPost, target: "/connections/disconnect?id=1", code: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			a.mux.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.target, nil))
+			assert.Equal(t, tt.code, rec.Code)
+		})
+	}
+	assert.Error(t, ctx.Err(), "expected connection to be cancelled")
+}
+
+func TestAdminStartAndStop(t *testing.T) {
+	a := NewAdmin("127.0.0.1", 0, NewRegistry())
+	require.NoError(t, a.Start())
+	resp, err := http.Get("http://" + a.listener.Addr().String() + "/connections")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, resp.Body.Close())
+	assert.NoError(t, a.Stop())
+}
+
+func TestAdminStopWaitsForRequests(t *testing.T) {
+	a := NewAdmin("127.0.0.1", 0, NewRegistry())
+	started := make(chan struct{})
+	finished := make(chan struct{})
+	a.mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		close(finished)
+	})
+	require.NoError(t, a.Start())
+	go func() {
+		if resp, err := http.Get("http://" + a.listener.Addr().String() + "/slow"); err == nil {
+			_ = resp.Body.Close()
+		}
+	}()
+	<-started
+	assert.NoError(t, a.Stop())
+	select {
+	case <-finished:
+	default:
+		t.Fatal("Stop returned while a request was being served")
+	}
+}
+
+func TestAdminReloadAccess(t *testing.T) {
+	a := NewAdmin("127.0.0.1", 0, NewRegistry())
+	rec := httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/access/reload", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code, "expected no route without access control")
+
+	ac, err := NewAccessControl("", &noopRecorder{})
+	require.NoError(t, err)
+	a.SetAccessControl(ac)
+	rec = httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/access/reload", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	rec = httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/access/reload", nil))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	a.access = &accessControl{file: "/does/not/exist"}
+	rec = httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/access/reload", nil))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+}
+
+func TestAdminPipeline(t *testing.T) {
+	a := NewAdmin("127.0.0.1", 0, NewRegistry())
+	p := newPipeline(newMapChecker(&noopRecorder{}), new(mockLog), PipelineConfig{NumberQueue: 4, WriteQueue: 8})
+	assert.True(t, p.push(context.Background(), 1, &connStats{}))
+	a.SetPipeline(p)
+
+	rec := httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/pipeline", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var depths PipelineDepths
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &depths))
+	assert.Equal(t, PipelineDepths{Numbers: 1, NumbersCap: 4, WritesCap: 8, MaxNumbers: 1}, depths)
+
+	rec = httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/pipeline", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestAdminChecker(t *testing.T) {
+	a := NewAdmin("127.0.0.1", 0, NewRegistry())
+	a.SetChecker(newMapChecker(&noopRecorder{}))
+	rec := httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/checker", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code, "the map checker keeps no stats")
+
+	c := newAdaptiveChecker(&noopRecorder{}, 2)
+	c.IsUnique(1)
+	c.IsUnique(2)
+	c.IsUnique(70000)
+	a = NewAdmin("127.0.0.1", 0, NewRegistry())
+	a.SetChecker(c)
+	rec = httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/checker", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var stats AdaptiveStats
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &stats))
+	assert.Equal(t, c.Stats(), stats)
+	assert.Equal(t, int64(1), stats.SparseChunks)
+	assert.Equal(t, int64(1), stats.DenseChunks)
+
+	rec = httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/checker", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestAdminResetAndForget(t *testing.T) {
+	r := NewRecorder()
+	c := newMapChecker(r)
+	for _, n := range []uint32{1, 2, 3, 4} {
+		c.IsUnique(n)
+	}
+	a := NewAdmin("127.0.0.1", 0, NewRegistry())
+	a.SetChecker(c)
+
+	tests := []struct {
+		name     string
+		target   string
+		body     string
+		code     int
+		expected string
+	}{
+		{name: "Query", target: "/checker/forget?number=000000001&number=000000009", code: http.StatusOK, expected: `{"forgotten":1,"unseen":1}`},
+		{name: "Body", target: "/checker/forget", body: "000000002\n\n000000003\n000000002\n", code: http.StatusOK, expected: `{"forgotten":2,"unseen":1}`},
+		{name: "InvalidQuery", target: "/checker/forget?number=4", code: http.StatusBadRequest, expected: "invalid number \"4\"\n"},
+		{name: "InvalidLine", target: "/checker/forget", body: "000000004\nabc\n", code: http.StatusBadRequest, expected: "line 2: invalid number \"abc\"\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body)))
+			assert.Equal(t, tt.code, rec.Code)
+			if tt.code == http.StatusOK {
+				assert.JSONEq(t, tt.expected, rec.Body.String())
+			} else {
+				assert.Equal(t, tt.expected, rec.Body.String())
+			}
+		})
+	}
+	assert.False(t, c.IsUnique(4), "nothing is forgotten from an invalid upload")
+	assert.Contains(t, r.getReport(), "Unique total: 1. Forgotten numbers: 3")
+
+	rec := httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/checker/reset", nil))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.True(t, c.IsUnique(4))
+	assert.Contains(t, r.getReport(), "Unique total: 1. Forgotten numbers: 3. Resets: 1")
+
+	for _, target := range []string{"/checker/reset", "/checker/forget"} {
+		rec = httptest.NewRecorder()
+		a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	}
+}
+
+func TestAdminForgetBloom(t *testing.T) {
+	c, err := newBloomChecker(&noopRecorder{}, 1000, 0.01)
+	require.NoError(t, err)
+	c.IsUnique(1)
+	a := NewAdmin("127.0.0.1", 0, NewRegistry())
+	a.SetChecker(c)
+	rec := httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/checker/forget?number=000000001", nil))
+	assert.Equal(t, http.StatusNotImplemented, rec.Code)
+	assert.Equal(t, "number checker cannot forget numbers\n", rec.Body.String())
+	assert.False(t, c.IsUnique(1))
+}
+
+func TestAdminForgetTooLarge(t *testing.T) {
+	a := NewAdmin("127.0.0.1", 0, NewRegistry())
+	a.SetChecker(newMapChecker(&noopRecorder{}))
+	body := strings.Repeat("000000001\n", maxForgetBody/10+1)
+	rec := httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/checker/forget", strings.NewReader(body)))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, "http: request body too large\n", rec.Body.String())
+}
+
+func TestAdminTopNumbers(t *testing.T) {
+	a := NewAdmin("127.0.0.1", 0, NewRegistry())
+	a.SetChecker(newMapChecker(&noopRecorder{}))
+	rec := httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/checker/top", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code, "duplicates are not counted")
+
+	c, err := newCountingChecker(newAdaptiveChecker(&noopRecorder{}, 0), "exact", 2)
+	require.NoError(t, err)
+	for _, n := range []uint32{1, 1, 2, 2, 2, 3, 3, 3, 3} {
+		c.IsUnique(n)
+	}
+	a = NewAdmin("127.0.0.1", 0, NewRegistry())
+	a.SetChecker(c)
+	rec = httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/checker/top", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `[{"number":3,"count":4},{"number":2,"count":3}]`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/checker", nil))
+	assert.Equal(t, http.StatusOK, rec.Code, "the stats of the counted checker are still served")
+
+	rec = httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/checker/top", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestAdminExport(t *testing.T) {
+	c := newPagedChecker(&noopRecorder{})
+	c.IsUnique(7)
+	c.IsUnique(3)
+	a := NewAdmin("127.0.0.1", 0, NewRegistry())
+	a.SetChecker(c)
+
+	tests := []struct {
+		name        string
+		target      string
+		code        int
+		contentType string
+		expected    string
+	}{
+		{name: "Default", target: "/checker/export", code: http.StatusOK, contentType: "text/plain; charset=utf-8", expected: "000000003\n000000007\n"},
+		{name: "CSV", target: "/checker/export?format=csv", code: http.StatusOK, contentType: "text/csv; charset=utf-8", expected: "number\n000000003\n000000007\n"},
+		{name: "Binary", target: "/checker/export?format=binary", code: http.StatusOK, contentType: "application/octet-stream", expected: "NLSNAP01\x04\x04\x00\x02"},
+		{name: "UnknownFormat", target: "/checker/export?format=xml", code: http.StatusBadRequest, contentType: "text/plain; charset=utf-8", expected: "unknown export format \"xml\"\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			assert.Equal(t, tt.code, rec.Code)
+			assert.Equal(t, tt.contentType, rec.Header().Get("Content-Type"))
+			assert.Equal(t, tt.expected, rec.Body.String())
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/checker/export", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	a = NewAdmin("127.0.0.1", 0, NewRegistry())
+	a.SetChecker(newTestBloomChecker(t, &noopRecorder{}, 1000, 0.01))
+	rec = httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/checker/export", nil))
+	assert.Equal(t, http.StatusNotImplemented, rec.Code)
+}
+
+func TestAdminRanges(t *testing.T) {
+	a := NewAdmin("127.0.0.1", 0, NewRegistry())
+	a.SetChecker(newMapChecker(&noopRecorder{}))
+	for _, target := range []string{"/checker/count", "/checker/coverage"} {
+		rec := httptest.NewRecorder()
+		a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, http.StatusNotFound, rec.Code, "the map checker is not a bitset")
+	}
+
+	c := newPagedChecker(&noopRecorder{})
+	for _, n := range []uint32{5, 150000000, 150000001} {
+		c.IsUnique(n)
+	}
+	a = NewAdmin("127.0.0.1", 0, NewRegistry())
+	a.SetChecker(c)
+	tests := []struct {
+		name     string
+		target   string
+		code     int
+		expected string
+	}{
+		{name: "CountAll", target: "/checker/count", code: http.StatusOK, expected: `{"from":0,"to":999999999,"seen":3}`},
+		{name: "Count", target: "/checker/count?from=100000000&to=199999999", code: http.StatusOK, expected: `{"from":100000000,"to":199999999,"seen":2}`},
+		{name: "CountInvalid", target: "/checker/count?from=abc", code: http.StatusBadRequest, expected: "invalid from \"abc\"\n"},
+		{name: "CountOutOfRange", target: "/checker/count?to=1000000000", code: http.StatusBadRequest, expected: "invalid range 000000000-1000000000\n"},
+		{name: "Coverage", target: "/checker/coverage?from=0&to=9&block=4", code: http.StatusOK, expected: `{"from":0,"to":9,"blockSize":4,"seen":1,"full":0,"empty":2,"blocks":[
+			{"start":0,"end":3,"seen":0,"fill":0},{"start":4,"end":7,"seen":1,"fill":0.25},{"start":8,"end":9,"seen":0,"fill":0}]}`},
+		{name: "CoverageInvalidBlock", target: "/checker/coverage?block=-1", code: http.StatusBadRequest, expected: "invalid block size \"-1\"\n"},
+		{name: "CoverageTooManyBlocks", target: "/checker/coverage?block=1", code: http.StatusBadRequest, expected: "1000000000 blocks of 1 numbers, at most 100000 are reported\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			assert.Equal(t, tt.code, rec.Code)
+			if tt.code == http.StatusOK {
+				assert.JSONEq(t, tt.expected, rec.Body.String())
+			} else {
+				assert.Equal(t, tt.expected, rec.Body.String())
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/checker/coverage", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var cov Coverage
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &cov))
+	assert.Len(t, cov.Blocks, 1000)
+	assert.Equal(t, 998, cov.Empty)
+
+	for _, target := range []string{"/checker/count", "/checker/coverage"} {
+		rec = httptest.NewRecorder()
+		a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, target, nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	}
+}
+
+func TestAdminEstimates(t *testing.T) {
+	est, err := NewEstimator(EstimatorConfig{Clients: 4, PrefixDigits: 1}, &noopRecorder{})
+	require.NoError(t, err)
+	est.observe(newTestConn("10.0.0.1:4567", ""), []uint32{1, 2, 300000000})
+	a := NewAdmin("127.0.0.1", 0, NewRegistry())
+	a.SetEstimator(est)
+
+	rec := httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/estimates", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var e Estimates
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &e))
+	assert.Equal(t, uint64(3), e.Window)
+	assert.Equal(t, map[string]uint64{"10.0.0.1": 3}, e.Clients)
+	assert.Equal(t, map[string]uint64{"0": 2, "3": 1}, e.Prefixes)
+	require.Len(t, e.Hours, 1)
+	var s Sketch
+	require.NoError(t, s.UnmarshalBinary(e.Hours[0].Sketch), "sketches are sent as base64")
+
+	tests := []struct {
+		name     string
+		target   string
+		code     int
+		distinct uint64
+		expected string
+	}{
+		{name: "Everything", target: "/estimates/rollup", code: http.StatusOK, distinct: 3},
+		{name: "Future", target: "/estimates/rollup?from=2999-01-01T00:00:00Z", code: http.StatusOK, distinct: 0},
+		{name: "Invalid", target: "/estimates/rollup?to=yesterday", code: http.StatusBadRequest, expected: "invalid to \"yesterday\"\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			assert.Equal(t, tt.code, rec.Code)
+			if tt.code != http.StatusOK {
+				assert.Equal(t, tt.expected, rec.Body.String())
+				return
+			}
+			var r RollUp
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &r))
+			assert.Equal(t, tt.distinct, r.Distinct)
+		})
+	}
+
+	for _, target := range []string{"/estimates", "/estimates/rollup"} {
+		rec = httptest.NewRecorder()
+		a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, target, nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	}
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go.uber.org/atomic"
+	"io"
+	"math"
+	"math/bits"
+	"sync"
+	syncatomic "sync/atomic"
+)
+
+const (
+	// DefaultBloomExpected is the number of unique numbers a bloom checker is
+	// sized for when none is configured.
+	DefaultBloomExpected = 10000000
+	// DefaultBloomFalsePositiveRate is the rate of unique numbers reported as
+	// duplicates a bloom checker is sized for when none is configured.
+	DefaultBloomFalsePositiveRate = 0.001
+	bloomStripes                  = 64
+)
+
+// A bloom snapshot is bloomMagic, the little endian uint64 number of bits,
+// the little endian uint32 number of hashes and then the bits as little
+// endian uint64 words. It can only be read into a bloom checker of the same
+// size.
+var bloomMagic = []byte("NLBLOOM1")
+
+// bloomChecker is a bloom filter, so it takes the same memory whatever
+// numbers it is sent, at the cost of reporting some unique numbers as
+// duplicates. Bits are set with compare and swap; the numbers are spread
+// over striped locks only so a number sent on two connections at once is
+// unique on one of them.
+type bloomChecker struct {
+	words  []uint64
+	m      uint64
+	k      uint32
+	set    atomic.Uint64
+	stripe [bloomStripes]sync.Mutex
+	r      Recorder
+}
+
+// newBloomChecker sizes the filter for expected unique numbers at a false
+// positive rate of rate.
+func newBloomChecker(r Recorder, expected int, rate float64) (*bloomChecker, error) {
+	if expected <= 0 {
+		expected = DefaultBloomExpected
+	}
+	if rate == 0 {
+		rate = DefaultBloomFalsePositiveRate
+	}
+	if rate < 0 || rate >= 1 {
+		return nil, fmt.Errorf("false positive rate %v out of range (0, 1)", rate)
+	}
+	m := uint64(math.Ceil(-float64(expected) * math.Log(rate) / (math.Ln2 * math.Ln2)))
+	m = (m + 63) / 64 * 64
+	k := uint32(math.Round(float64(m) / float64(expected) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return newBloomCheckerSized(r, m, k), nil
+}
+
+func newBloomCheckerSized(r Recorder, m uint64, k uint32) *bloomChecker {
+	c := &bloomChecker{
+		words: make([]uint64, m/64),
+		m:     m,
+		k:     k,
+		r:     r,
+	}
+	r.setMemory(m / 8)
+	r.setFalsePositiveRate(0)
+	return c
+}
+
+// hash mixes n with splitmix64 into the two hashes the bit positions are
+// derived from.
+func (c *bloomChecker) hash(n uint32) (h1, h2 uint64) {
+	z := mix64(uint64(n) + 0x9e3779b97f4a7c15)
+	return z, bits.RotateLeft64(z, 32) | 1
+}
+
+// mark sets the bits of n and reports whether any was unset.
+func (c *bloomChecker) mark(n uint32) (unique bool) {
+	h1, h2 := c.hash(n)
+	s := &c.stripe[h1%bloomStripes]
+	s.Lock()
+	defer s.Unlock()
+	for i := uint64(0); i < uint64(c.k); i++ {
+		b := (h1 + i*h2) % c.m
+		word, bit := &c.words[b/64], uint64(1)<<(b%64)
+		for {
+			old := syncatomic.LoadUint64(word)
+			if old&bit != 0 {
+				break
+			}
+			if syncatomic.CompareAndSwapUint64(word, old, old|bit) {
+				c.set.Inc()
+				unique = true
+				break
+			}
+		}
+	}
+	return unique
+}
+
+// contains reports whether every bit of n is set, without setting them.
+func (c *bloomChecker) contains(n uint32) bool {
+	h1, h2 := c.hash(n)
+	for i := uint64(0); i < uint64(c.k); i++ {
+		b := (h1 + i*h2) % c.m
+		if syncatomic.LoadUint64(&c.words[b/64])&(uint64(1)<<(b%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *bloomChecker) IsUnique(n uint32) (unique bool) {
+	if unique = c.mark(n); unique {
+		c.r.markUnique()
+		c.r.setFalsePositiveRate(c.FalsePositiveRate())
+	} else {
+		c.r.markDuplicate()
+	}
+	return unique
+}
+
+func (c *bloomChecker) IsUniqueBatch(ns []uint32, out []bool) {
+	for i, n := range ns {
+		out[i] = c.IsUnique(n)
+	}
+}
+
+// restore adds n without counting it as a received number, so seed files
+// can be loaded into the filter.
+func (c *bloomChecker) restore(n uint32) (restored bool) {
+	if restored = c.mark(n); restored {
+		c.r.markRestored()
+		c.r.setFalsePositiveRate(c.FalsePositiveRate())
+	}
+	return restored
+}
+
+// FalsePositiveRate estimates the chance of the next unique number being
+// reported as a duplicate from how many bits are set.
+func (c *bloomChecker) FalsePositiveRate() float64 {
+	return math.Pow(float64(c.set.Load())/float64(c.m), float64(c.k))
+}
+
+// estimatedCount estimates how many unique numbers were added from how
+// many bits are set.
+func (c *bloomChecker) estimatedCount() uint64 {
+	set := float64(c.set.Load())
+	if set >= float64(c.m) {
+		return math.MaxUint32
+	}
+	return uint64(math.Round(-float64(c.m) / float64(c.k) * math.Log(1-set/float64(c.m))))
+}
+
+// Reset clears every bit.
+func (c *bloomChecker) Reset() {
+	for i := range c.stripe {
+		c.stripe[i].Lock()
+	}
+	for w := range c.words {
+		syncatomic.StoreUint64(&c.words[w], 0)
+	}
+	c.set.Store(0)
+	for i := range c.stripe {
+		c.stripe[i].Unlock()
+	}
+	c.r.markReset()
+	c.r.setFalsePositiveRate(0)
+}
+
+// Forget always returns false: the bits of a number are shared with others,
+// so a bloom filter cannot forget it.
+func (c *bloomChecker) Forget(n uint32) bool {
+	return false
+}
+
+func (c *bloomChecker) cannotForget() {}
+
+func (c *bloomChecker) GetReport() string {
+	return c.r.getReport()
+}
+
+func (c *bloomChecker) writeSnapshot(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	header := make([]byte, len(bloomMagic)+12)
+	copy(header, bloomMagic)
+	binary.LittleEndian.PutUint64(header[8:], c.m)
+	binary.LittleEndian.PutUint32(header[16:], c.k)
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+	buf := make([]byte, 8)
+	for i := range c.words {
+		binary.LittleEndian.PutUint64(buf, syncatomic.LoadUint64(&c.words[i]))
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// readSnapshot adds the bits of a bloom snapshot to the filter and returns
+// the estimated number of unique numbers restored.
+func (c *bloomChecker) readSnapshot(r io.Reader) (uint64, error) {
+	header := make([]byte, len(bloomMagic)+12)
+	if _, err := io.ReadFull(r, header[:8]); err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(header[:8], bloomMagic) {
+		return 0, errors.New("a bloom checker can only restore a bloom snapshot")
+	}
+	if _, err := io.ReadFull(r, header[8:]); err != nil {
+		return 0, fmt.Errorf("truncated snapshot: %w", err)
+	}
+	m, k := binary.LittleEndian.Uint64(header[8:]), binary.LittleEndian.Uint32(header[16:])
+	if m != c.m || k != c.k {
+		return 0, fmt.Errorf("bloom snapshot of %v bits and %v hashes, expected %v bits and %v hashes", m, k, c.m, c.k)
+	}
+	before := c.estimatedCount()
+	br := bufio.NewReader(r)
+	buf := make([]byte, 8)
+	for i := range c.words {
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return 0, fmt.Errorf("truncated snapshot: %w", err)
+		}
+		for {
+			old := syncatomic.LoadUint64(&c.words[i])
+			merged := old | binary.LittleEndian.Uint64(buf)
+			if syncatomic.CompareAndSwapUint64(&c.words[i], old, merged) {
+				c.set.Add(uint64(bits.OnesCount64(merged) - bits.OnesCount64(old)))
+				break
+			}
+		}
+	}
+	count := c.estimatedCount() - before
+	if count > 0 {
+		c.r.addRestored(count)
+	}
+	c.r.setFalsePositiveRate(c.FalsePositiveRate())
+	return count, nil
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func newTestBloomChecker(t testing.TB, r Recorder, expected int, rate float64) *bloomChecker {
+	c, err := newBloomChecker(r, expected, rate)
+	require.NoError(t, err)
+	return c
+}
+
+func TestAddOkayBloom(t *testing.T) {
+	mr := &mockRecorder{}
+	mr.On("markUnique").Return()
+	mr.On("setMemory", mock.Anything).Return()
+	mr.On("setMemory", mock.Anything).Return()
+	mr.On("setFalsePositiveRate", mock.Anything).Return()
+	testAddOkay(t, newTestBloomChecker(t, mr, 1000, 0.01))
+}
+
+func TestAddDuplicateBloom(t *testing.T) {
+	mr := &mockRecorder{}
+	mr.On("markUnique").Return()
+	mr.On("markDuplicate").Return()
+	mr.On("setMemory", mock.Anything).Return()
+	mr.On("setMemory", mock.Anything).Return()
+	mr.On("setFalsePositiveRate", mock.Anything).Return()
+	testAddDuplicate(t, newTestBloomChecker(t, mr, 1000, 0.01))
+}
+
+func TestBloomChecker_resetAndForget(t *testing.T) {
+	r := NewRecorder()
+	c := newTestBloomChecker(t, r, 1000, 0.01)
+	c.IsUnique(1)
+	c.IsUnique(2)
+	assert.False(t, c.Forget(1), "a bloom filter cannot forget")
+	assert.False(t, c.IsUnique(1))
+	c.Reset()
+	assert.Zero(t, c.set.Load())
+	assert.Equal(t, float64(0), c.FalsePositiveRate())
+	assert.True(t, c.IsUnique(1))
+	assert.Contains(t, r.getReport(), "Unique total: 1. Resets: 1")
+}
+
+func TestNewBloomChecker(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected int
+		rate     float64
+		m        uint64
+		k        uint32
+		err      string
+	}{
+		{name: "Small", expected: 1000, rate: 0.01, m: 9600, k: 7},
+		{name: "Defaults", m: 143775936, k: 10},
+		{name: "Negative", expected: 1000, rate: -0.1, err: "false positive rate -0.1 out of range (0, 1)"},
+		{name: "One", expected: 1000, rate: 1, err: "false positive rate 1 out of range (0, 1)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newBloomChecker(&noopRecorder{}, tt.expected, tt.rate)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.m, c.m)
+			assert.Equal(t, tt.k, c.k)
+			assert.Len(t, c.words, int(tt.m/64))
+		})
+	}
+}
+
+func TestBloomChecker_falsePositiveRate(t *testing.T) {
+	r := NewRecorder()
+	c := newTestBloomChecker(t, r, 10000, 0.01)
+	assert.Equal(t, float64(0), c.FalsePositiveRate())
+	assert.Contains(t, c.GetReport(), ". Checker memory: 11984 bytes. Probabilistic, estimated false positive rate: 0.0000%")
+
+	rnd := rand.New(rand.NewSource(42))
+	seen := make(map[uint32]bool)
+	for len(seen) < 10000 {
+		n := uint32(rnd.Intn(numberSpace))
+		if !seen[n] {
+			seen[n] = true
+			c.IsUnique(n)
+		}
+	}
+	// Full to the expected count, the estimate lands on the target rate.
+	assert.InDelta(t, 0.01, c.FalsePositiveRate(), 0.002)
+	assert.InDelta(t, 10000, float64(c.estimatedCount()), 200)
+	assert.Contains(t, c.GetReport(), ". Probabilistic, estimated false positive rate: 0.9")
+
+	// Never seen numbers are reported as duplicates at about that rate.
+	falsePositives := 0
+	for tries := 0; tries < 100000; {
+		n := uint32(rnd.Intn(numberSpace))
+		if seen[n] {
+			continue
+		}
+		tries++
+		if c.contains(n) {
+			falsePositives++
+		}
+	}
+	assert.InDelta(t, 1000, falsePositives, 300)
+	for n := range seen {
+		assert.False(t, c.IsUnique(n), "a seen number is never unique")
+	}
+}
+
+func TestBloomChecker_concurrent(t *testing.T) {
+	c := newTestBloomChecker(t, &noopRecorder{}, 100000, 0.0001)
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		unique int
+	)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := uint32(0); n < 5000; n++ {
+				if c.IsUnique(n * 7919) {
+					mu.Lock()
+					unique++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 5000, unique, "every number is unique on exactly one connection")
+}
+
+func TestBloomChecker_snapshot(t *testing.T) {
+	src := newTestBloomChecker(t, &noopRecorder{}, 1000, 0.01)
+	for n := uint32(0); n < 500; n++ {
+		src.IsUnique(n * 3)
+	}
+	var buf bytes.Buffer
+	require.NoError(t, WriteSnapshot(src, &buf))
+	assert.Equal(t, bloomMagic, buf.Bytes()[:8])
+
+	r := NewRecorder()
+	dst := newTestBloomChecker(t, r, 1000, 0.01)
+	n, err := ReadSnapshot(dst, bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	assert.InDelta(t, 500, float64(n), 25)
+	assert.Equal(t, src.words, dst.words)
+	assert.Equal(t, src.set.Load(), dst.set.Load())
+	assert.Contains(t, r.getReport(), fmt.Sprintf("Unique total: %v", n))
+	for n := uint32(0); n < 500; n++ {
+		assert.False(t, dst.IsUnique(n*3))
+	}
+
+	// The restored bits are counted at once.
+	mr := &mockRecorder{}
+	mr.On("addRestored", n).Return().Once()
+	mr.On("setMemory", mock.Anything).Return()
+	mr.On("setFalsePositiveRate", mock.Anything).Return()
+	_, err = ReadSnapshot(newTestBloomChecker(t, mr, 1000, 0.01), bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	mr.AssertExpectations(t)
+
+	other := newTestBloomChecker(t, &noopRecorder{}, 2000, 0.01)
+	_, err = ReadSnapshot(other, bytes.NewReader(buf.Bytes()))
+	assert.EqualError(t, err, "bloom snapshot of 9600 bits and 7 hashes, expected 19200 bits and 7 hashes")
+
+	_, err = ReadSnapshot(newMapChecker(&noopRecorder{}), bytes.NewReader(buf.Bytes()))
+	assert.EqualError(t, err, "not a numbers snapshot")
+
+	buf.Reset()
+	m := newMapChecker(&noopRecorder{})
+	m.IsUnique(1)
+	require.NoError(t, WriteSnapshot(m, &buf))
+	// Other snapshots are restored number by number.
+	fresh := newTestBloomChecker(t, &noopRecorder{}, 1000, 0.01)
+	n, err = ReadSnapshot(fresh, &buf)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), n)
+	assert.False(t, fresh.IsUnique(1))
+
+	_, err = ReadSnapshot(dst, bytes.NewReader(bloomMagic))
+	assert.Error(t, err)
+}
+
+func BenchmarkBloomChecker(b *testing.B) {
+	c := newTestBloomChecker(b, &noopRecorder{}, DefaultBloomExpected, DefaultBloomFalsePositiveRate)
+	rnd := rand.New(rand.NewSource(42))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.IsUnique(uint32(rnd.Intn(numberSpace)))
+	}
+	b.ReportMetric(c.FalsePositiveRate(), "fp-rate")
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/atomic"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConnectionInfo is a point in time view of a connected producer.
+type ConnectionInfo struct {
+	ID         uint64    `json:"id"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Name       string    `json:"name"`
+	Namespace  string    `json:"namespace,omitempty"`
+	Connected  time.Time `json:"connected"`
+	Received   uint64    `json:"received"`
+	Unique     uint64    `json:"unique"`
+	Duplicates uint64    `json:"duplicates"`
+	Invalid    uint64    `json:"invalid"`
+	Throttled  uint64    `json:"throttled"`
+	BytesRead  uint64    `json:"bytesRead"`
+	// Closed is set on a connection closed for invalid input, listed until
+	// the next report so its invalid count is seen.
+	Closed bool `json:"closed,omitempty"`
+}
+
+type Registry interface {
+	Connections() []ConnectionInfo
+	Disconnect(id uint64) bool
+	add(conn net.Conn, cancel context.CancelFunc) *connStats
+	remove(id uint64)
+	getReport() string
+}
+
+func NewRegistry() Registry {
+	return &registry{
+		conns: make(map[uint64]*connStats),
+	}
+}
+
+type registry struct {
+	mu    sync.RWMutex
+	next  uint64
+	conns map[uint64]*connStats
+	// closed holds the connections closed for invalid input since the last
+	// report.
+	closed []*connStats
+}
+
+func (r *registry) add(conn net.Conn, cancel context.CancelFunc) *connStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.next++
+	cs := &connStats{
+		id:        r.next,
+		remote:    conn.RemoteAddr().String(),
+		connected: time.Now(),
+		cancel:    cancel,
+	}
+	r.conns[cs.id] = cs
+	return cs
+}
+
+func (r *registry) remove(id uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cs, ok := r.conns[id]
+	if !ok {
+		return
+	}
+	delete(r.conns, id)
+	if cs.invalid.Load() > 0 {
+		r.closed = append(r.closed, cs)
+	}
+}
+
+func (r *registry) Disconnect(id uint64) bool {
+	r.mu.RLock()
+	cs, ok := r.conns[id]
+	r.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	cs.cancel()
+	return true
+}
+
+func (r *registry) Connections() []ConnectionInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.infos()
+}
+
+// infos lists the open and closed connections by ID. r.mu must be held.
+func (r *registry) infos() []ConnectionInfo {
+	infos := make([]ConnectionInfo, 0, len(r.conns)+len(r.closed))
+	for _, cs := range r.conns {
+		infos = append(infos, cs.info())
+	}
+	for _, cs := range r.closed {
+		ci := cs.info()
+		ci.Closed = true
+		infos = append(infos, ci)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// getReport lists the connections, then forgets the closed ones.
+func (r *registry) getReport() string {
+	r.mu.Lock()
+	infos := r.infos()
+	r.closed = nil
+	r.mu.Unlock()
+
+	var sb strings.Builder
+	for _, ci := range infos {
+		closed := ""
+		if ci.Closed {
+			closed = ", closed"
+		}
+		_, _ = fmt.Fprintf(&sb,
+			"Connection %v (%s) from %s: received %v, unique %v, duplicates %v, invalid %v, throttled %v, bytes %v%s\n",
+			ci.ID, ci.Name, ci.RemoteAddr, ci.Received, ci.Unique, ci.Duplicates, ci.Invalid, ci.Throttled, ci.BytesRead, closed)
+	}
+	return sb.String()
+}
+
+type connStats struct {
+	id        uint64
+	remote    string
+	connected time.Time
+	cancel    context.CancelFunc
+	// ns is the namespace the connection declared, only used by the
+	// goroutine serving it.
+	ns *namespace
+
+	name      atomic.String
+	namespace atomic.String
+	received  atomic.Uint64
+	unique    atomic.Uint64
+	duplicate atomic.Uint64
+	invalid   atomic.Uint64
+	throttled atomic.Uint64
+	bytes     atomic.Uint64
+}
+
+func (cs *connStats) info() ConnectionInfo {
+	return ConnectionInfo{
+		ID:         cs.id,
+		RemoteAddr: cs.remote,
+		Name:       cs.name.Load(),
+		Namespace:  cs.namespace.Load(),
+		Connected:  cs.connected,
+		Received:   cs.received.Load(),
+		Unique:     cs.unique.Load(),
+		Duplicates: cs.duplicate.Load(),
+		Invalid:    cs.invalid.Load(),
+		Throttled:  cs.throttled.Load(),
+		BytesRead:  cs.bytes.Load(),
+	}
+}
+
+func (cs *connStats) join(n *namespace) {
+	cs.ns = n
+	cs.namespace.Store(n.name)
+}
+
+// countingReader counts the bytes read from the underlying connection.
+type countingReader struct {
+	r  io.Reader
+	cs *connStats
+}
+
+func (c *countingReader) Read(p []byte) (n int, err error) {
+	n, err = c.r.Read(p)
+	c.cs.bytes.Add(uint64(n))
+	return n, err
+}
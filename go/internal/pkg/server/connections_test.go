@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	s, c := net.Pipe()
+	defer s.Close()
+	defer c.Close()
+
+	cancelled := false
+	cs := r.add(c, func() { cancelled = true })
+	cs.name.Store("sensor")
+	cs.received.Add(3)
+	cs.unique.Add(2)
+	cs.duplicate.Inc()
+
+	conns := r.Connections()
+	require.Len(t, conns, 1)
+	assert.Equal(t, uint64(1), conns[0].ID)
+	assert.Equal(t, "sensor", conns[0].Name)
+	assert.Equal(t, "pipe", conns[0].RemoteAddr)
+	assert.Equal(t, uint64(3), conns[0].Received)
+	assert.Equal(t, uint64(2), conns[0].Unique)
+	assert.Equal(t, uint64(1), conns[0].Duplicates)
+	assert.Equal(t,
+		"Connection 1 (sensor) from pipe: received 3, unique 2, duplicates 1, invalid 0, throttled 0, bytes 0\n",
+		r.getReport())
+
+	assert.False(t, r.Disconnect(2))
+	assert.True(t, r.Disconnect(1))
+	assert.True(t, cancelled)
+
+	r.remove(cs.id)
+	assert.Empty(t, r.Connections())
+	assert.Equal(t, "", r.getReport())
+}
+
+func TestHandlerRegistersConnection(t *testing.T) {
+	m := new(mockRepo)
+	m.On("IsUnique", uint32(1)).Return(true).Once()
+	m.On("IsUnique", uint32(1)).Return(false).Once()
+	l := new(mockLog)
+	l.On("Info", "000000001", []zapcore.Field(nil))
+	r := NewRegistry()
+	h := NewHandler(m, l, r)
+
+	s, c := net.Pipe()
+	defer s.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- h.handle(context.Background(), func() {}, c)
+	}()
+
+	_, err := s.Write([]byte("name sensor\n000000001\n000000001\n"))
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		conns := r.Connections()
+		return len(conns) == 1 && conns[0].Received == 2
+	}, time.Second, 10*time.Millisecond)
+	ci := r.Connections()[0]
+	assert.Equal(t, "sensor", ci.Name)
+	assert.Equal(t, uint64(1), ci.Unique)
+	assert.Equal(t, uint64(1), ci.Duplicates)
+	assert.Equal(t, uint64(32), ci.BytesRead)
+
+	assert.True(t, r.Disconnect(ci.ID))
+	assert.NoError(t, <-done)
+	assert.Empty(t, r.Connections())
+	m.AssertExpectations(t)
+	l.AssertExpectations(t)
+}
+
+func TestRegistryKeepsInvalidConnectionsUntilReport(t *testing.T) {
+	r := NewRegistry()
+	s, c := net.Pipe()
+	defer s.Close()
+	defer c.Close()
+
+	cs := r.add(c, func() {})
+	cs.received.Inc()
+	cs.invalid.Inc()
+	clean := r.add(c, func() {})
+	r.remove(cs.id)
+	r.remove(clean.id)
+
+	conns := r.Connections()
+	require.Len(t, conns, 1)
+	assert.Equal(t, uint64(1), conns[0].Invalid)
+	assert.True(t, conns[0].Closed)
+	assert.False(t, r.Disconnect(cs.id))
+	assert.Equal(t,
+		"Connection 1 () from pipe: received 1, unique 0, duplicates 0, invalid 1, throttled 0, bytes 0, closed\n",
+		r.getReport())
+
+	assert.Empty(t, r.Connections())
+	assert.Equal(t, "", r.getReport())
+}
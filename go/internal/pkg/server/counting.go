@@ -0,0 +1,329 @@
+package server
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	syncatomic "sync/atomic"
+)
+
+const (
+	// DefaultTopNumbers is how many of the most repeated numbers are
+	// reported when not configured.
+	DefaultTopNumbers = 10
+	sketchDepth       = 4
+	sketchWidth       = 1 << 18
+	// sketchCandidates is how many numbers the sketch keeps as candidates
+	// per number reported.
+	sketchCandidates = 16
+)
+
+// TopNumber is a number along with how many times it was received.
+type TopNumber struct {
+	Number uint32 `json:"number"`
+	Count  uint64 `json:"count"`
+}
+
+// frequencies counts the duplicates of each number.
+type frequencies interface {
+	// add counts a duplicate of n and returns how many times n was received.
+	add(n uint32) uint64
+	// top returns the k numbers received the most times, most first.
+	top(k int) []TopNumber
+	forget(n uint32)
+	reset()
+}
+
+// countingChecker wraps a checker to count how often each duplicate is
+// received, so the numbers behind the duplicate rate can be reported.
+type countingChecker struct {
+	NumberChecker
+	f    frequencies
+	topN int
+}
+
+// newCountingChecker counts the duplicates of nc exactly or, with mode
+// "sketch", in a count-min sketch of fixed size.
+func newCountingChecker(nc NumberChecker, mode string, topN int) (*countingChecker, error) {
+	if topN <= 0 {
+		topN = DefaultTopNumbers
+	}
+	c := &countingChecker{NumberChecker: nc, topN: topN}
+	switch mode {
+	case "exact":
+		c.f = &exactFrequencies{counts: make(map[uint32]uint64)}
+	case "sketch":
+		c.f = newSketchFrequencies(topN * sketchCandidates)
+	default:
+		return nil, fmt.Errorf("unknown counting mode %q", mode)
+	}
+	return c, nil
+}
+
+func (c *countingChecker) IsUnique(n uint32) bool {
+	unique := c.NumberChecker.IsUnique(n)
+	if !unique {
+		c.f.add(n)
+	}
+	return unique
+}
+
+func (c *countingChecker) IsUniqueBatch(ns []uint32, out []bool) {
+	c.NumberChecker.IsUniqueBatch(ns, out)
+	for i, unique := range out[:len(ns)] {
+		if !unique {
+			c.f.add(ns[i])
+		}
+	}
+}
+
+// Reset forgets every number along with its count.
+func (c *countingChecker) Reset() {
+	c.NumberChecker.Reset()
+	c.f.reset()
+}
+
+// Forget forgets n along with its count. The count is kept when the wrapped
+// checker cannot forget n.
+func (c *countingChecker) Forget(n uint32) bool {
+	if !c.NumberChecker.Forget(n) {
+		return false
+	}
+	c.f.forget(n)
+	return true
+}
+
+// Top returns the most repeated numbers, most first.
+func (c *countingChecker) Top() []TopNumber {
+	return c.f.top(c.topN)
+}
+
+func (c *countingChecker) GetReport() string {
+	report := c.NumberChecker.GetReport()
+	top := c.Top()
+	if len(top) == 0 {
+		return report
+	}
+	parts := make([]string, len(top))
+	for i, t := range top {
+		parts[i] = fmt.Sprintf("%s x%v", appendNumber(nil, t.Number), t.Count)
+	}
+	return report + ". Most repeated: " + strings.Join(parts, ", ")
+}
+
+// Close closes the wrapped checker when it has to be.
+func (c *countingChecker) Close() error {
+	if closer, ok := c.NumberChecker.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// unwrap returns the checker being counted.
+func (c *countingChecker) unwrap() NumberChecker {
+	return c.NumberChecker
+}
+
+// baseChecker returns the checker keeping the numbers behind any wrappers.
+func baseChecker(nc NumberChecker) NumberChecker {
+	for {
+		w, ok := nc.(interface{ unwrap() NumberChecker })
+		if !ok {
+			return nc
+		}
+		nc = w.unwrap()
+	}
+}
+
+// exactFrequencies keeps a count for every number received more than once,
+// so it grows with them without bound.
+type exactFrequencies struct {
+	mu     sync.Mutex
+	counts map[uint32]uint64
+}
+
+func (e *exactFrequencies) add(n uint32) uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	count, ok := e.counts[n]
+	if !ok {
+		// The first time was unique.
+		count = 1
+	}
+	count++
+	e.counts[n] = count
+	return count
+}
+
+func (e *exactFrequencies) top(k int) []TopNumber {
+	e.mu.Lock()
+	all := make([]TopNumber, 0, len(e.counts))
+	for n, count := range e.counts {
+		all = append(all, TopNumber{Number: n, Count: count})
+	}
+	e.mu.Unlock()
+	return topNumbers(all, k)
+}
+
+func (e *exactFrequencies) forget(n uint32) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.counts, n)
+}
+
+func (e *exactFrequencies) reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.counts = make(map[uint32]uint64)
+}
+
+// sketchFrequencies counts duplicates in a count-min sketch, which never
+// undercounts and takes the same memory whatever it is sent, and keeps the
+// numbers with the highest estimates as candidates for the top.
+type sketchFrequencies struct {
+	rows [sketchDepth][]uint32
+
+	mu sync.Mutex
+	// candidates are also in a min-heap on their count, whose root is the
+	// one evicted by a number that has a higher estimate.
+	candidates map[uint32]*candidate
+	heap       candidateHeap
+	capacity   int
+}
+
+type candidate struct {
+	n     uint32
+	count uint64
+	index int
+}
+
+func newSketchFrequencies(capacity int) *sketchFrequencies {
+	s := &sketchFrequencies{
+		candidates: make(map[uint32]*candidate, capacity),
+		heap:       make(candidateHeap, 0, capacity),
+		capacity:   capacity,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint32, sketchWidth)
+	}
+	return s
+}
+
+func (s *sketchFrequencies) add(n uint32) uint64 {
+	estimate := uint32(0)
+	for i := range s.rows {
+		h := mix64(uint64(n) + uint64(i)*0x9e3779b97f4a7c15)
+		count := syncatomic.AddUint32(&s.rows[i][h%sketchWidth], 1)
+		if i == 0 || count < estimate {
+			estimate = count
+		}
+	}
+	// The first time was unique.
+	count := uint64(estimate) + 1
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.candidates[n]; ok {
+		c.count = count
+		heap.Fix(&s.heap, c.index)
+		return count
+	}
+	if len(s.heap) < s.capacity {
+		c := &candidate{n: n, count: count}
+		s.candidates[n] = c
+		heap.Push(&s.heap, c)
+		return count
+	}
+	if min := s.heap[0]; count > min.count {
+		delete(s.candidates, min.n)
+		min.n, min.count = n, count
+		s.candidates[n] = min
+		heap.Fix(&s.heap, 0)
+	}
+	return count
+}
+
+func (s *sketchFrequencies) top(k int) []TopNumber {
+	s.mu.Lock()
+	all := make([]TopNumber, 0, len(s.heap))
+	for _, c := range s.heap {
+		all = append(all, TopNumber{Number: c.n, Count: c.count})
+	}
+	s.mu.Unlock()
+	return topNumbers(all, k)
+}
+
+// forget only drops n from the candidates, the counters it shares with
+// other numbers are left as they are.
+func (s *sketchFrequencies) forget(n uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.candidates[n]; ok {
+		heap.Remove(&s.heap, c.index)
+		delete(s.candidates, n)
+	}
+}
+
+func (s *sketchFrequencies) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			syncatomic.StoreUint32(&s.rows[i][j], 0)
+		}
+	}
+	s.candidates = make(map[uint32]*candidate, s.capacity)
+	s.heap = make(candidateHeap, 0, s.capacity)
+}
+
+// candidateHeap implements heap.Interface, lowest count first.
+type candidateHeap []*candidate
+
+func (h candidateHeap) Len() int           { return len(h) }
+func (h candidateHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+
+func (h candidateHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *candidateHeap) Push(x interface{}) {
+	c := x.(*candidate)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *candidateHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return c
+}
+
+// topNumbers returns the k highest counts of all, most first and then by
+// number.
+func topNumbers(all []TopNumber, k int) []TopNumber {
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Count != all[j].Count {
+			return all[i].Count > all[j].Count
+		}
+		return all[i].Number < all[j].Number
+	})
+	if len(all) > k {
+		all = all[:k]
+	}
+	return all
+}
+
+// mix64 is the splitmix64 finalizer, spreading the bits of z over the
+// whole result.
+func mix64(z uint64) uint64 {
+	z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+	z = (z ^ z>>27) * 0x94d049bb133111eb
+	return z ^ z>>31
+}
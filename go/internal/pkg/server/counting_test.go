@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	"testing"
+)
+
+func TestCountingChecker_forget(t *testing.T) {
+	for _, mode := range []string{"exact", "sketch"} {
+		t.Run(mode, func(t *testing.T) {
+			c, err := newCountingChecker(newMapChecker(NewRecorder()), mode, 3)
+			require.NoError(t, err)
+			for _, n := range []uint32{42, 42, 7, 7, 7} {
+				c.IsUnique(n)
+			}
+			assert.True(t, c.Forget(7))
+			assert.Equal(t, []TopNumber{{42, 2}}, c.Top())
+			c.Reset()
+			assert.Empty(t, c.Top())
+			c.IsUnique(42)
+			c.IsUnique(42)
+			assert.Equal(t, []TopNumber{{42, 2}}, c.Top())
+		})
+	}
+	t.Run("CannotForget", func(t *testing.T) {
+		bloom, err := newBloomChecker(NewRecorder(), 1000, 0.01)
+		require.NoError(t, err)
+		c, err := newCountingChecker(bloom, "exact", 3)
+		require.NoError(t, err)
+		c.IsUnique(7)
+		c.IsUnique(7)
+		assert.False(t, c.Forget(7))
+		assert.Equal(t, []TopNumber{{7, 2}}, c.Top())
+	})
+}
+
+func TestCountingChecker_top(t *testing.T) {
+	for _, mode := range []string{"exact", "sketch"} {
+		t.Run(mode, func(t *testing.T) {
+			c, err := newCountingChecker(newMapChecker(NewRecorder()), mode, 3)
+			require.NoError(t, err)
+			for _, n := range []uint32{42, 42, 7, 42, 1337, 7, 5, 42} {
+				c.IsUnique(n)
+			}
+			c.IsUniqueBatch([]uint32{1337, 99, 99, 1337}, make([]bool, 4))
+			assert.Equal(t, []TopNumber{{42, 4}, {1337, 3}, {7, 2}}, c.Top())
+			assert.Equal(t,
+				"Received 5 unique numbers, 7 duplicates. Unique total: 5. Most repeated: 000000042 x4, 000001337 x3, 000000007 x2",
+				c.GetReport())
+		})
+	}
+}
+
+func TestCountingChecker_noDuplicates(t *testing.T) {
+	c, err := newCountingChecker(newMapChecker(NewRecorder()), "exact", 0)
+	require.NoError(t, err)
+	c.IsUnique(1)
+	assert.Empty(t, c.Top())
+	assert.Equal(t, "Received 1 unique numbers, 0 duplicates. Unique total: 1", c.GetReport())
+	assert.Equal(t, DefaultTopNumbers, c.topN)
+}
+
+func TestSketchFrequencies_heavyHitters(t *testing.T) {
+	s := newSketchFrequencies(5 * sketchCandidates)
+	exact := &exactFrequencies{counts: make(map[uint32]uint64)}
+	rnd := rand.New(rand.NewSource(42))
+	hot := []uint32{11, 22, 33, 44, 55}
+	for i := 0; i < 200000; i++ {
+		n := uint32(rnd.Intn(numberSpace))
+		if i%10 == 0 {
+			n = hot[rnd.Intn(len(hot))]
+		}
+		s.add(n)
+		exact.add(n)
+	}
+	top := s.top(len(hot))
+	expected := exact.top(len(hot))
+	require.Len(t, top, len(hot))
+	for i := range top {
+		assert.Equal(t, expected[i].Number, top[i].Number)
+		// A count-min sketch never undercounts.
+		assert.GreaterOrEqual(t, top[i].Count, expected[i].Count)
+		assert.InDelta(t, expected[i].Count, top[i].Count, 10)
+	}
+}
+
+func TestSketchFrequencies_evict(t *testing.T) {
+	s := newSketchFrequencies(2)
+	// Numbers are added on each duplicate, the first time counts too.
+	for _, n := range []uint32{1, 1, 1, 2, 3} {
+		s.add(n)
+	}
+	assert.Equal(t, []TopNumber{{Number: 1, Count: 4}, {Number: 2, Count: 2}}, s.top(2),
+		"a number no higher than the lowest candidate is not kept")
+	s.add(3)
+	assert.Equal(t, []TopNumber{{Number: 1, Count: 4}, {Number: 3, Count: 3}}, s.top(2))
+
+	s.forget(1)
+	s.add(4)
+	assert.Equal(t, []TopNumber{{Number: 3, Count: 3}, {Number: 4, Count: 2}}, s.top(2))
+	s.reset()
+	assert.Empty(t, s.top(2))
+	s.add(3)
+	assert.Equal(t, []TopNumber{{Number: 3, Count: 2}}, s.top(2))
+}
+
+type closingChecker struct {
+	NumberChecker
+	closed bool
+}
+
+func (c *closingChecker) Close() error {
+	c.closed = true
+	return errors.New("closed")
+}
+
+func TestCountingChecker_wraps(t *testing.T) {
+	inner := &closingChecker{NumberChecker: newMapChecker(&noopRecorder{})}
+	c, err := newCountingChecker(inner, "exact", 0)
+	require.NoError(t, err)
+	assert.EqualError(t, c.Close(), "closed")
+	assert.True(t, inner.closed)
+
+	m := newMapChecker(&noopRecorder{})
+	c, err = newCountingChecker(m, "sketch", 0)
+	require.NoError(t, err)
+	assert.Equal(t, m, baseChecker(c))
+	c.IsUnique(3)
+	var buf bytes.Buffer
+	require.NoError(t, WriteSnapshot(c, &buf))
+	restored, err := newCountingChecker(newMapChecker(&noopRecorder{}), "exact", 0)
+	require.NoError(t, err)
+	n, err := ReadSnapshot(restored, &buf)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), n)
+	assert.False(t, restored.IsUnique(3))
+}
+
+func TestNewNumberCheckerWith_count(t *testing.T) {
+	nc, err := NewNumberCheckerWith(CheckerConfig{Kind: "map", Count: "exact", TopN: 5}, &noopRecorder{})
+	require.NoError(t, err)
+	require.IsType(t, &countingChecker{}, nc)
+	assert.IsType(t, &checker{}, baseChecker(nc))
+	assert.Equal(t, 5, nc.(*countingChecker).topN)
+
+	_, err = NewNumberCheckerWith(CheckerConfig{Kind: "map", Count: "approximate"}, &noopRecorder{})
+	assert.EqualError(t, err, `unknown counting mode "approximate"`)
+}
@@ -0,0 +1,339 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"golang.org/x/sys/unix"
+	"net"
+	"sync"
+	"syscall"
+)
+
+const (
+	epollEvents  = unix.EPOLLIN | unix.EPOLLRDHUP | unix.EPOLLONESHOT
+	epollBatch   = 128
+	epollReadBuf = 4096
+	// maxLineLength bounds the partial line kept for a connection, no valid
+	// line comes close to it.
+	maxLineLength = 4096
+)
+
+// epollHandler serves connections from a small pool of workers waiting on
+// an epoll instance instead of a goroutine per connection, so an idle
+// producer costs a file descriptor and an epollConn. handle only registers
+// the connection and returns straight away.
+//
+// A worker serves one connection at a time, so with ThrottleBackpressure a
+// throttled connection holds on to its worker until its wait is over.
+type epollHandler struct {
+	h    *handler
+	epfd int
+	wake int
+
+	mu      sync.Mutex
+	conns   map[int]*epollConn
+	stopped bool
+	workers sync.WaitGroup
+}
+
+type epollConn struct {
+	mu   sync.Mutex
+	fd   int
+	conn net.Conn
+	// ctx ends when the connection is closed, so a worker waiting for the
+	// rate limit lets go of mu.
+	ctx        context.Context
+	disconnect context.CancelFunc
+	cancel     context.CancelFunc
+	cs         *connStats
+	bucket     *tokenBucket
+	partial    []byte
+	closed     bool
+}
+
+// NewEpollHandler serves the connections with workers goroutines, applying
+// the protocol, rate limits and registry of h.
+func NewEpollHandler(h *handler, workers int) (*epollHandler, error) {
+	if workers < 1 {
+		return nil, errors.New("the epoll backend needs at least one worker")
+	}
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	wake, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		_ = unix.Close(epfd)
+		return nil, err
+	}
+	// The wake event is level triggered and never read, so once Stop writes
+	// to it every worker sees it.
+	if err := unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, wake, &unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(wake)}); err != nil {
+		_ = unix.Close(wake)
+		_ = unix.Close(epfd)
+		return nil, err
+	}
+	e := &epollHandler{
+		h:     h,
+		epfd:  epfd,
+		wake:  wake,
+		conns: make(map[int]*epollConn),
+	}
+	e.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go e.work()
+	}
+	return e, nil
+}
+
+func (e *epollHandler) printReport() {
+	e.h.printReport()
+}
+
+func (e *epollHandler) handle(ctx context.Context, cancel context.CancelFunc, conn net.Conn) error {
+	fd, pending, ok := connFd(conn)
+	if !ok {
+		// Connections without a socket, such as pipes, are served the usual way.
+		return e.h.handle(ctx, cancel, conn)
+	}
+	ec := &epollConn{
+		fd:     fd,
+		conn:   conn,
+		cancel: cancel,
+		bucket: newTokenBucket(e.h.perConn),
+	}
+	ec.ctx, ec.disconnect = context.WithCancel(ctx)
+	ec.cs = e.h.reg.add(conn, func() {
+		e.closeConn(ec)
+	})
+	e.h.bindListener(ec.cs, conn)
+	e.h.resume(ec.cs, conn)
+
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	if len(pending) > 0 {
+		ec.cs.bytes.Add(uint64(len(pending)))
+		if !e.consume(ec, pending) {
+			return e.closeLocked(ec)
+		}
+	}
+	e.mu.Lock()
+	if e.stopped {
+		e.mu.Unlock()
+		return e.closeLocked(ec)
+	}
+	if e.h.isPaused() {
+		e.mu.Unlock()
+		e.pauseLocked(ec)
+		return nil
+	}
+	e.conns[fd] = ec
+	e.mu.Unlock()
+	if err := unix.EpollCtl(e.epfd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Events: epollEvents, Fd: int32(fd)}); err != nil {
+		_ = e.closeLocked(ec)
+		return err
+	}
+	return nil
+}
+
+// drain disconnects every producer, waiting for the lines being processed.
+func (e *epollHandler) drain() {
+	e.mu.Lock()
+	conns := make([]*epollConn, 0, len(e.conns))
+	for _, ec := range e.conns {
+		conns = append(conns, ec)
+	}
+	e.mu.Unlock()
+	for _, ec := range conns {
+		e.closeConn(ec)
+	}
+}
+
+// pause stops serving the connections without closing them, waiting for
+// the lines being processed, and keeps their partial lines for a successor.
+func (e *epollHandler) pause() {
+	e.h.pause()
+	e.mu.Lock()
+	conns := make([]*epollConn, 0, len(e.conns))
+	for _, ec := range e.conns {
+		conns = append(conns, ec)
+	}
+	e.mu.Unlock()
+	for _, ec := range conns {
+		ec.mu.Lock()
+		e.pauseLocked(ec)
+		ec.mu.Unlock()
+	}
+}
+
+func (e *epollHandler) pausedConns() []HandedConn {
+	return e.h.pausedConns()
+}
+
+func (e *epollHandler) pauseLocked(ec *epollConn) {
+	if ec.closed {
+		return
+	}
+	ec.closed = true
+	e.mu.Lock()
+	if e.conns[ec.fd] == ec {
+		delete(e.conns, ec.fd)
+	}
+	e.mu.Unlock()
+	_ = unix.EpollCtl(e.epfd, unix.EPOLL_CTL_DEL, ec.fd, nil)
+	e.h.reg.remove(ec.cs.id)
+	raw, _ := unwrapConn(ec.conn)
+	e.h.keepPaused(raw, ec.cs, ec.partial)
+}
+
+// Stop disconnects every producer and stops the workers.
+func (e *epollHandler) Stop() error {
+	e.mu.Lock()
+	if e.stopped {
+		e.mu.Unlock()
+		return nil
+	}
+	e.stopped = true
+	e.mu.Unlock()
+
+	e.drain()
+	if _, err := unix.Write(e.wake, []byte{1, 0, 0, 0, 0, 0, 0, 0}); err != nil {
+		return err
+	}
+	e.workers.Wait()
+	_ = unix.Close(e.wake)
+	return unix.Close(e.epfd)
+}
+
+func (e *epollHandler) work() {
+	defer e.workers.Done()
+	events := make([]unix.EpollEvent, epollBatch)
+	buf := make([]byte, epollReadBuf)
+	for {
+		n, err := unix.EpollWait(e.epfd, events, -1)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		for i := 0; i < n; i++ {
+			fd := int(events[i].Fd)
+			if fd == e.wake {
+				return
+			}
+			e.mu.Lock()
+			ec := e.conns[fd]
+			e.mu.Unlock()
+			if ec != nil {
+				e.serve(ec, buf)
+			}
+		}
+	}
+}
+
+// serve reads what is available from a ready connection and re-arms it.
+func (e *epollHandler) serve(ec *epollConn, buf []byte) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	if ec.closed {
+		return
+	}
+	n, err := unix.Read(ec.fd, buf)
+	if err == unix.EAGAIN || err == unix.EINTR {
+		e.rearm(ec)
+		return
+	}
+	if err != nil || n == 0 {
+		_ = e.closeLocked(ec)
+		return
+	}
+	ec.cs.bytes.Add(uint64(n))
+	if !e.consume(ec, buf[:n]) || ec.ctx.Err() != nil {
+		_ = e.closeLocked(ec)
+		return
+	}
+	e.rearm(ec)
+}
+
+// consume processes every complete line of data and keeps the rest for the
+// next read. It returns false when the connection has to be closed.
+func (e *epollHandler) consume(ec *epollConn, data []byte) bool {
+	var lines []string
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		line := data[:i]
+		if len(ec.partial) > 0 {
+			line = append(ec.partial, line...)
+			ec.partial = nil
+		}
+		lines = append(lines, string(line))
+		data = data[i+1:]
+	}
+	if len(lines) > 0 && !e.h.processLines(ec.ctx, ec.cancel, ec.cs, ec.bucket, lines) {
+		return false
+	}
+	ec.partial = append(ec.partial, data...)
+	if len(ec.partial) > maxLineLength {
+		ec.cs.invalid.Inc()
+		return false
+	}
+	return true
+}
+
+func (e *epollHandler) rearm(ec *epollConn) {
+	if err := unix.EpollCtl(e.epfd, unix.EPOLL_CTL_MOD, ec.fd, &unix.EpollEvent{Events: epollEvents, Fd: int32(ec.fd)}); err != nil {
+		_ = e.closeLocked(ec)
+	}
+}
+
+// closeConn ends any wait of the worker serving ec before closing it.
+func (e *epollHandler) closeConn(ec *epollConn) {
+	ec.disconnect()
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	_ = e.closeLocked(ec)
+}
+
+func (e *epollHandler) closeLocked(ec *epollConn) error {
+	if ec.closed {
+		return nil
+	}
+	ec.closed = true
+	ec.disconnect()
+	e.mu.Lock()
+	if e.conns[ec.fd] == ec {
+		delete(e.conns, ec.fd)
+	}
+	e.mu.Unlock()
+	_ = unix.EpollCtl(e.epfd, unix.EPOLL_CTL_DEL, ec.fd, nil)
+	e.h.reg.remove(ec.cs.id)
+	return ec.conn.Close()
+}
+
+// connFd finds the socket behind conn along with any bytes already read
+// from it, such as while parsing a PROXY protocol header.
+func connFd(conn net.Conn) (fd int, pending []byte, ok bool) {
+	raw, pending := unwrapConn(conn)
+	sc, ok := raw.(syscall.Conn)
+	if !ok {
+		return 0, nil, false
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, nil, false
+	}
+	if err := rc.Control(func(f uintptr) {
+		fd = int(f)
+	}); err != nil {
+		return 0, nil, false
+	}
+	return fd, pending, true
+}
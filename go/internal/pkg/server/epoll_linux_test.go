@@ -0,0 +1,318 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestEpollHandler(t *testing.T) {
+	l := new(mockLog)
+	l.On("Info", "000000001", mock.Anything).Once()
+	reg := NewRegistry()
+	e, err := NewEpollHandler(NewHandler(newMapChecker(&noopRecorder{}), l, reg), 2)
+	require.NoError(t, err)
+	defer e.Stop()
+	s, addr := startEpollServer(t, e, 10)
+	go func() {
+		_ = s.Process()
+	}()
+
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	// Lines split across reads are put back together.
+	_, err = c.Write([]byte("name sensor\n0000"))
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	_, err = c.Write([]byte("00001\n000000001\n"))
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		conns := reg.Connections()
+		return len(conns) == 1 && conns[0].Received == 2
+	}, time.Second, 10*time.Millisecond)
+	ci := reg.Connections()[0]
+	assert.Equal(t, "sensor", ci.Name)
+	assert.Equal(t, uint64(1), ci.Unique)
+	assert.Equal(t, uint64(1), ci.Duplicates)
+	assert.Equal(t, uint64(32), ci.BytesRead)
+
+	// An invalid line closes the connection, which is listed until the
+	// next report.
+	_, err = c.Write([]byte("bad\n"))
+	require.NoError(t, err)
+	_, err = bufio.NewReader(c).ReadByte()
+	assert.Equal(t, io.EOF, err)
+	assert.Eventually(t, func() bool {
+		conns := reg.Connections()
+		return len(conns) == 1 && conns[0].Closed && conns[0].Invalid == 1
+	}, time.Second, 10*time.Millisecond)
+	reg.getReport()
+	assert.Empty(t, reg.Connections())
+
+	// Disconnecting from the registry closes the connection.
+	c2, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c2.Close()
+	assert.Eventually(t, func() bool {
+		return len(reg.Connections()) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.True(t, reg.Disconnect(reg.Connections()[0].ID))
+	_, err = bufio.NewReader(c2).ReadByte()
+	assert.Equal(t, io.EOF, err)
+
+	require.NoError(t, s.Shutdown())
+	l.AssertExpectations(t)
+}
+
+func TestEpollHandler_terminate(t *testing.T) {
+	reg := NewRegistry()
+	e, err := NewEpollHandler(NewHandler(newMapChecker(&noopRecorder{}), new(mockLog), reg), 1)
+	require.NoError(t, err)
+	defer e.Stop()
+	s, addr := startEpollServer(t, e, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Process()
+	}()
+
+	idle, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer idle.Close()
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	assert.Eventually(t, func() bool {
+		return len(reg.Connections()) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = c.Write([]byte("terminate\n"))
+	require.NoError(t, err)
+	assert.NoError(t, <-done)
+	// Process only returns once every producer has been disconnected.
+	assert.Empty(t, reg.Connections())
+	_, err = bufio.NewReader(idle).ReadByte()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestEpollHandler_disconnectThrottled(t *testing.T) {
+	l := new(mockLog)
+	l.On("Info", mock.Anything, mock.Anything)
+	reg := NewRegistry()
+	h := NewHandler(newMapChecker(&noopRecorder{}), l, reg)
+	h.SetRateLimit(RateLimit{}, RateLimit{Rate: 0.1, Burst: 1}, ThrottleBackpressure, &noopRecorder{})
+	e, err := NewEpollHandler(h, 1)
+	require.NoError(t, err)
+	defer e.Stop()
+	s, addr := startEpollServer(t, e, 10)
+	go func() {
+		_ = s.Process()
+	}()
+	defer s.Shutdown()
+
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	// The second number waits ten seconds for a token, holding the worker.
+	_, err = c.Write([]byte("000000001\n000000002\n"))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		conns := reg.Connections()
+		return len(conns) == 1 && conns[0].Throttled == 1
+	}, time.Second, 10*time.Millisecond)
+
+	disconnected := make(chan bool, 1)
+	go func() {
+		disconnected <- reg.Disconnect(reg.Connections()[0].ID)
+	}()
+	select {
+	case ok := <-disconnected:
+		assert.True(t, ok)
+	case <-time.After(2 * time.Second):
+		t.Fatal("disconnect waited for the throttled worker")
+	}
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = bufio.NewReader(c).ReadByte()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestEpollHandler_proxyProtocol(t *testing.T) {
+	l := new(mockLog)
+	l.On("Info", "000000001", mock.Anything).Once()
+	reg := NewRegistry()
+	e, err := NewEpollHandler(NewHandler(newMapChecker(&noopRecorder{}), l, reg), 1)
+	require.NoError(t, err)
+	defer e.Stop()
+	trusted, err := ParseTrustedProxies("127.0.0.1")
+	require.NoError(t, err)
+	s := NewServer(10, "127.0.0.1", 0, e, time.Minute)
+	s.SetProxyProtocol(trusted)
+	require.NoError(t, s.Start())
+	go func() {
+		_ = s.Process()
+	}()
+	defer s.Shutdown()
+
+	c, err := net.Dial("tcp", s.listeners[0].Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	// The number arrives with the header, so it is read while parsing it.
+	_, err = c.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 5000 4000\r\n000000001\n"))
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		conns := reg.Connections()
+		return len(conns) == 1 && conns[0].Unique == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "192.0.2.1:5000", reg.Connections()[0].RemoteAddr)
+	l.AssertExpectations(t)
+}
+
+func TestEpollHandler_namespaceListener(t *testing.T) {
+	h := NewHandler(newMapChecker(&noopRecorder{}), new(mockLog), NewRegistry())
+	ns := newTestNamespaces(t, NamespaceConfig{Max: 1})
+	h.SetNamespaces(ns)
+	e, err := NewEpollHandler(h, 1)
+	require.NoError(t, err)
+	defer e.Stop()
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	bound, err := ns.Bind(ln, "red")
+	require.NoError(t, err)
+	s := NewServer(10, "", 0, e, time.Minute)
+	s.SetListeners(bound)
+	require.NoError(t, s.Start())
+	go func() {
+		_ = s.Process()
+	}()
+	defer s.Shutdown()
+
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", ln.Addr().(*net.TCPAddr).Port))
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte("000000001\n000000001\n"))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		stats := ns.Stats()
+		return len(stats) == 1 && stats[0].Unique == 1 && stats[0].Duplicates == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestEpollHandler_pipe(t *testing.T) {
+	reg := NewRegistry()
+	e, err := NewEpollHandler(NewHandler(newMapChecker(&noopRecorder{}), new(mockLog), reg), 1)
+	require.NoError(t, err)
+	defer e.Stop()
+
+	s, c := net.Pipe()
+	defer s.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- e.handle(context.Background(), func() {}, c)
+	}()
+	_, err = s.Write([]byte("name pipe\n"))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		conns := reg.Connections()
+		return len(conns) == 1 && conns[0].Name == "pipe"
+	}, time.Second, 10*time.Millisecond)
+	assert.True(t, reg.Disconnect(reg.Connections()[0].ID))
+	assert.NoError(t, <-done)
+}
+
+// BenchmarkConnectionMemory compares the memory held per idle producer by
+// the goroutine per connection handler and the epoll backend. The producers
+// are plain sockets so they add nothing to the Go heap.
+func BenchmarkConnectionMemory(b *testing.B) {
+	const conns = 1000
+	backends := []struct {
+		name string
+		new  func(h *handler) (handleConn, func())
+	}{
+		{"Goroutine", func(h *handler) (handleConn, func()) {
+			return h, func() {}
+		}},
+		{"Epoll", func(h *handler) (handleConn, func()) {
+			e, err := NewEpollHandler(h, 4)
+			require.NoError(b, err)
+			return e, func() {
+				_ = e.Stop()
+			}
+		}},
+	}
+	for _, backend := range backends {
+		b.Run(backend.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				reg := NewRegistry()
+				hc, stop := backend.new(NewHandler(newMapChecker(&noopRecorder{}), new(mockLog), reg))
+				s, addr := startEpollServer(b, hc, conns)
+				done := make(chan error, 1)
+				go func() {
+					done <- s.Process()
+				}()
+				port := s.listeners[0].Addr().(*net.TCPAddr).Port
+
+				before := inUse()
+				fds := make([]int, 0, conns)
+				for len(fds) < conns {
+					fd, err := dialRaw(port, "name idle\n")
+					require.NoError(b, err)
+					fds = append(fds, fd)
+				}
+				require.Eventually(b, func() bool {
+					return len(reg.Connections()) == conns
+				}, 10*time.Second, 10*time.Millisecond, addr)
+				b.ReportMetric(float64(int64(inUse())-int64(before))/conns, "bytes/conn")
+
+				for _, fd := range fds {
+					_ = unix.Close(fd)
+				}
+				_ = s.Shutdown()
+				<-done
+				stop()
+			}
+		})
+	}
+}
+
+func startEpollServer(tb testing.TB, h handleConn, connectionCount int) (*listening, string) {
+	s := NewServer(connectionCount, "127.0.0.1", 0, h, time.Minute)
+	require.NoError(tb, s.Start())
+	return s, s.listeners[0].Addr().String()
+}
+
+func inUse() uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapInuse + m.StackInuse
+}
+
+func dialRaw(port int, msg string) (int, error) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return 0, err
+	}
+	if err := unix.Connect(fd, &unix.SockaddrInet4{Port: port, Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		_ = unix.Close(fd)
+		return 0, fmt.Errorf("connect: %w", err)
+	}
+	if _, err := unix.Write(fd, []byte(msg)); err != nil {
+		_ = unix.Close(fd)
+		return 0, err
+	}
+	return fd, nil
+}
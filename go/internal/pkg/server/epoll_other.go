@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// epollHandler is only available on Linux.
+type epollHandler struct{}
+
+func NewEpollHandler(h *handler, workers int) (*epollHandler, error) {
+	return nil, errors.New("the epoll backend is only supported on Linux")
+}
+
+func (e *epollHandler) printReport() {}
+
+func (e *epollHandler) handle(ctx context.Context, cancel context.CancelFunc, conn net.Conn) error {
+	return errors.New("the epoll backend is only supported on Linux")
+}
+
+func (e *epollHandler) Stop() error {
+	return nil
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultEstimateHours is how many hourly sketches are kept.
+	DefaultEstimateHours = 24
+	// DefaultEstimateClients is how many clients get their own sketch.
+	DefaultEstimateClients = 64
+	// otherClients is the sketch of the clients beyond the configured ones.
+	otherClients = "other"
+)
+
+// EstimatorConfig sizes the sketches of an Estimator.
+type EstimatorConfig struct {
+	// Precision of every sketch, DefaultSketchPrecision when 0.
+	Precision int
+	// Hours is how many hourly sketches are kept, the current one
+	// included.
+	Hours int
+	// Clients is how many clients get their own sketch. The numbers of
+	// any others are counted together.
+	Clients int
+	// PrefixDigits is how many leading digits of the nine make a prefix,
+	// from 1 to 3.
+	PrefixDigits int
+}
+
+// Estimator approximately counts the distinct numbers accepted per client,
+// per hour and per leading digits with HyperLogLog sketches, which take the
+// same memory whatever is received.
+type Estimator interface {
+	// observe adds the numbers accepted from a connection.
+	observe(cs *connStats, ns []uint32)
+	// refresh records the current estimates with the Recorder.
+	refresh()
+	Estimates() Estimates
+	// RollUp merges the hourly sketches that started from from and before
+	// to.
+	RollUp(from, to time.Time) RollUp
+}
+
+// Estimates are the estimated distinct numbers accepted along each
+// dimension.
+type Estimates struct {
+	StdError float64 `json:"stdError"`
+	// Window is the distinct numbers over every hour kept.
+	Window   uint64            `json:"window"`
+	Hours    []HourEstimate    `json:"hours"`
+	Clients  map[string]uint64 `json:"clients"`
+	Prefixes map[string]uint64 `json:"prefixes"`
+}
+
+// HourEstimate is the estimate of an hour along with its sketch, which can
+// be merged with others with Sketch.UnmarshalBinary and Sketch.Merge.
+type HourEstimate struct {
+	Start    time.Time `json:"start"`
+	Distinct uint64    `json:"distinct"`
+	Sketch   []byte    `json:"sketch"`
+}
+
+// RollUp is the estimate of the hourly sketches merged over a period.
+type RollUp struct {
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	Hours    int       `json:"hours"`
+	Distinct uint64    `json:"distinct"`
+}
+
+type hourSketch struct {
+	start  time.Time
+	sketch *Sketch
+}
+
+type estimator struct {
+	mu  sync.Mutex
+	cfg EstimatorConfig
+	now func() time.Time
+	// hours are the hourly sketches, oldest first.
+	hours    []hourSketch
+	clients  map[string]*Sketch
+	prefixes []*Sketch
+	divisor  uint32
+	r        Recorder
+}
+
+func NewEstimator(cfg EstimatorConfig, r Recorder) (Estimator, error) {
+	return newEstimatorAt(cfg, r, time.Now)
+}
+
+func newEstimatorAt(cfg EstimatorConfig, r Recorder, now func() time.Time) (*estimator, error) {
+	if cfg.Precision == 0 {
+		cfg.Precision = DefaultSketchPrecision
+	}
+	if cfg.Hours <= 0 {
+		cfg.Hours = DefaultEstimateHours
+	}
+	if cfg.Clients < 0 {
+		cfg.Clients = 0
+	}
+	if cfg.Precision < minSketchPrecision || cfg.Precision > maxSketchPrecision {
+		return nil, fmt.Errorf("sketch precision %v, expected %v to %v", cfg.Precision, minSketchPrecision, maxSketchPrecision)
+	}
+	if cfg.PrefixDigits < 1 || cfg.PrefixDigits > 3 {
+		return nil, fmt.Errorf("%v prefix digits, expected 1 to 3", cfg.PrefixDigits)
+	}
+	e := &estimator{
+		cfg:      cfg,
+		now:      now,
+		clients:  make(map[string]*Sketch),
+		prefixes: make([]*Sketch, pow10(cfg.PrefixDigits)),
+		divisor:  uint32(pow10(9 - cfg.PrefixDigits)),
+		r:        r,
+	}
+	for i := range e.prefixes {
+		e.prefixes[i] = e.newSketch()
+	}
+	return e, nil
+}
+
+// newSketch returns an empty sketch of the configured precision, which has
+// been validated.
+func (e *estimator) newSketch() *Sketch {
+	s, _ := NewSketch(uint8(e.cfg.Precision))
+	return s
+}
+
+func pow10(n int) int {
+	p := 1
+	for ; n > 0; n-- {
+		p *= 10
+	}
+	return p
+}
+
+func (e *estimator) observe(cs *connStats, ns []uint32) {
+	if len(ns) == 0 {
+		return
+	}
+	client := clientKey(cs)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	hour := e.currentHour()
+	c := e.client(client)
+	for _, n := range ns {
+		h := mix64(uint64(n))
+		hour.add(h)
+		c.add(h)
+		e.prefixes[n/e.divisor].add(h)
+	}
+}
+
+// clientKey is the name a producer gave itself or else its address without
+// the port, which changes with each connection.
+func clientKey(cs *connStats) string {
+	if name := cs.name.Load(); name != "" {
+		return name
+	}
+	if host, _, err := net.SplitHostPort(cs.remote); err == nil {
+		return host
+	}
+	return cs.remote
+}
+
+// currentHour returns the sketch of the current hour, dropping the hours
+// no longer kept. The lock has to be held.
+func (e *estimator) currentHour() *Sketch {
+	start := e.now().Truncate(time.Hour)
+	if l := len(e.hours); l > 0 && !e.hours[l-1].start.Before(start) {
+		return e.hours[l-1].sketch
+	}
+	s := e.newSketch()
+	e.hours = append(e.hours, hourSketch{start: start, sketch: s})
+	oldest := start.Add(-time.Duration(e.cfg.Hours-1) * time.Hour)
+	for len(e.hours) > 0 && e.hours[0].start.Before(oldest) {
+		e.hours = e.hours[1:]
+	}
+	return s
+}
+
+// client returns the sketch of a client, or the one shared by the clients
+// beyond the configured ones. The lock has to be held.
+func (e *estimator) client(name string) *Sketch {
+	if s, ok := e.clients[name]; ok {
+		return s
+	}
+	if len(e.clients) >= e.cfg.Clients {
+		name = otherClients
+		if s, ok := e.clients[name]; ok {
+			return s
+		}
+	}
+	s := e.newSketch()
+	e.clients[name] = s
+	return s
+}
+
+func (e *estimator) refresh() {
+	e.mu.Lock()
+	hour := e.currentHour().Estimate()
+	window := e.window().Estimate()
+	e.mu.Unlock()
+	e.r.setDistinct(hour, window, e.cfg.Hours)
+}
+
+// merge returns the hourly sketches that started from from and before to
+// merged, along with how many there were. The lock has to be held.
+func (e *estimator) merge(from, to time.Time) (merged *Sketch, hours int) {
+	merged = e.newSketch()
+	for _, h := range e.hours {
+		if !h.start.Before(from) && h.start.Before(to) {
+			_ = merged.Merge(h.sketch)
+			hours++
+		}
+	}
+	return merged, hours
+}
+
+// window returns every hourly sketch kept merged. The lock has to be held.
+func (e *estimator) window() *Sketch {
+	merged, _ := e.merge(time.Time{}, e.now().Add(time.Hour))
+	return merged
+}
+
+func (e *estimator) Estimates() Estimates {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.currentHour()
+	est := Estimates{
+		StdError: e.prefixes[0].StdError(),
+		Window:   e.window().Estimate(),
+		Clients:  make(map[string]uint64, len(e.clients)),
+		Prefixes: make(map[string]uint64, len(e.prefixes)),
+	}
+	for _, h := range e.hours {
+		b, _ := h.sketch.MarshalBinary()
+		est.Hours = append(est.Hours, HourEstimate{Start: h.start, Distinct: h.sketch.Estimate(), Sketch: b})
+	}
+	for name, s := range e.clients {
+		est.Clients[name] = s.Estimate()
+	}
+	for i, s := range e.prefixes {
+		if d := s.Estimate(); d > 0 {
+			est.Prefixes[fmt.Sprintf("%0*d", e.cfg.PrefixDigits, i)] = d
+		}
+	}
+	return est
+}
+
+func (e *estimator) RollUp(from, to time.Time) RollUp {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	merged, hours := e.merge(from, to)
+	return RollUp{From: from, To: to, Hours: hours, Distinct: merged.Estimate()}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func newTestEstimator(t *testing.T, cfg EstimatorConfig, r Recorder) (*estimator, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2020, 9, 13, 12, 30, 0, 0, time.UTC)}
+	e, err := newEstimatorAt(cfg, r, clock.now)
+	require.NoError(t, err)
+	return e, clock
+}
+
+func newTestConn(remote, name string) *connStats {
+	cs := &connStats{remote: remote}
+	cs.name.Store(name)
+	return cs
+}
+
+func numbersFrom(from, to uint32) []uint32 {
+	ns := make([]uint32, 0, to-from)
+	for n := from; n < to; n++ {
+		ns = append(ns, n)
+	}
+	return ns
+}
+
+func TestNewEstimator(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  EstimatorConfig
+		err  string
+	}{
+		{name: "Defaults", cfg: EstimatorConfig{PrefixDigits: 1}},
+		{name: "Precision", cfg: EstimatorConfig{Precision: 20, PrefixDigits: 1}, err: "sketch precision 20, expected 4 to 16"},
+		{name: "NoPrefix", cfg: EstimatorConfig{}, err: "0 prefix digits, expected 1 to 3"},
+		{name: "LongPrefix", cfg: EstimatorConfig{PrefixDigits: 4}, err: "4 prefix digits, expected 1 to 3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewEstimator(tt.cfg, &noopRecorder{})
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestEstimator_dimensions(t *testing.T) {
+	e, _ := newTestEstimator(t, EstimatorConfig{Clients: 2, PrefixDigits: 2}, &noopRecorder{})
+	e.observe(newTestConn("10.0.0.1:4567", ""), numbersFrom(0, 1000))
+	e.observe(newTestConn("10.0.0.1:4568", ""), numbersFrom(500, 1500))
+	e.observe(newTestConn("10.0.0.2:4567", "batch"), []uint32{990000000, 991000000})
+	e.observe(newTestConn("10.0.0.3:4567", ""), []uint32{1})
+	e.observe(newTestConn("10.0.0.4:4567", ""), []uint32{2, 3})
+	e.observe(newTestConn("10.0.0.5:4567", ""), nil)
+
+	est := e.Estimates()
+	assert.Equal(t, 0.008125, est.StdError)
+	assert.InDelta(t, 1502, est.Window, 20)
+	assert.Len(t, est.Clients, 3)
+	assert.InDelta(t, 1500, est.Clients["10.0.0.1"], 40, "connections from an address are one client")
+	assert.Equal(t, uint64(2), est.Clients["batch"])
+	assert.Equal(t, uint64(3), est.Clients[otherClients])
+	assert.Len(t, est.Prefixes, 2)
+	assert.Equal(t, est.Clients["10.0.0.1"], est.Prefixes["00"])
+	assert.Equal(t, uint64(2), est.Prefixes["99"])
+	require.Len(t, est.Hours, 1)
+	assert.Equal(t, time.Date(2020, 9, 13, 12, 0, 0, 0, time.UTC), est.Hours[0].Start)
+	assert.Equal(t, est.Window, est.Hours[0].Distinct)
+
+	var s Sketch
+	require.NoError(t, s.UnmarshalBinary(est.Hours[0].Sketch))
+	assert.Equal(t, est.Hours[0].Distinct, s.Estimate())
+}
+
+func TestEstimator_hours(t *testing.T) {
+	r := NewRecorder()
+	e, clock := newTestEstimator(t, EstimatorConfig{Hours: 3, PrefixDigits: 1}, r)
+	cs := newTestConn("10.0.0.1:4567", "")
+	start := clock.now().Truncate(time.Hour)
+	for h := uint32(0); h < 4; h++ {
+		// Each hour repeats half of the numbers of the one before.
+		e.observe(cs, numbersFrom(h*500, h*500+1000))
+		clock.advance(time.Hour)
+	}
+	clock.advance(-time.Hour)
+
+	est := e.Estimates()
+	require.Len(t, est.Hours, 3, "the oldest hour is dropped")
+	for i, h := range est.Hours {
+		assert.Equal(t, start.Add(time.Duration(i+1)*time.Hour), h.Start)
+		assert.InDelta(t, 1000, h.Distinct, 25)
+	}
+	assert.InDelta(t, 2000, est.Window, 50)
+
+	r2 := e.RollUp(start, start.Add(3*time.Hour))
+	assert.Equal(t, 2, r2.Hours)
+	assert.InDelta(t, 1500, r2.Distinct, 40)
+	assert.Equal(t, RollUp{From: start, To: start, Hours: 0, Distinct: 0}, e.RollUp(start, start))
+
+	e.refresh()
+	assert.Contains(t, r.getReport(), fmt.Sprintf(". Estimated distinct numbers: %v this hour, %v in the last 3 hours", est.Hours[2].Distinct, est.Window))
+	clock.advance(time.Hour)
+	e.refresh()
+	assert.Contains(t, r.getReport(), fmt.Sprintf(". Estimated distinct numbers: 0 this hour, %v in the last 3 hours", e.RollUp(start, clock.now()).Distinct))
+}
+
+func TestClientKey(t *testing.T) {
+	assert.Equal(t, "10.0.0.1", clientKey(newTestConn("10.0.0.1:4567", "")))
+	assert.Equal(t, "::1", clientKey(newTestConn("[::1]:4567", "")))
+	assert.Equal(t, "pipe", clientKey(newTestConn("pipe", "")))
+	assert.Equal(t, "batch", clientKey(newTestConn("10.0.0.1:4567", "batch")))
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ExportFormat is how Export writes the numbers seen.
+type ExportFormat int
+
+const (
+	// ExportText writes a number per line, nine digits as producers send
+	// them.
+	ExportText ExportFormat = iota
+	// ExportCSV writes the same lines under a number header.
+	ExportCSV
+	// ExportBinary writes a snapshot, the distance of each number from the
+	// previous one as a uvarint, which can be seeded back into a checker.
+	ExportBinary
+)
+
+var errExportUnsupported = errors.New("number checker cannot list its numbers")
+
+func ParseExportFormat(s string) (ExportFormat, error) {
+	switch s {
+	case "text":
+		return ExportText, nil
+	case "csv":
+		return ExportCSV, nil
+	case "binary":
+		return ExportBinary, nil
+	}
+	return ExportText, fmt.Errorf("unknown export format %q", s)
+}
+
+// Export writes every number seen by nc to w in ascending order and returns
+// how many were written. The checker keeps accepting numbers meanwhile, as
+// it is only locked a range at a time, so numbers added during the export
+// may or may not be included.
+func Export(nc NumberChecker, w io.Writer, format ExportFormat) (count uint64, err error) {
+	s, ok := baseChecker(nc).(snapshotter)
+	if !ok {
+		return 0, errExportUnsupported
+	}
+	if format == ExportBinary {
+		return writeDeltas(s, w)
+	}
+	bw := bufio.NewWriter(w)
+	if format == ExportCSV {
+		if _, err := bw.WriteString("number\n"); err != nil {
+			return 0, err
+		}
+	}
+	var line [10]byte
+	line[9] = '\n'
+	s.walk(func(n uint32) bool {
+		for i := 8; i >= 0; i-- {
+			line[i] = byte('0' + n%10)
+			n /= 10
+		}
+		if _, err = bw.Write(line[:]); err != nil {
+			return false
+		}
+		count++
+		return true
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, bw.Flush()
+}
+
+// writeDeltas writes the numbers of s in the snapshot format.
+func writeDeltas(s snapshotter, w io.Writer) (count uint64, err error) {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(snapshotMagic); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	prev := int64(-1)
+	s.walk(func(n uint32) bool {
+		l := binary.PutUvarint(buf, uint64(int64(n)-prev))
+		if _, err = bw.Write(buf[:l]); err != nil {
+			return false
+		}
+		prev = int64(n)
+		count++
+		return true
+	})
+	if err != nil {
+		return count, err
+	}
+	l := binary.PutUvarint(buf, 0)
+	l += binary.PutUvarint(buf[l:], count)
+	if _, err := bw.Write(buf[:l]); err != nil {
+		return count, err
+	}
+	return count, bw.Flush()
+}
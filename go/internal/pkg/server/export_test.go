@@ -0,0 +1,94 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseExportFormat(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected ExportFormat
+		err      string
+	}{
+		{in: "text", expected: ExportText},
+		{in: "csv", expected: ExportCSV},
+		{in: "binary", expected: ExportBinary},
+		{in: "json", err: `unknown export format "json"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			f, err := ParseExportFormat(tt.in)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, f)
+		})
+	}
+}
+
+func TestExport(t *testing.T) {
+	checkers := []struct {
+		name string
+		nc   NumberChecker
+	}{
+		{name: "Paged", nc: newPagedChecker(&noopRecorder{})},
+		{name: "Map", nc: newMapChecker(&noopRecorder{})},
+		{name: "Sharded", nc: newShardedChecker(&noopRecorder{}, 4)},
+		{name: "Roaring", nc: newRoaringChecker(&noopRecorder{})},
+		{name: "Adaptive", nc: newAdaptiveChecker(&noopRecorder{}, 2)},
+	}
+	for _, tt := range checkers {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, n := range []uint32{maxNumber, 42, 70000, 0, 42} {
+				tt.nc.IsUnique(n)
+			}
+
+			var buf bytes.Buffer
+			count, err := Export(tt.nc, &buf, ExportText)
+			require.NoError(t, err)
+			assert.Equal(t, uint64(4), count)
+			assert.Equal(t, "000000000\n000000042\n000070000\n999999999\n", buf.String())
+
+			buf.Reset()
+			_, err = Export(tt.nc, &buf, ExportCSV)
+			require.NoError(t, err)
+			assert.Equal(t, "number\n000000000\n000000042\n000070000\n999999999\n", buf.String())
+
+			buf.Reset()
+			count, err = Export(tt.nc, &buf, ExportBinary)
+			require.NoError(t, err)
+			assert.Equal(t, uint64(4), count)
+			assert.Equal(t, snapshotMagic, buf.Bytes()[:len(snapshotMagic)], "roaring exports deltas too")
+			restored := newMapChecker(&noopRecorder{})
+			n, err := ReadSnapshot(restored, &buf)
+			require.NoError(t, err)
+			assert.Equal(t, uint64(4), n)
+			assert.False(t, restored.IsUnique(70000))
+		})
+	}
+}
+
+func TestExport_errors(t *testing.T) {
+	_, err := Export(newTestBloomChecker(t, &noopRecorder{}, 1000, 0.01), &bytes.Buffer{}, ExportText)
+	assert.Equal(t, errExportUnsupported, err)
+
+	c := newMapChecker(&noopRecorder{})
+	c.IsUnique(1)
+	c.IsUnique(2)
+	for _, format := range []ExportFormat{ExportText, ExportBinary} {
+		_, err := Export(c, failingWriter{}, format)
+		assert.EqualError(t, err, "disk full")
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
@@ -2,15 +2,23 @@ package server
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"go.uber.org/zap"
 	"io"
 	"net"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// maxBatch is the most buffered lines handled together.
+const maxBatch = 256
+
 type log interface {
 	Info(msg string, fields ...zap.Field)
 }
@@ -20,29 +28,131 @@ type handleConn interface {
 	printReport()
 }
 
+// drainer is implemented by handlers that keep serving connections after
+// handle has returned. drain disconnects them once Process is done.
+type drainer interface {
+	drain()
+}
+
 type handler struct {
 	nc     NumberChecker
 	logger log
+	reg    Registry
+
+	global   *tokenBucket
+	perConn  RateLimit
+	throttle ThrottleMode
+	r        Recorder
+
+	p    Pipeline
+	est  Estimator
+	keys KeySet
+	ns   Namespaces
+
+	// paused is closed once the connections are paused for a handover.
+	paused    chan struct{}
+	pauseOnce sync.Once
+	handedMu  sync.Mutex
+	handed    []HandedConn
 }
 
-func NewHandler(numberChecker NumberChecker, logger log) handleConn {
+func NewHandler(numberChecker NumberChecker, logger log, registry Registry) *handler {
 	return &handler{
 		nc:     numberChecker,
 		logger: logger,
+		reg:    registry,
+		paused: make(chan struct{}),
 	}
 }
 
+// NewBackend returns h served by the named backend, goroutine or epoll,
+// along with a function stopping the backend.
+func NewBackend(name string, h *handler, epollWorkers int) (handleConn, func() error, error) {
+	switch name {
+	case "goroutine":
+		return h, func() error { return nil }, nil
+	case "epoll":
+		e, err := NewEpollHandler(h, epollWorkers)
+		if err != nil {
+			return nil, nil, err
+		}
+		return e, e.Stop, nil
+	}
+	return nil, nil, fmt.Errorf("unknown backend %q", name)
+}
+
+// SetRateLimit limits the numbers accepted across all connections and from
+// each connection. Throttled numbers are counted by the given Recorder.
+func (h *handler) SetRateLimit(global, perConn RateLimit, mode ThrottleMode, r Recorder) {
+	h.global = newTokenBucket(global)
+	h.perConn = perConn
+	h.throttle = mode
+	h.r = r
+}
+
+// SetPipeline hands the numbers over to p instead of checking and writing
+// them on the connection's goroutine.
+func (h *handler) SetPipeline(p Pipeline) {
+	h.p = p
+}
+
+// SetEstimator feeds est the numbers accepted, so it estimates how many are
+// distinct along other dimensions than the number checker.
+func (h *handler) SetEstimator(est Estimator) {
+	h.est = est
+}
+
+// SetKeys deduplicates the keys of ks instead of nine digit numbers. The
+// numbers checker, pipeline and estimator are left unused.
+func (h *handler) SetKeys(ks KeySet) {
+	h.keys = ks
+}
+
+// SetNamespaces lets connections check and log their numbers in one of ns,
+// declared with a namespace command before any number or by the listener
+// they connected to.
+func (h *handler) SetNamespaces(ns Namespaces) {
+	h.ns = ns
+}
+
 func (h *handler) printReport() {
+	if h.keys != nil {
+		fmt.Println(h.keys.GetReport())
+		fmt.Print(h.reg.getReport())
+		return
+	}
+	if h.est != nil {
+		h.est.refresh()
+	}
 	fmt.Println(h.nc.GetReport())
+	if h.p != nil {
+		fmt.Println(h.p.getReport())
+	}
+	if h.ns != nil {
+		fmt.Print(h.ns.getReport())
+	}
+	fmt.Print(h.reg.getReport())
 }
 
 func (h *handler) handle(ctx context.Context, cancel context.CancelFunc, conn net.Conn) error {
-	reader := bufio.NewReader(conn)
+	ctx, disconnect := context.WithCancel(ctx)
+	defer disconnect()
+	cs := h.reg.add(conn, disconnect)
+	defer h.reg.remove(cs.id)
+	h.bindListener(cs, conn)
+	h.resume(cs, conn)
+
+	bucket := newTokenBucket(h.perConn)
+	reader := bufio.NewReader(&countingReader{r: conn, cs: cs})
 	c := make(chan string, 1)
 	e := make(chan error, 1)
 	d := make(chan struct{}, 1)
 
 	for {
+		if h.isPaused() {
+			h.pauseConn(conn, cs, unreadBuffer(reader))
+			return nil
+		}
 		go func() {
 			msg, err := reader.ReadString('\n')
 			if err != nil {
@@ -59,7 +169,23 @@ func (h *handler) handle(ctx context.Context, cancel context.CancelFunc, conn ne
 				return errConn
 			}
 			return nil
+		case <-h.paused:
+			// The read is cut short, what it got is kept for the successor.
+			_ = conn.SetReadDeadline(time.Now())
+			msg := <-c
+			select {
+			case err := <-e:
+				if !errors.Is(err, os.ErrDeadlineExceeded) {
+					_ = conn.Close()
+					return nil
+				}
+			default:
+			}
+			h.pauseConn(conn, cs, append([]byte(msg), unreadBuffer(reader)...))
+			return nil
 		case <-d:
+			// The producer is gone, closing only releases its connection slot.
+			_ = conn.Close()
 			return nil
 		case err := <-e:
 			if errConn := conn.Close(); errConn != nil {
@@ -67,31 +193,221 @@ func (h *handler) handle(ctx context.Context, cancel context.CancelFunc, conn ne
 			}
 			return err
 		case msg := <-c:
-			v := strings.TrimRight(msg, "\n")
-			if v == "terminate" {
-				cancel()
-				continue
+			lines := []string{strings.TrimRight(msg, "\n")}
+			// Lines that are already buffered are read without blocking and
+			// checked together.
+			for len(lines) < maxBatch && bufferedLine(reader) {
+				msg, _ := reader.ReadString('\n')
+				lines = append(lines, strings.TrimRight(msg, "\n"))
 			}
-			if len(v) != 9 {
+			if !h.processLines(ctx, cancel, cs, bucket, lines) {
 				if errConn := conn.Close(); errConn != nil {
 					// log errConn
 					return errConn
 				}
 				return nil
 			}
+		}
+	}
+}
 
-			i, err := strconv.ParseUint(v, 10, 32)
-			if err != nil {
-				if errConn := conn.Close(); errConn != nil {
-					// log errConn
-					return errConn
-				}
-				return nil
-			}
+// pauseConn keeps conn for a successor along with the bytes read from it
+// but not processed, pending first.
+func (h *handler) pauseConn(conn net.Conn, cs *connStats, pending []byte) {
+	raw, unread := unwrapConn(conn)
+	h.keepPaused(raw, cs, append(pending, unread...))
+}
 
-			if h.nc.IsUnique(uint32(i)) {
-				h.logger.Info(v)
+// processLines applies the lines in order, checking each run of numbers
+// with a single IsUniqueBatch call. It returns false when a line is invalid
+// and the connection has to be closed.
+func (h *handler) processLines(ctx context.Context, cancel context.CancelFunc, cs *connStats, bucket *tokenBucket, lines []string) bool {
+	if h.keys != nil {
+		return h.keys.processLines(ctx, h, cancel, cs, bucket, lines)
+	}
+	ns := make([]uint32, 0, len(lines))
+	vs := make([]string, 0, len(lines))
+	for _, v := range lines {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if len(v) != 9 || err != nil || h.p != nil {
+			// The numbers before anything else are checked first, and the
+			// pipeline does its own batching.
+			h.checkBatch(cs, ns, vs)
+			ns, vs = ns[:0], vs[:0]
+			if !h.processLine(ctx, cancel, cs, bucket, v) {
+				return false
 			}
+			continue
+		}
+		cs.received.Inc()
+		if !h.takeToken(ctx, bucket, cs) {
+			continue
 		}
+		ns = append(ns, uint32(n))
+		vs = append(vs, v)
 	}
+	h.checkBatch(cs, ns, vs)
+	return true
+}
+
+func (h *handler) checkBatch(cs *connStats, ns []uint32, vs []string) {
+	if len(ns) == 0 {
+		return
+	}
+	if h.est != nil {
+		h.est.observe(cs, ns)
+	}
+	nc, logger := h.target(cs)
+	unique := make([]bool, len(ns))
+	nc.IsUniqueBatch(ns, unique)
+	for i, u := range unique {
+		h.record(cs, u)
+		if u {
+			logger.Info(vs[i])
+		}
+	}
+}
+
+// target returns the checker and log of the connection's namespace, the
+// default ones when it has none.
+func (h *handler) target(cs *connStats) (NumberChecker, log) {
+	if cs.ns != nil {
+		return cs.ns.nc, cs.ns.wr
+	}
+	return h.nc, h.logger
+}
+
+// record counts a checked number for the connection and its namespace.
+func (h *handler) record(cs *connStats, unique bool) {
+	if unique {
+		cs.unique.Inc()
+	} else {
+		cs.duplicate.Inc()
+	}
+	if cs.ns != nil {
+		cs.ns.record(unique)
+	}
+}
+
+// bindListener puts the connection in the namespace bound to the listener
+// it connected to, if any.
+func (h *handler) bindListener(cs *connStats, conn net.Conn) {
+	if n := connNamespace(conn); n != nil {
+		cs.join(n)
+	}
+}
+
+// bufferedLine reports whether a whole line can be read without blocking.
+func bufferedLine(r *bufio.Reader) bool {
+	b, err := r.Peek(r.Buffered())
+	return err == nil && bytes.IndexByte(b, '\n') >= 0
+}
+
+// processLine applies a single line of the protocol. It returns false when
+// the line is invalid and the connection has to be closed.
+func (h *handler) processLine(ctx context.Context, cancel context.CancelFunc, cs *connStats, bucket *tokenBucket, v string) bool {
+	i, err := strconv.ParseUint(v, 10, 32)
+	if len(v) != 9 || err != nil {
+		return h.processCommand(cancel, cs, v)
+	}
+
+	cs.received.Inc()
+	if !h.takeToken(ctx, bucket, cs) {
+		return true
+	}
+	if h.est != nil {
+		h.est.observe(cs, []uint32{uint32(i)})
+	}
+	if h.p != nil {
+		h.p.push(ctx, uint32(i), cs)
+		return true
+	}
+	nc, logger := h.target(cs)
+	unique := nc.IsUnique(uint32(i))
+	h.record(cs, unique)
+	if unique {
+		logger.Info(v)
+	}
+	return true
+}
+
+// isCommand reports whether a line is a command rather than a number or
+// key.
+func isCommand(v string) bool {
+	return v == "terminate" || strings.HasPrefix(v, "name ")
+}
+
+// processCommand applies a line that is not a number or key. It returns
+// false when the line is invalid and the connection has to be closed.
+func (h *handler) processCommand(cancel context.CancelFunc, cs *connStats, v string) bool {
+	switch {
+	case v == "terminate":
+		cancel()
+	case strings.HasPrefix(v, "name "):
+		cs.name.Store(strings.TrimPrefix(v, "name "))
+	case h.ns != nil && strings.HasPrefix(v, "namespace "):
+		return h.joinNamespace(cs, strings.TrimPrefix(v, "namespace "))
+	default:
+		cs.invalid.Inc()
+		return false
+	}
+	return true
+}
+
+// joinNamespace puts the connection in the named namespace. It has to be
+// declared before any number, once, and the connection is closed otherwise
+// or when the namespace cannot be created.
+func (h *handler) joinNamespace(cs *connStats, name string) bool {
+	if cs.ns != nil || cs.received.Load() > 0 {
+		fmt.Printf("connection %v: namespace %q declared after numbers or another namespace\n", cs.id, name)
+		cs.invalid.Inc()
+		return false
+	}
+	n, err := h.ns.join(name)
+	if err != nil {
+		fmt.Printf("connection %v: %v\n", cs.id, err)
+		cs.invalid.Inc()
+		return false
+	}
+	cs.join(n)
+	return true
+}
+
+// takeToken applies the rate limits to a single number. It returns false
+// when the number has to be dropped.
+func (h *handler) takeToken(ctx context.Context, bucket *tokenBucket, cs *connStats) bool {
+	if h.throttle == ThrottleReject {
+		if !bucket.allow() {
+			h.markThrottled(cs)
+			return false
+		}
+		if !h.global.allow() {
+			bucket.refund()
+			h.markThrottled(cs)
+			return false
+		}
+		return true
+	}
+
+	wait := bucket.reserve()
+	if g := h.global.reserve(); g > wait {
+		wait = g
+	}
+	if wait <= 0 {
+		return true
+	}
+	h.markThrottled(cs)
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+func (h *handler) markThrottled(cs *connStats) {
+	cs.throttled.Inc()
+	h.r.markThrottled()
 }
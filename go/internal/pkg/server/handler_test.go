@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"go.uber.org/zap"
@@ -45,7 +46,7 @@ func Test_handler_handle(t *testing.T) {
 				l.On("Info", "000000001", []zapcore.Field(nil))
 				l.On("Info", "000000002", []zapcore.Field(nil))
 
-				return m, NewHandler(m, l), l
+				return m, NewHandler(m, l, NewRegistry()), l
 			},
 			write: func(in net.Conn, cxl context.CancelFunc) {
 				logger.Debug("writing...")
@@ -62,7 +63,7 @@ func Test_handler_handle(t *testing.T) {
 			setup: func() (m *mockRepo, h handleConn, l *mockLog) {
 				m = new(mockRepo)
 				l = new(mockLog)
-				return m, NewHandler(m, l), l
+				return m, NewHandler(m, l, NewRegistry()), l
 			},
 			write: func(in net.Conn, cxl context.CancelFunc) {
 				cxl()
@@ -80,7 +81,7 @@ func Test_handler_handle(t *testing.T) {
 				m.On("IsUnique", uint32(0)).Return(true)
 				l = new(mockLog)
 				l.On("Info", "000000000", []zapcore.Field(nil))
-				return m, NewHandler(m, l), l
+				return m, NewHandler(m, l, NewRegistry()), l
 			},
 			write: func(in net.Conn, cxl context.CancelFunc) {
 				logger.Debug("writing...")
@@ -97,7 +98,7 @@ func Test_handler_handle(t *testing.T) {
 			setup: func() (m *mockRepo, h handleConn, l *mockLog) {
 				m = new(mockRepo)
 				l = new(mockLog)
-				return m, NewHandler(m, l), l
+				return m, NewHandler(m, l, NewRegistry()), l
 			},
 			write: func(in net.Conn, cxl context.CancelFunc) {
 				logger.Debug("writing...")
@@ -112,7 +113,7 @@ func Test_handler_handle(t *testing.T) {
 			setup: func() (m *mockRepo, h handleConn, l *mockLog) {
 				m = new(mockRepo)
 				l = new(mockLog)
-				return m, NewHandler(m, l), l
+				return m, NewHandler(m, l, NewRegistry()), l
 			},
 			write: func(in net.Conn, cxl context.CancelFunc) {
 				logger.Debug("writing...")
@@ -127,7 +128,7 @@ func Test_handler_handle(t *testing.T) {
 			setup: func() (m *mockRepo, h handleConn, l *mockLog) {
 				m = new(mockRepo)
 				l = new(mockLog)
-				return m, NewHandler(m, l), l
+				return m, NewHandler(m, l, NewRegistry()), l
 			},
 			write: func(in net.Conn, cxl context.CancelFunc) {
 				logger.Debug("writing...")
@@ -143,7 +144,7 @@ func Test_handler_handle(t *testing.T) {
 				m = new(mockRepo)
 				m.On("IsUnique", uint32(0)).Return(false)
 				l = new(mockLog)
-				return m, NewHandler(m, l), l
+				return m, NewHandler(m, l, NewRegistry()), l
 			},
 			write: func(in net.Conn, cxl context.CancelFunc) {
 				logger.Debug("writing...")
@@ -208,6 +209,21 @@ func (m *mockRepo) IsUnique(n uint32) (unique bool) {
 	return args.Bool(0)
 }
 
+func (m *mockRepo) IsUniqueBatch(ns []uint32, out []bool) {
+	for i, n := range ns {
+		out[i] = m.IsUnique(n)
+	}
+}
+
+func (m *mockRepo) Reset() {
+	m.Called()
+}
+
+func (m *mockRepo) Forget(n uint32) (forgotten bool) {
+	args := m.Called(n)
+	return args.Bool(0)
+}
+
 func (m *mockRepo) GetReport() string {
 	args := m.Called()
 	return args.String(0)
@@ -220,3 +236,92 @@ type mockLog struct {
 func (m *mockLog) Info(msg string, fields ...zap.Field) {
 	m.Called(msg, fields)
 }
+
+func TestNewBackend(t *testing.T) {
+	h := NewHandler(new(mockRepo), new(mockLog), NewRegistry())
+	hc, stop, err := NewBackend("goroutine", h, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, h, hc)
+	assert.NoError(t, stop())
+
+	_, _, err = NewBackend("threads", h, 1)
+	assert.EqualError(t, err, `unknown backend "threads"`)
+}
+
+func TestHandlerBatchesBufferedLines(t *testing.T) {
+	m := new(mockRepo)
+	m.On("IsUnique", uint32(1)).Return(true).Once()
+	m.On("IsUnique", uint32(2)).Return(true).Once()
+	m.On("IsUnique", uint32(1)).Return(false).Once()
+	l := new(mockLog)
+	l.On("Info", "000000001", []zapcore.Field(nil)).Once()
+	l.On("Info", "000000002", []zapcore.Field(nil)).Once()
+	r := NewRegistry()
+	h := NewHandler(m, l, r)
+
+	s, c := net.Pipe()
+	defer s.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- h.handle(context.Background(), func() {}, c)
+	}()
+	// The lines arrive together, the numbers before the name are checked
+	// before it is applied and nothing after the invalid line is.
+	_, err := s.Write([]byte("000000001\n000000002\nname batch\n000000001\nbad\n000000003\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, <-done)
+	m.AssertExpectations(t)
+	l.AssertExpectations(t)
+}
+
+// closeErrConn fails to close, like a socket the producer already reset.
+type closeErrConn struct {
+	net.Conn
+	closed bool
+}
+
+func (c *closeErrConn) Close() error {
+	c.closed = true
+	_ = c.Conn.Close()
+	return errors.New("connection reset by peer")
+}
+
+func TestHandlerProducerGone(t *testing.T) {
+	h := NewHandler(new(mockRepo), new(mockLog), NewRegistry())
+	s, c := net.Pipe()
+	conn := &closeErrConn{Conn: c}
+	done := make(chan error, 1)
+	go func() {
+		done <- h.handle(context.Background(), func() {}, conn)
+	}()
+	assert.NoError(t, s.Close())
+	assert.NoError(t, <-done, "a producer disconnecting is not an error")
+	assert.True(t, conn.closed, "the connection is closed to release its slot")
+}
+
+func TestHandlerFeedsEstimator(t *testing.T) {
+	m := new(mockRepo)
+	m.On("IsUnique", uint32(1)).Return(true)
+	m.On("IsUnique", uint32(2)).Return(false)
+	l := new(mockLog)
+	l.On("Info", "000000001", []zapcore.Field(nil))
+	h := NewHandler(m, l, NewRegistry())
+	est, err := NewEstimator(EstimatorConfig{Clients: 4, PrefixDigits: 1}, &noopRecorder{})
+	assert.NoError(t, err)
+	h.SetEstimator(est)
+
+	s, c := net.Pipe()
+	defer s.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- h.handle(context.Background(), func() {}, c)
+	}()
+	_, err = s.Write([]byte("name feeder\n000000001\n000000002\n000000001\nbad\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, <-done)
+
+	e := est.Estimates()
+	assert.Equal(t, uint64(2), e.Window)
+	assert.Equal(t, map[string]uint64{"feeder": 2}, e.Clients)
+	assert.Equal(t, map[string]uint64{"0": 2}, e.Prefixes)
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// HandoverConnsEnv is set to the number of producer connections passed to
+// a successor after its listeners.
+const HandoverConnsEnv = "NUMBERS_LOG_HANDOVER_CONNS"
+
+// HandedConn is a producer connection paused for a handover, along with
+// what was read from it without being processed.
+type HandedConn struct {
+	Name      string `json:"name,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Remote    string `json:"remote"`
+	Pending   []byte `json:"pending,omitempty"`
+
+	conn net.Conn
+}
+
+// pauser is implemented by the handlers that can stop serving their
+// connections without closing them.
+type pauser interface {
+	// pause stops reading from every connection at a line boundary, and
+	// from the connections handled afterwards straight away.
+	pause()
+	pausedConns() []HandedConn
+}
+
+func (h *handler) pause() {
+	h.pauseOnce.Do(func() {
+		close(h.paused)
+	})
+}
+
+func (h *handler) isPaused() bool {
+	select {
+	case <-h.paused:
+		return true
+	default:
+		return false
+	}
+}
+
+// keepPaused keeps the socket of a paused connection for a successor.
+func (h *handler) keepPaused(raw net.Conn, cs *connStats, pending []byte) {
+	h.handedMu.Lock()
+	defer h.handedMu.Unlock()
+	h.handed = append(h.handed, HandedConn{
+		Name:      cs.name.Load(),
+		Namespace: cs.namespace.Load(),
+		Remote:    cs.remote,
+		Pending:   pending,
+		conn:      raw,
+	})
+}
+
+func (h *handler) pausedConns() []HandedConn {
+	h.handedMu.Lock()
+	defer h.handedMu.Unlock()
+	return append([]HandedConn(nil), h.handed...)
+}
+
+// resume gives a connection handed over by a previous process back its name
+// and namespace.
+func (h *handler) resume(cs *connStats, conn net.Conn) {
+	rc := findResumed(conn)
+	if rc == nil {
+		return
+	}
+	cs.name.Store(rc.name)
+	if rc.namespace == "" || h.ns == nil {
+		return
+	}
+	n, err := h.ns.join(rc.namespace)
+	if err != nil {
+		fmt.Printf("connection %v: %v\n", cs.id, err)
+		return
+	}
+	cs.join(n)
+}
+
+// unreadBuffer returns a copy of what r has buffered.
+func unreadBuffer(r *bufio.Reader) []byte {
+	b, _ := r.Peek(r.Buffered())
+	return append([]byte(nil), b...)
+}
+
+// unwrapConn returns the connection accepted by the listener behind conn,
+// along with any bytes read from it that conn has not returned yet.
+func unwrapConn(conn net.Conn) (raw net.Conn, pending []byte) {
+	for {
+		switch c := conn.(type) {
+		case *releaseConn:
+			conn = c.Conn
+		case *namespaceConn:
+			conn = c.Conn
+		case *proxyConn:
+			pending = append(pending, unreadBuffer(c.r)...)
+			conn = c.Conn
+		case *resumedConn:
+			pending = append(pending, c.pending...)
+			conn = c.Conn
+		default:
+			return conn, pending
+		}
+	}
+}
+
+// SaveConns writes the paused connections to file and returns duplicates of
+// their sockets, in the same order, to pass to a successor.
+func SaveConns(conns []HandedConn, file string) ([]*os.File, error) {
+	files := make([]*os.File, 0, len(conns))
+	closeFiles := func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}
+	for _, hc := range conns {
+		c, ok := hc.conn.(interface{ File() (*os.File, error) })
+		if !ok {
+			closeFiles()
+			return nil, errors.New("connection cannot be handed over")
+		}
+		f, err := c.File()
+		if err != nil {
+			closeFiles()
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	b, err := json.Marshal(conns)
+	if err == nil {
+		err = os.WriteFile(file, b, 0644)
+	}
+	if err != nil {
+		closeFiles()
+		return nil, err
+	}
+	return files, nil
+}
+
+// ConnsFromEnv returns the producer connections handed over by a previous
+// process, passed after its listeners, and removes the file they were saved
+// to. It returns no connections when none were passed.
+func ConnsFromEnv(file string, listeners int) ([]net.Conn, error) {
+	count := os.Getenv(HandoverConnsEnv)
+	if count == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q", HandoverConnsEnv, count)
+	}
+	if err := os.Unsetenv(HandoverConnsEnv); err != nil {
+		return nil, err
+	}
+	files := make([]*os.File, 0, n)
+	for fd := listenFdsStart + listeners; fd < listenFdsStart+listeners+n; fd++ {
+		files = append(files, os.NewFile(uintptr(fd), "conn"+strconv.Itoa(fd)))
+	}
+	conns, err := resumeConns(file, files)
+	for _, f := range files {
+		_ = f.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return conns, os.Remove(file)
+}
+
+// resumeConns matches the sockets in files with the connections saved to
+// file. The files can be closed afterwards.
+func resumeConns(file string, files []*os.File) ([]net.Conn, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var handed []HandedConn
+	if err := json.Unmarshal(b, &handed); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if len(handed) != len(files) {
+		return nil, fmt.Errorf("%s lists %v connections, %v were passed", file, len(handed), len(files))
+	}
+	conns := make([]net.Conn, 0, len(files))
+	for i, f := range files {
+		c, err := net.FileConn(f)
+		if err != nil {
+			for _, opened := range conns {
+				_ = opened.Close()
+			}
+			return nil, fmt.Errorf("file descriptor %v is not a connection: %w", f.Fd(), err)
+		}
+		hc := handed[i]
+		var remote net.Addr = c.RemoteAddr()
+		if addr, err := net.ResolveTCPAddr("tcp", hc.Remote); err == nil {
+			remote = addr
+		}
+		conns = append(conns, &resumedConn{
+			Conn:      c,
+			pending:   hc.Pending,
+			remote:    remote,
+			name:      hc.Name,
+			namespace: hc.Namespace,
+		})
+	}
+	return conns, nil
+}
+
+// resumedConn is a connection handed over by a previous process, which
+// returns what that process read from it before the socket.
+type resumedConn struct {
+	net.Conn
+	pending   []byte
+	remote    net.Addr
+	name      string
+	namespace string
+}
+
+func (c *resumedConn) Read(p []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *resumedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// findResumed returns conn as handed over by a previous process, nil if it
+// was accepted by this one.
+func findResumed(conn net.Conn) *resumedConn {
+	for {
+		switch c := conn.(type) {
+		case *resumedConn:
+			return c
+		case *releaseConn:
+			conn = c.Conn
+		default:
+			return nil
+		}
+	}
+}
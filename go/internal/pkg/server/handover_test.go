@@ -0,0 +1,105 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHandOverConns(t *testing.T) {
+	for _, backend := range []string{"goroutine", "epoll"} {
+		t.Run(backend, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "handover")
+			require.NoError(t, err)
+			t.Cleanup(func() { _ = os.RemoveAll(dir) })
+			file := filepath.Join(dir, "numbers.state.conns")
+
+			l1 := new(mockLog)
+			l1.On("Info", "000000001", mock.Anything).Once()
+			reg1 := NewRegistry()
+			hc, stop, err := NewBackend(backend, NewHandler(newMapChecker(&noopRecorder{}), l1, reg1), 1)
+			if err != nil {
+				t.Skip(err)
+			}
+			defer stop()
+			s1 := NewServer(10, "127.0.0.1", 0, hc, time.Minute)
+			require.NoError(t, s1.Start())
+			done := make(chan error, 1)
+			go func() {
+				done <- s1.Process()
+			}()
+
+			c, err := net.Dial("tcp", s1.listeners[0].Addr().String())
+			require.NoError(t, err)
+			defer c.Close()
+			_, err = c.Write([]byte("name sensor\n000000001\n0000"))
+			require.NoError(t, err)
+			assert.Eventually(t, func() bool {
+				conns := reg1.Connections()
+				return len(conns) == 1 && conns[0].Unique == 1 && conns[0].BytesRead == 26
+			}, time.Second, 10*time.Millisecond)
+
+			// Pausing keeps the connection open along with its partial line.
+			require.NoError(t, s1.Pause())
+			require.NoError(t, <-done)
+			paused := s1.PausedConns()
+			require.Len(t, paused, 1)
+			defer paused[0].conn.Close()
+			assert.Equal(t, "sensor", paused[0].Name)
+			assert.Equal(t, []byte("0000"), paused[0].Pending)
+			assert.Empty(t, reg1.Connections())
+
+			files, err := SaveConns(paused, file)
+			require.NoError(t, err)
+			conns, err := resumeConns(file, files)
+			for _, f := range files {
+				_ = f.Close()
+			}
+			require.NoError(t, err)
+
+			// The successor carries on with the same connection.
+			l2 := new(mockLog)
+			l2.On("Info", "000000002", mock.Anything).Once()
+			reg2 := NewRegistry()
+			hc2, stop2, err := NewBackend(backend, NewHandler(newMapChecker(&noopRecorder{}), l2, reg2), 1)
+			require.NoError(t, err)
+			defer stop2()
+			s2 := NewServer(10, "127.0.0.1", 0, hc2, time.Minute)
+			s2.ResumeConns(conns...)
+			require.NoError(t, s2.Start())
+			go func() {
+				_ = s2.Process()
+			}()
+			defer s2.Shutdown()
+
+			_, err = c.Write([]byte("00002\n"))
+			require.NoError(t, err)
+			assert.Eventually(t, func() bool {
+				conns := reg2.Connections()
+				return len(conns) == 1 && conns[0].Unique == 1
+			}, time.Second, 10*time.Millisecond)
+			ci := reg2.Connections()[0]
+			assert.Equal(t, "sensor", ci.Name)
+			assert.Equal(t, c.LocalAddr().String(), ci.RemoteAddr)
+			l1.AssertExpectations(t)
+			l2.AssertExpectations(t)
+		})
+	}
+}
+
+func TestConnsFromEnv(t *testing.T) {
+	setEnv(t, HandoverConnsEnv, "")
+	conns, err := ConnsFromEnv("missing.conns", 0)
+	assert.NoError(t, err)
+	assert.Empty(t, conns)
+
+	setEnv(t, HandoverConnsEnv, "some")
+	_, err = ConnsFromEnv("missing.conns", 0)
+	assert.Error(t, err)
+}
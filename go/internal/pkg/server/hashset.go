@@ -0,0 +1,26 @@
+package server
+
+// newHashChecker creates a sharded KeyChecker of any key type, which suits
+// keys too sparse for a bitset such as strings.
+func newHashChecker[K Key](r Recorder, shards int) *shardedSet[K] {
+	return newShardedSet(r, shards, hashKey[K])
+}
+
+// hashKey spreads the bits of k over a 64 bit hash, with FNV-1a for
+// strings.
+func hashKey[K Key](k K) uint64 {
+	switch k := any(k).(type) {
+	case uint32:
+		return mix64(uint64(k))
+	case uint64:
+		return mix64(k)
+	case string:
+		h := uint64(14695981039346656037)
+		for i := 0; i < len(k); i++ {
+			h ^= uint64(k[i])
+			h *= 1099511628211
+		}
+		return mix64(h)
+	}
+	return 0
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestAddOkayHash(t *testing.T) {
+	mr := &mockRecorder{}
+	mr.On("markUnique").Return()
+	testAddOkay(t, newHashChecker[uint32](mr, 4))
+}
+
+func TestAddDuplicateHash(t *testing.T) {
+	mr := &mockRecorder{}
+	mr.On("markUnique").Return()
+	mr.On("markDuplicate").Return()
+	testAddDuplicate(t, newHashChecker[uint32](mr, 4))
+}
+
+func TestHashChecker_keys(t *testing.T) {
+	t.Run("uint64", func(t *testing.T) {
+		testHashCheckerKeys(t, []uint64{1, 1 << 40, 18446744073709551615, 7})
+	})
+	t.Run("string", func(t *testing.T) {
+		testHashCheckerKeys(t, []string{"a", "", "0f8fad5b-d9cb-469f-a165-70867728950e", "b"})
+	})
+}
+
+func testHashCheckerKeys[K Key](t *testing.T, keys []K) {
+	r := NewRecorder()
+	c := newHashChecker[K](r, 4)
+	for _, k := range keys {
+		assert.True(t, c.IsUnique(k), "key %v", k)
+	}
+	out := make([]bool, len(keys)+1)
+	c.IsUniqueBatch(append([]K{keys[0]}, keys...), out)
+	assert.Equal(t, make([]bool, len(keys)+1), out)
+	assert.Equal(t, fmt.Sprintf("Received %v unique numbers, %v duplicates. Unique total: %v", len(keys), len(keys)+1, len(keys)), c.GetReport())
+
+	var walked []K
+	c.walkKeys(func(k K) bool {
+		walked = append(walked, k)
+		return true
+	})
+	assert.ElementsMatch(t, keys, walked)
+
+	assert.True(t, c.Forget(keys[1]))
+	assert.False(t, c.Forget(keys[1]))
+	assert.True(t, c.restoreKey(keys[1]))
+	assert.False(t, c.restoreKey(keys[1]))
+	c.Reset()
+	assert.True(t, c.IsUnique(keys[2]))
+}
+
+func TestNewHashChecker(t *testing.T) {
+	tests := []struct {
+		shards, expected int
+	}{
+		{shards: 0, expected: 1},
+		{shards: 3, expected: 4},
+		{shards: 64, expected: 64},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.shards), func(t *testing.T) {
+			c := newHashChecker[string](&noopRecorder{}, tt.shards)
+			assert.Len(t, c.shards, tt.expected)
+			used := map[int]bool{}
+			for i := 0; i < 1000; i++ {
+				s := c.shard(fmt.Sprintf("order-%v", i))
+				assert.Less(t, s, tt.expected)
+				used[s] = true
+			}
+			assert.Len(t, used, tt.expected, "keys spread over every shard")
+		})
+	}
+}
+
+func TestHashChecker_walkStops(t *testing.T) {
+	c := newHashChecker[uint64](&noopRecorder{}, 4)
+	for k := uint64(0); k < 100; k++ {
+		c.IsUnique(k)
+	}
+	var walked []uint64
+	c.walkKeys(func(k uint64) bool {
+		walked = append(walked, k)
+		return len(walked) < 10
+	})
+	assert.Len(t, walked, 10)
+}
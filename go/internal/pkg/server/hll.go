@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+const (
+	// DefaultSketchPrecision gives sketches of 16KB with a standard error
+	// of 0.8%.
+	DefaultSketchPrecision = 14
+	minSketchPrecision     = 4
+	maxSketchPrecision     = 16
+)
+
+var sketchMagic = []byte("NLHLL001")
+
+// Sketch is a HyperLogLog sketch, estimating how many distinct numbers were
+// added to it with a standard error of 1.04/sqrt(2^precision) from a byte
+// per 2^precision registers. Sketches of the same precision merge into the
+// sketch of every number added to either of them, so hourly sketches can be
+// rolled up into daily ones. A Sketch is not safe for concurrent use.
+type Sketch struct {
+	p         uint8
+	registers []uint8
+}
+
+func NewSketch(precision uint8) (*Sketch, error) {
+	if precision < minSketchPrecision || precision > maxSketchPrecision {
+		return nil, fmt.Errorf("sketch precision %v, expected %v to %v", precision, minSketchPrecision, maxSketchPrecision)
+	}
+	return &Sketch{p: precision, registers: make([]uint8, 1<<precision)}, nil
+}
+
+// Precision is the base 2 logarithm of the number of registers.
+func (s *Sketch) Precision() uint8 {
+	return s.p
+}
+
+// StdError is the relative standard error of the estimates.
+func (s *Sketch) StdError() float64 {
+	return 1.04 / math.Sqrt(float64(len(s.registers)))
+}
+
+func (s *Sketch) Add(n uint32) {
+	s.add(mix64(uint64(n)))
+}
+
+// add records the 64 bit hash of a number. Its first p bits pick the
+// register, which keeps the longest run of leading zeros of the rest.
+func (s *Sketch) add(h uint64) {
+	i := h >> (64 - s.p)
+	rho := uint8(bits.LeadingZeros64(h<<s.p|1<<(s.p-1)) + 1)
+	if rho > s.registers[i] {
+		s.registers[i] = rho
+	}
+}
+
+// Merge adds the numbers of o to s.
+func (s *Sketch) Merge(o *Sketch) error {
+	if o.p != s.p {
+		return fmt.Errorf("cannot merge a sketch of precision %v into one of %v", o.p, s.p)
+	}
+	for i, r := range o.registers {
+		if r > s.registers[i] {
+			s.registers[i] = r
+		}
+	}
+	return nil
+}
+
+// Estimate returns the estimated count of distinct numbers added. Small
+// counts, where registers are still empty, are estimated from how many are.
+func (s *Sketch) Estimate() uint64 {
+	m := float64(len(s.registers))
+	sum, zeros := 0.0, 0
+	for _, r := range s.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := alpha(len(s.registers)) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+	return uint64(e + 0.5)
+}
+
+func alpha(m int) float64 {
+	switch m {
+	case 16:
+		return 0.673
+	case 32:
+		return 0.697
+	case 64:
+		return 0.709
+	}
+	return 0.7213 / (1 + 1.079/float64(m))
+}
+
+// MarshalBinary encodes the sketch as sketchMagic, the precision and a byte
+// per register.
+func (s *Sketch) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 0, len(sketchMagic)+1+len(s.registers))
+	b = append(b, sketchMagic...)
+	b = append(b, s.p)
+	return append(b, s.registers...), nil
+}
+
+func (s *Sketch) UnmarshalBinary(b []byte) error {
+	if len(b) <= len(sketchMagic) || !bytes.Equal(b[:len(sketchMagic)], sketchMagic) {
+		return errors.New("not a numbers sketch")
+	}
+	p := b[len(sketchMagic)]
+	o, err := NewSketch(p)
+	if err != nil {
+		return err
+	}
+	registers := b[len(sketchMagic)+1:]
+	if len(registers) != len(o.registers) {
+		return fmt.Errorf("sketch of %v registers, expected %v", len(registers), len(o.registers))
+	}
+	for _, r := range registers {
+		if int(r) > 65-int(p) {
+			return fmt.Errorf("sketch register of %v, expected at most %v", r, 65-int(p))
+		}
+	}
+	copy(o.registers, registers)
+	*s = *o
+	return nil
+}
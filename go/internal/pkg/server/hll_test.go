@@ -0,0 +1,95 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math"
+	"testing"
+)
+
+func newTestSketch(t *testing.T, from, to uint32) *Sketch {
+	s, err := NewSketch(DefaultSketchPrecision)
+	require.NoError(t, err)
+	for n := from; n < to; n++ {
+		s.Add(n)
+	}
+	return s
+}
+
+func assertEstimate(t *testing.T, expected uint64, s *Sketch) {
+	// Three standard errors away is rare enough for fixed inputs.
+	delta := 3 * s.StdError() * float64(expected)
+	assert.InDelta(t, float64(expected), float64(s.Estimate()), math.Max(delta, 1), "expected about %v", expected)
+}
+
+func TestNewSketch(t *testing.T) {
+	for _, p := range []uint8{0, 3, 17} {
+		_, err := NewSketch(p)
+		assert.Error(t, err, "precision %v", p)
+	}
+	s, err := NewSketch(4)
+	require.NoError(t, err)
+	assert.Equal(t, uint8(4), s.Precision())
+	assert.Equal(t, 0.26, s.StdError())
+}
+
+func TestSketch_Estimate(t *testing.T) {
+	tests := []struct {
+		name     string
+		distinct uint32
+	}{
+		{name: "Empty", distinct: 0},
+		{name: "Few", distinct: 10},
+		{name: "Thousands", distinct: 5000},
+		{name: "Hundreds of thousands", distinct: 300000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestSketch(t, 1000, 1000+tt.distinct)
+			assertEstimate(t, uint64(tt.distinct), s)
+			before := s.Estimate()
+			for n := uint32(1000); n < 1000+tt.distinct; n++ {
+				s.Add(n)
+			}
+			assert.Equal(t, before, s.Estimate(), "duplicates change nothing")
+		})
+	}
+}
+
+func TestSketch_Merge(t *testing.T) {
+	a := newTestSketch(t, 0, 60000)
+	b := newTestSketch(t, 40000, 100000)
+	require.NoError(t, a.Merge(b))
+	assertEstimate(t, 100000, a)
+
+	c, err := NewSketch(10)
+	require.NoError(t, err)
+	assert.EqualError(t, a.Merge(c), "cannot merge a sketch of precision 10 into one of 14")
+}
+
+func TestSketch_Binary(t *testing.T) {
+	s := newTestSketch(t, 0, 1000)
+	b, err := s.MarshalBinary()
+	require.NoError(t, err)
+	assert.Len(t, b, len(sketchMagic)+1+1<<DefaultSketchPrecision)
+
+	var decoded Sketch
+	require.NoError(t, decoded.UnmarshalBinary(b))
+	assert.Equal(t, s, &decoded)
+
+	tests := []struct {
+		name string
+		b    []byte
+		err  string
+	}{
+		{name: "Magic", b: []byte("NLSNAP01\x04"), err: "not a numbers sketch"},
+		{name: "Precision", b: append([]byte("NLHLL001\x02"), make([]byte, 4)...), err: "sketch precision 2, expected 4 to 16"},
+		{name: "Registers", b: append([]byte("NLHLL001\x04"), make([]byte, 15)...), err: "sketch of 15 registers, expected 16"},
+		{name: "Register", b: append([]byte("NLHLL001\x04"), append(make([]byte, 15), 62)...), err: "sketch register of 62, expected at most 61"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.EqualError(t, new(Sketch).UnmarshalBinary(tt.b), tt.err)
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// maxKeyLength is the longest string key accepted.
+const maxKeyLength = 256
+
+// Key is a type of key that can be deduplicated.
+type Key interface {
+	uint32 | uint64 | string
+}
+
+// KeyChecker deduplicates keys of type K.
+type KeyChecker[K Key] interface {
+	IsUnique(k K) (unique bool)
+	// IsUniqueBatch sets out[i] to whether ks[i] is unique. A key repeated
+	// within ks is only unique the first time.
+	IsUniqueBatch(ks []K, out []bool)
+	// Reset forgets every key seen.
+	Reset()
+	// Forget forgets k, so it is unique the next time it is received, and
+	// reports whether it had been seen.
+	Forget(k K) (forgotten bool)
+	GetReport() string
+}
+
+// KeyType parses the lines producers send into keys and formats the keys
+// back into the lines written to the log.
+type KeyType[K Key] struct {
+	Name   string
+	Parse  func(line string) (K, error)
+	Format func(k K) string
+}
+
+var (
+	// Uint64Keys are decimal numbers up to 18446744073709551615, such as
+	// order IDs. Leading zeros are dropped, so 007 and 7 are the same key.
+	Uint64Keys = KeyType[uint64]{
+		Name:   "uint64",
+		Parse:  parseUint64Key,
+		Format: func(k uint64) string { return strconv.FormatUint(k, 10) },
+	}
+	// UUIDKeys are UUIDs in their 36 character form, in either case. They
+	// are logged in lower case.
+	UUIDKeys = KeyType[string]{
+		Name:   "uuid",
+		Parse:  parseUUIDKey,
+		Format: func(k string) string { return k },
+	}
+	// StringKeys are any line of up to maxKeyLength printable bytes.
+	StringKeys = KeyType[string]{
+		Name:   "string",
+		Parse:  parseStringKey,
+		Format: func(k string) string { return k },
+	}
+)
+
+func parseUint64Key(line string) (uint64, error) {
+	// ParseUint would accept a sign or underscores.
+	for i := 0; i < len(line); i++ {
+		if line[i] < '0' || line[i] > '9' {
+			return 0, fmt.Errorf("invalid number %q", line)
+		}
+	}
+	k, err := strconv.ParseUint(line, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", line)
+	}
+	return k, nil
+}
+
+func parseUUIDKey(line string) (string, error) {
+	if len(line) != 36 {
+		return "", fmt.Errorf("invalid UUID %q", line)
+	}
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case i == 8 || i == 13 || i == 18 || i == 23:
+			if c != '-' {
+				return "", fmt.Errorf("invalid UUID %q", line)
+			}
+		case c >= '0' && c <= '9', c >= 'a' && c <= 'f', c >= 'A' && c <= 'F':
+		default:
+			return "", fmt.Errorf("invalid UUID %q", line)
+		}
+	}
+	return strings.ToLower(line), nil
+}
+
+func parseStringKey(line string) (string, error) {
+	if line == "" || len(line) > maxKeyLength {
+		return "", fmt.Errorf("invalid key %q", line)
+	}
+	for i := 0; i < len(line); i++ {
+		if line[i] < 0x20 || line[i] == 0x7f {
+			return "", fmt.Errorf("invalid key %q", line)
+		}
+	}
+	return line, nil
+}
+
+// KeySet is a KeyChecker of keys other than nine digit numbers along with
+// their KeyType, so a handler and handovers work on it whatever the type.
+type KeySet interface {
+	GetReport() string
+	// processLines applies the lines of a connection for h, checking each
+	// run of keys with a single IsUniqueBatch call. It returns false when a
+	// line is invalid and the connection has to be closed.
+	processLines(ctx context.Context, h *handler, cancel context.CancelFunc, cs *connStats, bucket *tokenBucket, lines []string) bool
+	// writeKeys writes every key seen, one per line.
+	writeKeys(w io.Writer) (count uint64, err error)
+	// readKeys restores the keys written by writeKeys.
+	readKeys(r io.Reader) (count uint64, err error)
+}
+
+// keyRestorer is implemented by the key checkers whose keys can be saved
+// for a handover.
+type keyRestorer[K Key] interface {
+	// walkKeys calls fn for every key seen, in no particular order, until
+	// fn returns false.
+	walkKeys(fn func(k K) bool)
+	// restoreKey marks k as seen without counting it as received and
+	// reports whether it was new.
+	restoreKey(k K) (restored bool)
+}
+
+// NewKeySet returns a hash set of shards for the named key type: uint64,
+// uuid or string.
+func NewKeySet(keys string, shards int, r Recorder) (KeySet, error) {
+	switch keys {
+	case Uint64Keys.Name:
+		return newKeySet[uint64](Uint64Keys, newHashChecker[uint64](r, shards)), nil
+	case UUIDKeys.Name:
+		return newKeySet[string](UUIDKeys, newHashChecker[string](r, shards)), nil
+	case StringKeys.Name:
+		return newKeySet[string](StringKeys, newHashChecker[string](r, shards)), nil
+	}
+	return nil, fmt.Errorf("unknown key type %q", keys)
+}
+
+type keySet[K Key] struct {
+	kt KeyType[K]
+	kc KeyChecker[K]
+}
+
+func newKeySet[K Key](kt KeyType[K], kc KeyChecker[K]) *keySet[K] {
+	return &keySet[K]{kt: kt, kc: kc}
+}
+
+func (s *keySet[K]) GetReport() string {
+	return s.kc.GetReport()
+}
+
+func (s *keySet[K]) processLines(ctx context.Context, h *handler, cancel context.CancelFunc, cs *connStats, bucket *tokenBucket, lines []string) bool {
+	ks := make([]K, 0, len(lines))
+	for _, v := range lines {
+		k, err := s.kt.Parse(v)
+		if err != nil || isCommand(v) {
+			// The keys before anything else are checked first. Commands
+			// win over string keys spelling them.
+			s.checkBatch(h, cs, ks)
+			ks = ks[:0]
+			if !h.processCommand(cancel, cs, v) {
+				return false
+			}
+			continue
+		}
+		cs.received.Inc()
+		if !h.takeToken(ctx, bucket, cs) {
+			continue
+		}
+		ks = append(ks, k)
+	}
+	s.checkBatch(h, cs, ks)
+	return true
+}
+
+func (s *keySet[K]) checkBatch(h *handler, cs *connStats, ks []K) {
+	if len(ks) == 0 {
+		return
+	}
+	unique := make([]bool, len(ks))
+	s.kc.IsUniqueBatch(ks, unique)
+	for i, u := range unique {
+		if u {
+			cs.unique.Inc()
+			h.logger.Info(s.kt.Format(ks[i]))
+		} else {
+			cs.duplicate.Inc()
+		}
+	}
+}
+
+func (s *keySet[K]) writeKeys(w io.Writer) (count uint64, err error) {
+	kr, ok := s.kc.(keyRestorer[K])
+	if !ok {
+		return 0, errSnapshotUnsupported
+	}
+	bw := bufio.NewWriter(w)
+	kr.walkKeys(func(k K) bool {
+		if _, err = bw.WriteString(s.kt.Format(k) + "\n"); err != nil {
+			return false
+		}
+		count++
+		return true
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, bw.Flush()
+}
+
+func (s *keySet[K]) readKeys(r io.Reader) (count uint64, err error) {
+	kr, ok := s.kc.(keyRestorer[K])
+	if !ok {
+		return 0, errSnapshotUnsupported
+	}
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		k, err := s.kt.Parse(sc.Text())
+		if err != nil {
+			return count, fmt.Errorf("line %v: %v", line, err)
+		}
+		if kr.restoreKey(k) {
+			count++
+		}
+	}
+	return count, sc.Err()
+}
+
+// SaveKeys writes the keys of ks to file, one per line, for a successor to
+// load with LoadKeys.
+func SaveKeys(ks KeySet, file string) error {
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := ks.writeKeys(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// LoadKeys restores the keys saved by SaveKeys into ks and returns how many
+// were read.
+func LoadKeys(ks KeySet, file string) (uint64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return ks.readKeys(f)
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeyTypes(t *testing.T) {
+	long := strings.Repeat("x", maxKeyLength)
+	tests := []struct {
+		name   string
+		parse  func(string) (string, error)
+		line   string
+		logged string
+		err    string
+	}{
+		{name: "Uint64", parse: formatted(Uint64Keys), line: "18446744073709551615", logged: "18446744073709551615"},
+		{name: "Uint64Zeros", parse: formatted(Uint64Keys), line: "007", logged: "7"},
+		{name: "Uint64Overflow", parse: formatted(Uint64Keys), line: "18446744073709551616", err: `invalid number "18446744073709551616"`},
+		{name: "Uint64Sign", parse: formatted(Uint64Keys), line: "+1", err: `invalid number "+1"`},
+		{name: "Uint64Underscore", parse: formatted(Uint64Keys), line: "1_000", err: `invalid number "1_000"`},
+		{name: "Uint64Empty", parse: formatted(Uint64Keys), line: "", err: `invalid number ""`},
+		{name: "UUID", parse: formatted(UUIDKeys), line: "0F8FAD5B-D9CB-469F-A165-70867728950E", logged: "0f8fad5b-d9cb-469f-a165-70867728950e"},
+		{name: "UUIDShort", parse: formatted(UUIDKeys), line: "0f8fad5b-d9cb-469f-a165-70867728950", err: `invalid UUID "0f8fad5b-d9cb-469f-a165-70867728950"`},
+		{name: "UUIDHyphens", parse: formatted(UUIDKeys), line: "0f8fad5bd-9cb-469f-a165-70867728950e", err: `invalid UUID "0f8fad5bd-9cb-469f-a165-70867728950e"`},
+		{name: "UUIDHex", parse: formatted(UUIDKeys), line: "0f8fad5b-d9cb-469f-a165-70867728950g", err: `invalid UUID "0f8fad5b-d9cb-469f-a165-70867728950g"`},
+		{name: "String", parse: formatted(StringKeys), line: "order #42", logged: "order #42"},
+		{name: "StringLongest", parse: formatted(StringKeys), line: long, logged: long},
+		{name: "StringTooLong", parse: formatted(StringKeys), line: long + "x", err: `invalid key "` + long + `x"`},
+		{name: "StringControl", parse: formatted(StringKeys), line: "a\tb", err: `invalid key "a\tb"`},
+		{name: "StringEmpty", parse: formatted(StringKeys), line: "", err: `invalid key ""`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logged, err := tt.parse(tt.line)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.logged, logged)
+		})
+	}
+}
+
+// formatted parses a line into a key of kt and formats it back.
+func formatted[K Key](kt KeyType[K]) func(string) (string, error) {
+	return func(line string) (string, error) {
+		k, err := kt.Parse(line)
+		if err != nil {
+			return "", err
+		}
+		return kt.Format(k), nil
+	}
+}
+
+func TestNewKeySet(t *testing.T) {
+	for _, keys := range []string{"uint64", "uuid", "string"} {
+		ks, err := NewKeySet(keys, 4, &noopRecorder{})
+		assert.NoError(t, err)
+		assert.NotNil(t, ks)
+	}
+	_, err := NewKeySet("number", 4, &noopRecorder{})
+	assert.EqualError(t, err, `unknown key type "number"`)
+}
+
+func TestHandlerKeys(t *testing.T) {
+	tests := []struct {
+		name   string
+		keys   string
+		sent   string
+		logged []string
+		report string
+	}{
+		{
+			name:   "Uint64",
+			keys:   "uint64",
+			sent:   "18446744073709551615\n42\n042\nname orders\n7\n-1\n8\n",
+			logged: []string{"18446744073709551615", "42", "7"},
+			report: "Received 3 unique numbers, 1 duplicates. Unique total: 3",
+		},
+		{
+			name:   "UUID",
+			keys:   "uuid",
+			sent:   "0f8fad5b-d9cb-469f-a165-70867728950e\n0F8FAD5B-D9CB-469F-A165-70867728950E\n7c9e6679-7425-40de-944b-e07fc1f90ae7\nterminate\n",
+			logged: []string{"0f8fad5b-d9cb-469f-a165-70867728950e", "7c9e6679-7425-40de-944b-e07fc1f90ae7"},
+			report: "Received 2 unique numbers, 1 duplicates. Unique total: 2",
+		},
+		{
+			name:   "String",
+			keys:   "string",
+			sent:   "a b\nname strings\na b\nc\nterminate\n",
+			logged: []string{"a b", "c"},
+			report: "Received 2 unique numbers, 1 duplicates. Unique total: 2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := new(mockLog)
+			for _, v := range tt.logged {
+				l.On("Info", v, []zapcore.Field(nil)).Once()
+			}
+			r := NewRecorder()
+			ks, err := NewKeySet(tt.keys, 4, r)
+			require.NoError(t, err)
+			h := NewHandler(nil, l, NewRegistry())
+			h.SetKeys(ks)
+
+			s, c := net.Pipe()
+			defer s.Close()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan error, 1)
+			go func() {
+				done <- h.handle(ctx, cancel, c)
+			}()
+			// The connection is closed by an invalid line or terminate.
+			_, _ = s.Write([]byte(tt.sent))
+			assert.NoError(t, <-done)
+			l.AssertExpectations(t)
+			assert.Equal(t, tt.report, ks.GetReport())
+		})
+	}
+}
+
+func TestKeySet_saveAndLoad(t *testing.T) {
+	ks, err := NewKeySet("uuid", 4, &noopRecorder{})
+	require.NoError(t, err)
+	kc := ks.(*keySet[string]).kc
+	kc.IsUnique("0f8fad5b-d9cb-469f-a165-70867728950e")
+	kc.IsUnique("7c9e6679-7425-40de-944b-e07fc1f90ae7")
+
+	dir, err := ioutil.TempDir("", "Keys")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "numbers.state")
+	require.NoError(t, SaveKeys(ks, file))
+
+	r := NewRecorder()
+	restored, err := NewKeySet("uuid", 2, r)
+	require.NoError(t, err)
+	n, err := LoadKeys(restored, file)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), n)
+	assert.Equal(t, "Received 0 unique numbers, 0 duplicates. Unique total: 2", r.getReport())
+	rc := restored.(*keySet[string]).kc
+	assert.False(t, rc.IsUnique("7c9e6679-7425-40de-944b-e07fc1f90ae7"))
+
+	// Keys already present are not counted.
+	n, err = restored.readKeys(bytes.NewBufferString("7c9e6679-7425-40de-944b-e07fc1f90ae7\n550e8400-e29b-41d4-a716-446655440000\n"))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), n)
+	_, err = restored.readKeys(bytes.NewBufferString("7c9e6679-7425-40de-944b-e07fc1f90ae7\nnope\n"))
+	assert.EqualError(t, err, `line 2: invalid UUID "nope"`)
+	_, err = LoadKeys(restored, file+".missing")
+	assert.True(t, os.IsNotExist(err))
+	_, err = newKeySet[uint32](KeyType[uint32]{}, new(mockRepo)).writeKeys(&bytes.Buffer{})
+	assert.Equal(t, errSnapshotUnsupported, err)
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// OverflowPolicy decides what happens to a connection that arrives once
+// the connection limit has been reached.
+type OverflowPolicy int
+
+const (
+	// OverflowQueue stops accepting, leaving new connections in the kernel backlog.
+	OverflowQueue OverflowPolicy = iota
+	// OverflowReject accepts the connection, replies with busyMessage and closes it.
+	OverflowReject
+	// OverflowWait accepts the connection and rejects it if no slot frees up within the maximum wait.
+	OverflowWait
+)
+
+const busyMessage = "ERR server-busy\n"
+
+// DefaultMaxWaiting is how many connections can wait for a slot at once
+// with OverflowWait when none is configured.
+const DefaultMaxWaiting = 1024
+
+var errListenerClosed = errors.New("listener closed")
+
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch s {
+	case "queue":
+		return OverflowQueue, nil
+	case "reject":
+		return OverflowReject, nil
+	case "wait":
+		return OverflowWait, nil
+	}
+	return OverflowQueue, fmt.Errorf("unknown overflow policy %q", s)
+}
+
+type limitListener struct {
+	net.Listener
+	sem     chan struct{}
+	waiting chan struct{}
+	policy  OverflowPolicy
+	maxWait time.Duration
+	r       Recorder
+
+	start     sync.Once
+	closeOnce sync.Once
+	done      chan struct{}
+	ready     chan net.Conn
+	errs      chan error
+}
+
+// newLimitListener limits the connections accepted by l to the capacity of
+// sem, which can be shared between listeners for an aggregate limit. With
+// OverflowWait, connections beyond the capacity of waiting are rejected
+// right away rather than each holding a descriptor for up to maxWait.
+func newLimitListener(l net.Listener, sem, waiting chan struct{}, policy OverflowPolicy, maxWait time.Duration, r Recorder) *limitListener {
+	return &limitListener{
+		Listener: l,
+		sem:      sem,
+		waiting:  waiting,
+		policy:   policy,
+		maxWait:  maxWait,
+		r:        r,
+		done:     make(chan struct{}),
+		ready:    make(chan net.Conn),
+		errs:     make(chan error, 1),
+	}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	if l.policy == OverflowQueue {
+		select {
+		case l.sem <- struct{}{}:
+		case <-l.done:
+			return nil, errListenerClosed
+		}
+		c, err := l.Listener.Accept()
+		if err != nil {
+			l.release()
+			return nil, err
+		}
+		return &releaseConn{Conn: c, release: l.release}, nil
+	}
+
+	l.start.Do(func() {
+		go l.admitLoop()
+	})
+	select {
+	case c := <-l.ready:
+		return c, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+func (l *limitListener) admitLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			l.errs <- err
+			return
+		}
+		go l.admit(c)
+	}
+}
+
+func (l *limitListener) admit(c net.Conn) {
+	if !l.acquire() {
+		l.reject(c)
+		return
+	}
+	select {
+	case l.ready <- &releaseConn{Conn: c, release: l.release}:
+	case <-l.done:
+		l.release()
+		_ = c.Close()
+	}
+}
+
+func (l *limitListener) acquire() bool {
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	default:
+	}
+	if l.policy == OverflowReject {
+		return false
+	}
+	select {
+	case l.waiting <- struct{}{}:
+		defer func() { <-l.waiting }()
+	default:
+		return false
+	}
+	t := time.NewTimer(l.maxWait)
+	defer t.Stop()
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	case <-l.done:
+		return false
+	}
+}
+
+func (l *limitListener) reject(c net.Conn) {
+	l.r.markRejected()
+	_ = c.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := c.Write([]byte(busyMessage)); err != nil {
+		fmt.Println(err)
+	}
+	if err := c.Close(); err != nil {
+		fmt.Println(err)
+	}
+}
+
+func (l *limitListener) release() {
+	<-l.sem
+}
+
+type releaseConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (c *releaseConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return err
+}
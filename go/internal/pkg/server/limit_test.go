@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bufio"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseOverflowPolicy(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    OverflowPolicy
+		wantErr bool
+	}{
+		{in: "queue", want: OverflowQueue},
+		{in: "reject", want: OverflowReject},
+		{in: "wait", want: OverflowWait},
+		{in: "drop", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseOverflowPolicy(tt.in)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestLimitListener_queue(t *testing.T) {
+	l := startLimitListener(t, OverflowQueue, 0, &noopRecorder{})
+	defer l.Close()
+
+	first := dial(t, l)
+	defer first.Close()
+	c1, err := l.Accept()
+	require.NoError(t, err)
+
+	second := dial(t, l)
+	defer second.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+	select {
+	case <-accepted:
+		t.Fatal("accepted a connection above the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.NoError(t, c1.Close())
+	select {
+	case c := <-accepted:
+		assert.NoError(t, c.Close())
+	case <-time.After(time.Second):
+		t.Fatal("queued connection was never accepted")
+	}
+}
+
+func TestLimitListener_reject(t *testing.T) {
+	mr := &mockRecorder{}
+	mr.On("markRejected").Return()
+	l := startLimitListener(t, OverflowReject, 0, mr)
+	defer l.Close()
+
+	first := dial(t, l)
+	defer first.Close()
+	c1, err := l.Accept()
+	require.NoError(t, err)
+	defer c1.Close()
+
+	second := dial(t, l)
+	defer second.Close()
+	msg, err := bufio.NewReader(second).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, busyMessage, msg)
+	mr.AssertNumberOfCalls(t, "markRejected", 1)
+}
+
+func TestLimitListener_wait(t *testing.T) {
+	mr := &mockRecorder{}
+	mr.On("markRejected").Return()
+	l := startLimitListener(t, OverflowWait, 200*time.Millisecond, mr)
+	defer l.Close()
+
+	first := dial(t, l)
+	defer first.Close()
+	c1, err := l.Accept()
+	require.NoError(t, err)
+
+	// Times out while the first connection holds the only slot.
+	second := dial(t, l)
+	defer second.Close()
+	msg, err := bufio.NewReader(second).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, busyMessage, msg)
+
+	// Gets the slot once the first connection is closed within the wait.
+	third := dial(t, l)
+	defer third.Close()
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, c1.Close())
+	c3, err := l.Accept()
+	require.NoError(t, err)
+	assert.NoError(t, c3.Close())
+	mr.AssertNumberOfCalls(t, "markRejected", 1)
+}
+
+func TestLimitListener_waitingFull(t *testing.T) {
+	mr := &mockRecorder{}
+	mr.On("markRejected").Return()
+	l := startLimitListener(t, OverflowWait, time.Minute, mr)
+	defer l.Close()
+
+	first := dial(t, l)
+	defer first.Close()
+	c1, err := l.Accept()
+	require.NoError(t, err)
+	defer c1.Close()
+
+	// Waits for the slot, taking the only waiting place.
+	second := dial(t, l)
+	defer second.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	// Rejected without waiting for the minute.
+	third := dial(t, l)
+	defer third.Close()
+	require.NoError(t, third.SetReadDeadline(time.Now().Add(5*time.Second)))
+	msg, err := bufio.NewReader(third).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, busyMessage, msg)
+	mr.AssertNumberOfCalls(t, "markRejected", 1)
+}
+
+func TestLimitListener_closed(t *testing.T) {
+	l := startLimitListener(t, OverflowReject, 0, &noopRecorder{})
+	require.NoError(t, l.Close())
+	_, err := l.Accept()
+	assert.Error(t, err)
+}
+
+func startLimitListener(t *testing.T, policy OverflowPolicy, maxWait time.Duration, r Recorder) *limitListener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	return newLimitListener(ln, make(chan struct{}, 1), make(chan struct{}, 1), policy, maxWait, r)
+}
+
+func dial(t *testing.T, l net.Listener) net.Conn {
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	return c
+}
@@ -0,0 +1,24 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package server
+
+import (
+	"errors"
+	"time"
+)
+
+// mmapChecker is only available on Unix.
+type mmapChecker struct {
+	NumberChecker
+}
+
+func NewMmapChecker(path string, r Recorder) (*mmapChecker, error) {
+	return nil, errors.New("the mmap checker is only supported on Unix")
+}
+
+func (c *mmapChecker) SetSyncInterval(interval time.Duration) {}
+
+func (c *mmapChecker) Close() error {
+	return nil
+}
@@ -0,0 +1,272 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"math/bits"
+	"os"
+	"sync"
+	syncatomic "sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// A bitset file starts with a header of mmapHeaderSize bytes: mmapMagic, the
+// little endian uint32 format version, 4 reserved bytes and the little endian
+// uint64 count of numbers it covers. A bit per number follows, number n
+// being bit n%8 of byte n/8 of the bitset. The bitset is updated a 64 bit
+// word at a time, so the layout only holds on little endian hosts and the
+// checker refuses to run on others.
+var mmapMagic = []byte("NLBITSET")
+
+// littleEndian reports whether the host stores the low byte of a word
+// first.
+var littleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+const (
+	mmapVersion    = 1
+	mmapHeaderSize = 4096
+	mmapWords      = (numberSpace + 63) / 64
+	mmapFileSize   = mmapHeaderSize + mmapWords*8
+)
+
+// mmapChecker keeps the bitset of seen numbers in a memory mapped file, so
+// the numbers seen survive a restart without a snapshot and the kernel only
+// keeps the pages in use in memory. The file is created sparse, so it only
+// takes disk space for the ranges used.
+type mmapChecker struct {
+	f     *os.File
+	data  []byte
+	words []uint64
+	r     Recorder
+
+	mu     sync.Mutex
+	closed bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewMmapChecker maps the bitset file at path, creating it when missing.
+// It refuses files of another format, version or number count. The numbers
+// already in the file are counted as restored.
+func NewMmapChecker(path string, r Recorder) (*mmapChecker, error) {
+	if !littleEndian {
+		return nil, errors.New("the mmap checker needs a little endian host")
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := prepareBitsetFile(f); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	data, err := unix.Mmap(int(f.Fd()), 0, mmapFileSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	c := &mmapChecker{
+		f:     f,
+		data:  data,
+		words: (*[mmapWords]uint64)(unsafe.Pointer(&data[mmapHeaderSize]))[:],
+		r:     r,
+	}
+	var restored uint64
+	for _, word := range c.words {
+		restored += uint64(bits.OnesCount64(word))
+	}
+	if restored > 0 {
+		r.addRestored(restored)
+	}
+	return c, nil
+}
+
+// prepareBitsetFile writes the header of an empty file and checks the one
+// of an existing file.
+func prepareBitsetFile(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		header := make([]byte, mmapHeaderSize)
+		copy(header, mmapMagic)
+		binary.LittleEndian.PutUint32(header[8:], mmapVersion)
+		binary.LittleEndian.PutUint64(header[16:], numberSpace)
+		if _, err := f.WriteAt(header, 0); err != nil {
+			return err
+		}
+		if err := f.Truncate(mmapFileSize); err != nil {
+			return err
+		}
+		return f.Sync()
+	}
+	header := make([]byte, 24)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("not a numbers bitset file: %v", err)
+	}
+	if !bytes.Equal(header[:8], mmapMagic) {
+		return fmt.Errorf("not a numbers bitset file")
+	}
+	if v := binary.LittleEndian.Uint32(header[8:]); v != mmapVersion {
+		return fmt.Errorf("unsupported bitset version %v, expected %v", v, mmapVersion)
+	}
+	if n := binary.LittleEndian.Uint64(header[16:]); n != numberSpace {
+		return fmt.Errorf("bitset of %v numbers, expected %v", n, numberSpace)
+	}
+	if info.Size() != mmapFileSize {
+		return fmt.Errorf("bitset file of %v bytes, expected %v", info.Size(), mmapFileSize)
+	}
+	return nil
+}
+
+// SetSyncInterval flushes the bitset to disk every interval until Close.
+func (c *mmapChecker) SetSyncInterval(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.stop != nil {
+		return
+	}
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	go func() {
+		defer close(c.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.Sync(); err != nil {
+					fmt.Println(err)
+				}
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Sync flushes the bitset to disk.
+func (c *mmapChecker) Sync() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	return unix.Msync(c.data, unix.MS_SYNC)
+}
+
+// Close flushes the bitset to disk and unmaps it. The checker must not be
+// used afterwards.
+func (c *mmapChecker) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	stop, done := c.stop, c.done
+	c.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	err := unix.Msync(c.data, unix.MS_SYNC)
+	if uerr := unix.Munmap(c.data); err == nil {
+		err = uerr
+	}
+	if cerr := c.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// mark sets the bit of n and reports whether it was unset.
+func (c *mmapChecker) mark(n uint32) bool {
+	word, bit := &c.words[n/64], uint64(1)<<(n%64)
+	for {
+		old := syncatomic.LoadUint64(word)
+		if old&bit != 0 {
+			return false
+		}
+		if syncatomic.CompareAndSwapUint64(word, old, old|bit) {
+			return true
+		}
+	}
+}
+
+func (c *mmapChecker) IsUnique(n uint32) (unique bool) {
+	if unique = c.mark(n); unique {
+		c.r.markUnique()
+	} else {
+		c.r.markDuplicate()
+	}
+	return unique
+}
+
+func (c *mmapChecker) IsUniqueBatch(ns []uint32, out []bool) {
+	for _, o := range batchOrder(ns) {
+		n, i := uint32(o>>32), uint32(o)
+		out[i] = c.IsUnique(n)
+	}
+}
+
+// Reset clears the bitset. Only the words holding numbers are written, so
+// the file stays sparse.
+func (c *mmapChecker) Reset() {
+	for w := range c.words {
+		if syncatomic.LoadUint64(&c.words[w]) != 0 {
+			syncatomic.StoreUint64(&c.words[w], 0)
+		}
+	}
+	c.r.markReset()
+}
+
+func (c *mmapChecker) Forget(n uint32) (forgotten bool) {
+	if clearBit(&c.words[n/64], uint64(1)<<(n%64)) {
+		c.r.markForgotten()
+		return true
+	}
+	return false
+}
+
+func (c *mmapChecker) GetReport() string {
+	return c.r.getReport()
+}
+
+func (c *mmapChecker) walk(fn func(n uint32) bool) {
+	for w := range c.words {
+		for word := syncatomic.LoadUint64(&c.words[w]); word != 0; word &= word - 1 {
+			if !fn(uint32(w*64 + bits.TrailingZeros64(word))) {
+				return
+			}
+		}
+	}
+}
+
+func (c *mmapChecker) countRange(from, to uint32) uint64 {
+	return countBits(c.words, from, to)
+}
+
+func (c *mmapChecker) restore(n uint32) (restored bool) {
+	if restored = c.mark(n); restored {
+		c.r.markRestored()
+	}
+	return restored
+}
@@ -0,0 +1,162 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package server
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func init() {
+	checkerCases = append(checkerCases, checkerCase{"Mmap", func(t *testing.T, r Recorder) NumberChecker {
+		return newTempMmapChecker(t, r)
+	}, maxNumber})
+}
+
+func tempBitset(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "Mmap")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	return filepath.Join(dir, "numbers.bitset")
+}
+
+func newTempMmapChecker(t *testing.T, r Recorder) *mmapChecker {
+	c, err := NewMmapChecker(tempBitset(t), r)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = c.Close()
+	})
+	return c
+}
+
+func TestAddOkayMmap(t *testing.T) {
+	mr := &mockRecorder{}
+	mr.On("markUnique").Return()
+	testAddOkay(t, newTempMmapChecker(t, mr))
+}
+
+func TestAddDuplicateMmap(t *testing.T) {
+	mr := &mockRecorder{}
+	mr.On("markUnique").Return()
+	mr.On("markDuplicate").Return()
+	testAddDuplicate(t, newTempMmapChecker(t, mr))
+}
+
+func TestMmapChecker_reopen(t *testing.T) {
+	file := tempBitset(t)
+	numbers := []uint32{0, 63, 64, 123456789, maxNumber}
+	c, err := NewMmapChecker(file, &noopRecorder{})
+	require.NoError(t, err)
+	for _, n := range numbers {
+		assert.True(t, c.IsUnique(n))
+	}
+	require.NoError(t, c.Close())
+	require.NoError(t, c.Close(), "closing twice is a no-op")
+
+	// Only the header and the pages written take disk space.
+	info, err := os.Stat(file)
+	require.NoError(t, err)
+	assert.Equal(t, int64(mmapFileSize), info.Size())
+	assert.Less(t, info.Sys().(*syscall.Stat_t).Blocks*512, int64(1<<20))
+
+	mr := &mockRecorder{}
+	mr.On("addRestored", uint64(len(numbers))).Return().Once()
+	mr.On("markDuplicate").Return()
+	c, err = NewMmapChecker(file, mr)
+	require.NoError(t, err)
+	defer c.Close()
+	for _, n := range numbers {
+		assert.False(t, c.IsUnique(n))
+	}
+	mr.AssertExpectations(t)
+	var walked []uint32
+	c.walk(func(n uint32) bool {
+		walked = append(walked, n)
+		return true
+	})
+	assert.Equal(t, numbers, walked)
+}
+
+func TestMmapChecker_mismatch(t *testing.T) {
+	header := func(magic string, version uint32, domain uint64) []byte {
+		b := make([]byte, mmapHeaderSize)
+		copy(b, magic)
+		binary.LittleEndian.PutUint32(b[8:], version)
+		binary.LittleEndian.PutUint64(b[16:], domain)
+		return b
+	}
+	tests := []struct {
+		name     string
+		contents []byte
+		size     int64
+		expected string
+	}{
+		{name: "Magic", contents: header("NLSNAP01", 1, numberSpace), size: mmapFileSize, expected: "not a numbers bitset file"},
+		{name: "Short", contents: []byte("NLBIT"), size: 5, expected: "not a numbers bitset file: EOF"},
+		{name: "Version", contents: header("NLBITSET", 2, numberSpace), size: mmapFileSize, expected: "unsupported bitset version 2, expected 1"},
+		{name: "Domain", contents: header("NLBITSET", 1, 1000), size: mmapFileSize, expected: "bitset of 1000 numbers, expected 1000000000"},
+		{name: "Size", contents: header("NLBITSET", 1, numberSpace), size: mmapFileSize - 8, expected: "bitset file of 125004088 bytes, expected 125004096"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := tempBitset(t)
+			require.NoError(t, ioutil.WriteFile(file, tt.contents, 0644))
+			require.NoError(t, os.Truncate(file, tt.size))
+
+			_, err := NewMmapChecker(file, &noopRecorder{})
+			assert.EqualError(t, err, file+": "+tt.expected)
+			info, err := os.Stat(file)
+			require.NoError(t, err)
+			assert.Equal(t, tt.size, info.Size(), "the file must be left alone")
+		})
+	}
+}
+
+func TestMmapChecker_syncInterval(t *testing.T) {
+	mr := &mockRecorder{}
+	mr.On("markUnique").Return()
+	c := newTempMmapChecker(t, mr)
+	c.SetSyncInterval(time.Millisecond)
+	c.IsUnique(42)
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, c.Sync())
+	require.NoError(t, c.Close())
+	require.NoError(t, c.Sync(), "syncing a closed checker is a no-op")
+}
+
+func TestNewNumberCheckerWith_mmap(t *testing.T) {
+	file := tempBitset(t)
+	nc, err := NewNumberCheckerWith(CheckerConfig{Kind: "mmap", Path: file, SyncInterval: time.Second}, &noopRecorder{})
+	require.NoError(t, err)
+	require.IsType(t, &mmapChecker{}, nc)
+	require.NoError(t, nc.(*mmapChecker).Close())
+
+	require.NoError(t, ioutil.WriteFile(file, []byte("garbage"), 0644))
+	_, err = NewNumberCheckerWith(CheckerConfig{Kind: "mmap", Path: file}, &noopRecorder{})
+	assert.Error(t, err)
+}
+
+func TestMmapChecker_countRange(t *testing.T) {
+	c, err := NewMmapChecker(tempBitset(t), &noopRecorder{})
+	require.NoError(t, err)
+	defer c.Close()
+	for _, n := range []uint32{0, 63, 64, 500000000, maxNumber} {
+		c.IsUnique(n)
+	}
+	seen, err := CountRange(c, 63, 500000000)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), seen)
+	seen, err = CountRange(c, 0, maxNumber)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), seen)
+}
@@ -0,0 +1,356 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"go.uber.org/atomic"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultNamespaceDir is where namespaces keep their files.
+	DefaultNamespaceDir = "namespaces"
+	// maxNamespaceName is the longest namespace name.
+	maxNamespaceName = 64
+)
+
+// NamespaceConfig configures the namespaces connections can use besides the
+// default one, which keeps numbers.log.
+type NamespaceConfig struct {
+	// Max is how many namespaces can be created.
+	Max int
+	// Dir holds the NAME.log file of each namespace, along with its
+	// NAME.state snapshot during a handover and its NAME.bitset file with
+	// the mmap checker.
+	Dir string
+	// Checker configures the checker of each namespace.
+	Checker CheckerConfig
+	// Handover restores the namespaces saved by the predecessor and keeps
+	// their logs.
+	Handover bool
+}
+
+// NamespaceStats are the numbers a namespace received since it was
+// created.
+type NamespaceStats struct {
+	Name       string `json:"name"`
+	File       string `json:"file"`
+	Unique     uint64 `json:"unique"`
+	Duplicates uint64 `json:"duplicates"`
+	// Total is the numbers the namespace's checker holds, received or
+	// restored and not forgotten, reset or expired since.
+	Total uint64 `json:"total"`
+}
+
+// NamespaceListener is a listener whose connections are all in a namespace.
+type NamespaceListener struct {
+	Name string
+	// Addr is the resolved host:port to listen on.
+	Addr string
+}
+
+// ParseNamespaceListeners parses comma separated NAME=HOST:PORT pairs.
+func ParseNamespaceListeners(s string) ([]NamespaceListener, error) {
+	var listeners []NamespaceListener
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		i := strings.IndexByte(p, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid namespace listener %q", p)
+		}
+		name := p[:i]
+		if !validNamespace(name) {
+			return nil, fmt.Errorf("invalid namespace %q", name)
+		}
+		addr, err := net.ResolveTCPAddr("tcp", p[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid namespace listener %q: %v", p, err)
+		}
+		listeners = append(listeners, NamespaceListener{Name: name, Addr: addr.String()})
+	}
+	return listeners, nil
+}
+
+// Namespaces are independent dedup domains, each with its own
+// NumberChecker, Recorder and log, created when a connection first
+// declares them.
+type Namespaces interface {
+	// Bind returns ln with the connections it accepts in the named
+	// namespace, creating it.
+	Bind(ln net.Listener, name string) (net.Listener, error)
+	// Save snapshots every namespace for a successor.
+	Save() error
+	// Close syncs the logs and closes the checkers of every namespace.
+	Close() error
+	Stats() []NamespaceStats
+	// Seed loads file into the checker of the named namespace, creating it,
+	// like LoadSeed.
+	Seed(name, file string, progress func(SeedProgress)) (SeedSummary, error)
+	// join returns the named namespace, creating it unless the limit is
+	// reached.
+	join(name string) (*namespace, error)
+	// lookup returns the named namespace, nil if it was not created.
+	lookup(name string) *namespace
+	getReport() string
+}
+
+type namespace struct {
+	name string
+	file string
+	nc   NumberChecker
+	r    Recorder
+	wr   Writer
+
+	unique    atomic.Uint64
+	duplicate atomic.Uint64
+}
+
+func (n *namespace) record(unique bool) {
+	if unique {
+		n.unique.Inc()
+	} else {
+		n.duplicate.Inc()
+	}
+}
+
+type namespaces struct {
+	cfg NamespaceConfig
+
+	mu     sync.Mutex
+	spaces map[string]*namespace
+}
+
+// NewNamespaces creates cfg.Dir and, on a handover, restores the namespaces
+// saved there.
+func NewNamespaces(cfg NamespaceConfig) (Namespaces, error) {
+	if cfg.Dir == "" {
+		cfg.Dir = DefaultNamespaceDir
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, err
+	}
+	ns := &namespaces{
+		cfg:    cfg,
+		spaces: make(map[string]*namespace),
+	}
+	if cfg.Handover {
+		if err := ns.restore(); err != nil {
+			_ = ns.Close()
+			return nil, err
+		}
+	}
+	return ns, nil
+}
+
+// restore creates the namespaces with a snapshot in the directory and loads
+// it.
+func (ns *namespaces) restore() error {
+	files, err := filepath.Glob(filepath.Join(ns.cfg.Dir, "*.state"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		n, err := ns.join(strings.TrimSuffix(filepath.Base(file), ".state"))
+		if err != nil {
+			return err
+		}
+		if _, err = LoadSnapshot(n.nc, file); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validNamespace reports whether name can be used as a file name: up to
+// maxNamespaceName lower case letters, digits, hyphens and underscores,
+// starting with a letter or digit.
+func validNamespace(name string) bool {
+	if name == "" || len(name) > maxNamespaceName || name[0] == '-' || name[0] == '_' {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+func (ns *namespaces) join(name string) (*namespace, error) {
+	if !validNamespace(name) {
+		return nil, fmt.Errorf("invalid namespace %q", name)
+	}
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if n, ok := ns.spaces[name]; ok {
+		return n, nil
+	}
+	if len(ns.spaces) >= ns.cfg.Max {
+		return nil, fmt.Errorf("namespace %q over the limit of %v namespaces", name, ns.cfg.Max)
+	}
+	cfg := ns.cfg.Checker
+	cfg.Path = filepath.Join(ns.cfg.Dir, name+".bitset")
+	r := NewRecorder()
+	nc, err := NewNumberCheckerWith(cfg, r)
+	if err != nil {
+		return nil, err
+	}
+	n := &namespace{
+		name: name,
+		file: filepath.Join(ns.cfg.Dir, name+".log"),
+		nc:   nc,
+		r:    r,
+	}
+	if ns.cfg.Handover {
+		n.wr = GetAppendWriter(n.file)
+	} else {
+		n.wr = GetWriter(n.file)
+	}
+	ns.spaces[name] = n
+	return n, nil
+}
+
+func (ns *namespaces) lookup(name string) *namespace {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return ns.spaces[name]
+}
+
+func (ns *namespaces) Seed(name, file string, progress func(SeedProgress)) (SeedSummary, error) {
+	n, err := ns.join(name)
+	if err != nil {
+		return SeedSummary{File: file}, err
+	}
+	return LoadSeed(n.nc, file, progress)
+}
+
+func (ns *namespaces) Bind(ln net.Listener, name string) (net.Listener, error) {
+	n, err := ns.join(name)
+	if err != nil {
+		return nil, err
+	}
+	return &namespaceListener{Listener: ln, ns: n}, nil
+}
+
+// namespaceListener puts the connections it accepts in a namespace. Keying
+// them on the listener rather than its address keeps wildcard listeners
+// working, as their connections report the address they arrived on.
+type namespaceListener struct {
+	net.Listener
+	ns *namespace
+}
+
+func (l *namespaceListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &namespaceConn{Conn: c, ns: l.ns}, nil
+}
+
+// File duplicates the listening socket for a successor.
+func (l *namespaceListener) File() (*os.File, error) {
+	ln, ok := l.Listener.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, errors.New("listener cannot be handed over")
+	}
+	return ln.File()
+}
+
+type namespaceConn struct {
+	net.Conn
+	ns *namespace
+}
+
+// connNamespace returns the namespace of the listener that accepted conn, if
+// it was bound to one.
+func connNamespace(conn net.Conn) *namespace {
+	for {
+		switch c := conn.(type) {
+		case *namespaceConn:
+			return c.ns
+		case *releaseConn:
+			conn = c.Conn
+		case *proxyConn:
+			conn = c.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+// sorted returns the namespaces by name.
+func (ns *namespaces) sorted() []*namespace {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	spaces := make([]*namespace, 0, len(ns.spaces))
+	for _, n := range ns.spaces {
+		spaces = append(spaces, n)
+	}
+	sort.Slice(spaces, func(i, j int) bool {
+		return spaces[i].name < spaces[j].name
+	})
+	return spaces
+}
+
+func (ns *namespaces) Save() error {
+	for _, n := range ns.sorted() {
+		if err := n.wr.Sync(); err != nil {
+			return err
+		}
+		if err := SaveSnapshot(n.nc, filepath.Join(ns.cfg.Dir, n.name+".state")); err != nil {
+			return fmt.Errorf("namespace %s: %v", n.name, err)
+		}
+	}
+	return nil
+}
+
+func (ns *namespaces) Close() (err error) {
+	for _, n := range ns.sorted() {
+		if errSync := n.wr.Sync(); errSync != nil && err == nil {
+			err = errSync
+		}
+		if c, ok := n.nc.(io.Closer); ok {
+			if errClose := c.Close(); errClose != nil && err == nil {
+				err = errClose
+			}
+		}
+	}
+	return err
+}
+
+func (ns *namespaces) Stats() []NamespaceStats {
+	spaces := ns.sorted()
+	stats := make([]NamespaceStats, 0, len(spaces))
+	for _, n := range spaces {
+		stats = append(stats, NamespaceStats{
+			Name:       n.name,
+			File:       n.file,
+			Unique:     n.unique.Load(),
+			Duplicates: n.duplicate.Load(),
+			Total:      n.r.getTotal(),
+		})
+	}
+	return stats
+}
+
+// getReport returns a line with the report of each namespace's checker.
+func (ns *namespaces) getReport() string {
+	var b strings.Builder
+	for _, n := range ns.sorted() {
+		fmt.Fprintf(&b, "Namespace %s: %s\n", n.name, n.nc.GetReport())
+	}
+	return b.String()
+}
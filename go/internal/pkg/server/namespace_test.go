@@ -0,0 +1,338 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestNamespaces(t *testing.T, cfg NamespaceConfig) Namespaces {
+	if cfg.Dir == "" {
+		dir, err := ioutil.TempDir("", "namespaces")
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = os.RemoveAll(dir) })
+		cfg.Dir = dir
+	}
+	if cfg.Checker.Kind == "" {
+		cfg.Checker.Kind = "map"
+	}
+	ns, err := NewNamespaces(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ns.Close() })
+	return ns
+}
+
+func TestValidNamespace(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{name: "red", valid: true},
+		{name: "team-1_a", valid: true},
+		{name: "0", valid: true},
+		{name: "", valid: false},
+		{name: "-red", valid: false},
+		{name: "_red", valid: false},
+		{name: "Red", valid: false},
+		{name: "../red", valid: false},
+		{name: "red blue", valid: false},
+		{name: string(make([]byte, maxNamespaceName+1)), valid: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.valid, validNamespace(tt.name))
+		})
+	}
+}
+
+func TestParseNamespaceListeners(t *testing.T) {
+	listeners, err := ParseNamespaceListeners(" red=127.0.0.1:4010, ,blue=127.0.0.1:4011")
+	require.NoError(t, err)
+	assert.Equal(t, []NamespaceListener{
+		{Name: "red", Addr: "127.0.0.1:4010"},
+		{Name: "blue", Addr: "127.0.0.1:4011"},
+	}, listeners)
+
+	listeners, err = ParseNamespaceListeners("")
+	assert.NoError(t, err)
+	assert.Empty(t, listeners)
+
+	for _, s := range []string{"red", "Red=127.0.0.1:4010", "red=127.0.0.1"} {
+		_, err := ParseNamespaceListeners(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestNamespacesJoin(t *testing.T) {
+	ns := newTestNamespaces(t, NamespaceConfig{Max: 2})
+	red, err := ns.join("red")
+	require.NoError(t, err)
+	again, err := ns.join("red")
+	require.NoError(t, err)
+	assert.Same(t, red, again)
+	_, err = ns.join("blue")
+	require.NoError(t, err)
+
+	_, err = ns.join("green")
+	assert.EqualError(t, err, `namespace "green" over the limit of 2 namespaces`)
+	_, err = ns.join("../green")
+	assert.EqualError(t, err, `invalid namespace "../green"`)
+
+	assert.True(t, red.nc.IsUnique(1))
+	red.record(true)
+	red.record(false)
+	stats := ns.Stats()
+	require.Len(t, stats, 2)
+	assert.Equal(t, "blue", stats[0].Name)
+	assert.Equal(t, NamespaceStats{
+		Name:       "red",
+		File:       red.file,
+		Unique:     1,
+		Duplicates: 1,
+		Total:      1,
+	}, stats[1])
+	assert.Equal(t,
+		"Namespace blue: Received 0 unique numbers, 0 duplicates. Unique total: 0\n"+
+			"Namespace red: Received 1 unique numbers, 0 duplicates. Unique total: 1\n",
+		ns.getReport())
+}
+
+func TestNamespacesBind(t *testing.T) {
+	ns := newTestNamespaces(t, NamespaceConfig{Max: 1})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	bound, err := ns.Bind(ln, "red")
+	require.NoError(t, err)
+	_, err = ns.Bind(ln, "blue")
+	assert.Error(t, err, "over the limit")
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	conn, err := bound.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	n := connNamespace(&releaseConn{Conn: conn})
+	require.NotNil(t, n)
+	assert.Equal(t, "red", n.name)
+	assert.Nil(t, connNamespace(c))
+
+	f, err := bound.(*namespaceListener).File()
+	require.NoError(t, err, "a bound listener can be handed over")
+	assert.NoError(t, f.Close())
+}
+
+func TestNamespacesHandover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "namespaces")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	ns := newTestNamespaces(t, NamespaceConfig{Max: 2, Dir: dir})
+	red, err := ns.join("red")
+	require.NoError(t, err)
+	for _, n := range []uint32{1, 2, 3} {
+		red.nc.IsUnique(n)
+		red.wr.Info(fmt.Sprintf("%09d", n))
+	}
+	require.NoError(t, ns.Save())
+	require.NoError(t, ns.Close())
+	assert.FileExists(t, filepath.Join(dir, "red.state"))
+
+	successor := newTestNamespaces(t, NamespaceConfig{Max: 2, Dir: dir, Handover: true})
+	stats := successor.Stats()
+	require.Len(t, stats, 1)
+	assert.Equal(t, uint64(3), stats[0].Total)
+	assert.NoFileExists(t, filepath.Join(dir, "red.state"))
+
+	red, err = successor.join("red")
+	require.NoError(t, err)
+	assert.False(t, red.nc.IsUnique(2))
+	red.wr.Info("000000004")
+	require.NoError(t, successor.Close())
+	b, err := ioutil.ReadFile(filepath.Join(dir, "red.log"))
+	require.NoError(t, err)
+	assert.Equal(t, "000000001\n000000002\n000000003\n000000004\n", string(b), "the log is kept")
+}
+
+func TestHandlerNamespaces(t *testing.T) {
+	m := new(mockRepo)
+	m.On("IsUnique", uint32(1)).Return(true)
+	l := new(mockLog)
+	l.On("Info", "000000001", []zapcore.Field(nil))
+	reg := NewRegistry()
+	h := NewHandler(m, l, reg)
+	ns := newTestNamespaces(t, NamespaceConfig{Max: 1})
+	h.SetNamespaces(ns)
+
+	send := func(lines string) {
+		s, c := net.Pipe()
+		defer s.Close()
+		done := make(chan error, 1)
+		go func() {
+			done <- h.handle(context.Background(), func() {}, c)
+		}()
+		_, err := s.Write([]byte(lines))
+		assert.NoError(t, err)
+		assert.NoError(t, <-done)
+	}
+	send("namespace red\n000000001\n000000001\n000000002\nbad\n")
+	// Declared too late, the connection is closed.
+	send("000000001\nnamespace red\n000000003\n")
+	// Over the limit.
+	send("namespace blue\n000000004\n")
+
+	m.AssertNumberOfCalls(t, "IsUnique", 1)
+	l.AssertNumberOfCalls(t, "Info", 1)
+	stats := ns.Stats()
+	require.Len(t, stats, 1)
+	assert.Equal(t, NamespaceStats{
+		Name:       "red",
+		File:       stats[0].File,
+		Unique:     2,
+		Duplicates: 1,
+		Total:      2,
+	}, stats[0])
+	require.NoError(t, ns.Close())
+	b, err := ioutil.ReadFile(stats[0].File)
+	require.NoError(t, err)
+	assert.Equal(t, "000000001\n000000002\n", string(b))
+}
+
+func TestHandlerNamespaceListener(t *testing.T) {
+	h := NewHandler(new(mockRepo), new(mockLog), NewRegistry())
+	ns := newTestNamespaces(t, NamespaceConfig{Max: 1})
+	h.SetNamespaces(ns)
+
+	// Connections to a wildcard listener report the address they arrived on.
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	defer ln.Close()
+	bound, err := ns.Bind(ln, "red")
+	require.NoError(t, err)
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", ln.Addr().(*net.TCPAddr).Port))
+	require.NoError(t, err)
+	defer c.Close()
+	conn, err := bound.Accept()
+	require.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- h.handle(context.Background(), func() {}, conn)
+	}()
+	_, err = c.Write([]byte("000000001\n000000001\nbad\n"))
+	require.NoError(t, err)
+	assert.NoError(t, <-done)
+
+	stats := ns.Stats()
+	require.Len(t, stats, 1)
+	assert.Equal(t, uint64(1), stats[0].Unique)
+	assert.Equal(t, uint64(1), stats[0].Duplicates)
+}
+
+func TestAdminNamespaces(t *testing.T) {
+	ns := newTestNamespaces(t, NamespaceConfig{Max: 1})
+	red, err := ns.join("red")
+	require.NoError(t, err)
+	red.nc.IsUnique(1)
+	red.record(true)
+	a := NewAdmin("127.0.0.1", 0, NewRegistry())
+	a.SetNamespaces(ns)
+
+	rec := httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/namespaces", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var stats []NamespaceStats
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &stats))
+	assert.Equal(t, []NamespaceStats{{Name: "red", File: red.file, Unique: 1, Total: 1}}, stats)
+
+	rec = httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/namespaces", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestNamespacesTotal(t *testing.T) {
+	ns := newTestNamespaces(t, NamespaceConfig{Max: 1})
+	red, err := ns.join("red")
+	require.NoError(t, err)
+	for _, n := range []uint32{1, 2, 3} {
+		red.record(red.nc.IsUnique(n))
+	}
+	red.nc.Forget(2)
+	stats := ns.Stats()
+	assert.Equal(t, uint64(3), stats[0].Unique)
+	assert.Equal(t, uint64(2), stats[0].Total, "forgotten numbers are not in the total")
+	red.nc.Reset()
+	assert.Equal(t, uint64(0), ns.Stats()[0].Total)
+}
+
+func TestNamespacesSeed(t *testing.T) {
+	ns := newTestNamespaces(t, NamespaceConfig{Max: 1})
+	file := writeSeed(t, []byte("000000001\n000000002\n"))
+	summary, err := ns.Seed("red", file, nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), summary.Loaded)
+	red := ns.lookup("red")
+	require.NotNil(t, red)
+	assert.False(t, red.nc.IsUnique(2))
+	assert.Equal(t, uint64(2), ns.Stats()[0].Total)
+
+	_, err = ns.Seed("blue", file, nil)
+	assert.EqualError(t, err, `namespace "blue" over the limit of 1 namespaces`)
+}
+
+func TestAdminNamespaceChecker(t *testing.T) {
+	ns := newTestNamespaces(t, NamespaceConfig{Max: 1, Checker: CheckerConfig{Kind: "paged"}})
+	red, err := ns.join("red")
+	require.NoError(t, err)
+	red.nc.IsUnique(1)
+	red.nc.IsUnique(2)
+	nc := newPagedChecker(&noopRecorder{})
+	nc.IsUnique(3)
+	a := NewAdmin("127.0.0.1", 0, NewRegistry())
+	a.SetChecker(nc)
+	a.SetNamespaces(ns)
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		code   int
+		body   string
+	}{
+		{name: "Export", method: http.MethodGet, target: "/checker/export?namespace=red", code: http.StatusOK, body: "000000001\n000000002\n"},
+		{name: "ExportDefault", method: http.MethodGet, target: "/checker/export", code: http.StatusOK, body: "000000003\n"},
+		{name: "Count", method: http.MethodGet, target: "/checker/count?namespace=red", code: http.StatusOK, body: `{"from":0,"to":999999999,"seen":2}` + "\n"},
+		{name: "Forget", method: http.MethodPost, target: "/checker/forget?namespace=red&number=000000001", code: http.StatusOK, body: `{"forgotten":1,"unseen":0}` + "\n"},
+		{name: "Unknown", method: http.MethodPost, target: "/checker/reset?namespace=blue", code: http.StatusNotFound, body: "namespace \"blue\" not found\n"},
+		{name: "Reset", method: http.MethodPost, target: "/checker/reset?namespace=red", code: http.StatusNoContent},
+		{name: "Coverage", method: http.MethodGet, target: "/checker/coverage?namespace=red&to=9&block=10", code: http.StatusOK,
+			body: `{"from":0,"to":9,"blockSize":10,"seen":0,"full":0,"empty":1,"blocks":[{"start":0,"end":9,"seen":0,"fill":0}]}` + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			a.mux.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.target, nil))
+			assert.Equal(t, tt.code, rec.Code)
+			assert.Equal(t, tt.body, rec.Body.String())
+		})
+	}
+	assert.False(t, nc.IsUnique(3), "the default checker is left alone")
+
+	a = NewAdmin("127.0.0.1", 0, NewRegistry())
+	a.SetChecker(nc)
+	rec := httptest.NewRecorder()
+	a.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/checker/reset?namespace=red", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, "namespaces are disabled\n", rec.Body.String())
+}
@@ -1,18 +1,142 @@
 package server
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
 	"sync"
+	"time"
+)
+
+const (
+	// numberSpace is the number of distinct nine digit numbers.
+	numberSpace = 1000000000
+	maxNumber   = numberSpace - 1
+	// walkChunk is how many numbers a walk inspects per lock acquisition.
+	walkChunk = 1 << 16
 )
 
 func NewNumberChecker(r Recorder) NumberChecker {
 	return newBoolListChecker(r)
 }
 
-type NumberChecker interface {
-	IsUnique(n uint32) (unique bool)
-	GetReport() string
+// CheckerConfig selects the NumberChecker implementation.
+type CheckerConfig struct {
+	// Kind is one of:
+	//   bool     a lock per number, the default
+	//   paged    a bitset allocated a page at a time
+	//   list     a single lock over a list of every number
+	//   map      a single lock over a map of the numbers seen
+	//   sharded  Shards maps of the numbers seen, each with its own lock
+	//   roaring  a compressed bitmap, small when the numbers are clustered
+	//   adaptive chunks that move from a sorted list to a bitset once they
+	//            hold DenseThreshold numbers
+	//   mmap     a bitset in the file at Path, flushed every SyncInterval
+	//   bloom    a bloom filter sized for ExpectedNumbers unique numbers at
+	//            FalsePositiveRate, which reports some unique numbers as
+	//            duplicates
+	//   window   the numbers seen within Window, split into Generations
+	//            that expire in turn
+	Kind              string
+	Shards            int
+	DenseThreshold    int
+	Path              string
+	SyncInterval      time.Duration
+	ExpectedNumbers   int
+	FalsePositiveRate float64
+	Window            time.Duration
+	Generations       int
+	// Count, when "exact" or "sketch", counts how often each duplicate is
+	// received to report the TopN most repeated numbers.
+	Count string
+	TopN  int
+}
+
+// NewNumberCheckerWith creates the checker selected by cfg.
+func NewNumberCheckerWith(cfg CheckerConfig, r Recorder) (NumberChecker, error) {
+	nc, err := newBaseChecker(cfg, r)
+	if err != nil || cfg.Count == "" {
+		return nc, err
+	}
+	c, err := newCountingChecker(nc, cfg.Count, cfg.TopN)
+	if err != nil {
+		if closer, ok := nc.(io.Closer); ok {
+			_ = closer.Close()
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+func newBaseChecker(cfg CheckerConfig, r Recorder) (NumberChecker, error) {
+	switch cfg.Kind {
+	case "", "bool":
+		return newBoolListChecker(r), nil
+	case "paged":
+		return newPagedChecker(r), nil
+	case "list":
+		return newAltChecker(r), nil
+	case "map":
+		return newMapChecker(r), nil
+	case "sharded":
+		shards := cfg.Shards
+		if shards <= 0 {
+			shards = DefaultShards
+		}
+		return newShardedChecker(r, shards), nil
+	case "roaring":
+		return newRoaringChecker(r), nil
+	case "adaptive":
+		return newAdaptiveChecker(r, cfg.DenseThreshold), nil
+	case "mmap":
+		c, err := NewMmapChecker(cfg.Path, r)
+		if err != nil {
+			return nil, err
+		}
+		c.SetSyncInterval(cfg.SyncInterval)
+		return c, nil
+	case "bloom":
+		return newBloomChecker(r, cfg.ExpectedNumbers, cfg.FalsePositiveRate)
+	case "window":
+		if cfg.Window <= 0 {
+			return nil, fmt.Errorf("window %v must be positive", cfg.Window)
+		}
+		return newWindowChecker(r, cfg.Window, cfg.Generations), nil
+	}
+	return nil, fmt.Errorf("unknown checker %q", cfg.Kind)
+}
+
+// NumberChecker deduplicates the nine digit numbers of numbers.log.
+type NumberChecker = KeyChecker[uint32]
+
+var errForgetUnsupported = errors.New("number checker cannot forget numbers")
+
+// canForget reports whether nc can forget a single number, rather than
+// always returning false from Forget.
+func canForget(nc NumberChecker) bool {
+	_, ok := baseChecker(nc).(interface{ cannotForget() })
+	return !ok
+}
+
+// batchOrder returns the numbers of ns in ascending order, each packed with
+// its position in ns in the low 32 bits, so a batch walks the checker's
+// memory forwards and repeated numbers keep their order.
+func batchOrder(ns []uint32) []uint64 {
+	order := make([]uint64, len(ns))
+	for i, n := range ns {
+		order[i] = uint64(n)<<32 | uint64(i)
+	}
+	sort.Sort(packedNumbers(order))
+	return order
 }
 
+type packedNumbers []uint64
+
+func (p packedNumbers) Len() int           { return len(p) }
+func (p packedNumbers) Less(i, j int) bool { return p[i] < p[j] }
+func (p packedNumbers) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
 type checker struct {
 	mu sync.Mutex
 	tm map[uint32]bool
@@ -42,6 +166,67 @@ func (c *checker) IsUnique(n uint32) (unique bool) {
 	return false
 }
 
+func (c *checker) IsUniqueBatch(ns []uint32, out []bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, n := range ns {
+		if _, ok := c.tm[n]; !ok {
+			c.tm[n] = true
+			c.r.markUnique()
+			out[i] = true
+			continue
+		}
+		c.r.markDuplicate()
+		out[i] = false
+	}
+}
+
+func (c *checker) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tm = make(map[uint32]bool)
+	c.r.markReset()
+}
+
+func (c *checker) Forget(n uint32) (forgotten bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.tm[n]; ok {
+		delete(c.tm, n)
+		c.r.markForgotten()
+		return true
+	}
+	return false
+}
+
+func (c *checker) walk(fn func(n uint32) bool) {
+	c.mu.Lock()
+	seen := make([]uint32, 0, len(c.tm))
+	for n := range c.tm {
+		seen = append(seen, n)
+	}
+	c.mu.Unlock()
+	sort.Slice(seen, func(i, j int) bool {
+		return seen[i] < seen[j]
+	})
+	for _, n := range seen {
+		if !fn(n) {
+			return
+		}
+	}
+}
+
+func (c *checker) restore(n uint32) (restored bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.tm[n]; !ok {
+		c.tm[n] = true
+		c.r.markRestored()
+		return true
+	}
+	return false
+}
+
 type checkerImplList struct {
 	mu sync.Mutex
 	tm []bool
@@ -50,7 +235,7 @@ type checkerImplList struct {
 
 func newAltChecker(r Recorder) NumberChecker {
 	return &checkerImplList{
-		tm: make([]bool, 1000000000),
+		tm: make([]bool, numberSpace),
 		r:  r,
 	}
 }
@@ -67,10 +252,96 @@ func (c *checkerImplList) IsUnique(n uint32) (unique bool) {
 	return false
 }
 
+func (c *checkerImplList) IsUniqueBatch(ns []uint32, out []bool) {
+	order := batchOrder(ns)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, o := range order {
+		n, i := uint32(o>>32), uint32(o)
+		if !c.tm[n] {
+			c.tm[n] = true
+			c.r.markUnique()
+			out[i] = true
+			continue
+		}
+		c.r.markDuplicate()
+		out[i] = false
+	}
+}
+
 func (c *checkerImplList) GetReport() string {
 	return c.r.getReport()
 }
 
+func (c *checkerImplList) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range c.tm {
+		c.tm[i] = false
+	}
+	c.r.markReset()
+}
+
+func (c *checkerImplList) Forget(n uint32) (forgotten bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tm[n] {
+		c.tm[n] = false
+		c.r.markForgotten()
+		return true
+	}
+	return false
+}
+
+func (c *checkerImplList) walk(fn func(n uint32) bool) {
+	var seen []uint32
+	for start := 0; start < len(c.tm); start += walkChunk {
+		seen = seen[:0]
+		c.mu.Lock()
+		for i := start; i < start+walkChunk && i < len(c.tm); i++ {
+			if c.tm[i] {
+				seen = append(seen, uint32(i))
+			}
+		}
+		c.mu.Unlock()
+		for _, n := range seen {
+			if !fn(n) {
+				return
+			}
+		}
+	}
+}
+
+// countRange tests each number of the range, taking the lock a chunk at a
+// time like walk.
+func (c *checkerImplList) countRange(from, to uint32) (count uint64) {
+	for start := uint64(from); start <= uint64(to); start += walkChunk {
+		end := start + walkChunk - 1
+		if end > uint64(to) {
+			end = uint64(to)
+		}
+		c.mu.Lock()
+		for i := start; i <= end; i++ {
+			if c.tm[i] {
+				count++
+			}
+		}
+		c.mu.Unlock()
+	}
+	return count
+}
+
+func (c *checkerImplList) restore(n uint32) (restored bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.tm[n] {
+		c.tm[n] = true
+		c.r.markRestored()
+		return true
+	}
+	return false
+}
+
 type aBool struct {
 	marked bool
 	mu     sync.Mutex
@@ -87,9 +358,25 @@ func (a *aBool) mark() bool {
 
 }
 
+func (a *aBool) unmark() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.marked {
+		a.marked = false
+		return true
+	}
+	return false
+}
+
+func (a *aBool) isMarked() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.marked
+}
+
 func newBoolListChecker(r Recorder) NumberChecker {
 	return &checkerImplABoolList{
-		tm: make([]aBool, 1000000000),
+		tm: make([]aBool, numberSpace),
 		r:  r,
 	}
 }
@@ -108,6 +395,54 @@ func (c *checkerImplABoolList) IsUnique(n uint32) (unique bool) {
 	return false
 }
 
+func (c *checkerImplABoolList) IsUniqueBatch(ns []uint32, out []bool) {
+	for _, o := range batchOrder(ns) {
+		n, i := uint32(o>>32), uint32(o)
+		out[i] = c.IsUnique(n)
+	}
+}
+
 func (c *checkerImplABoolList) GetReport() string {
 	return c.r.getReport()
 }
+
+// Reset unmarks the numbers one at a time, so numbers received meanwhile
+// may or may not be kept.
+func (c *checkerImplABoolList) Reset() {
+	for i := range c.tm {
+		c.tm[i].unmark()
+	}
+	c.r.markReset()
+}
+
+func (c *checkerImplABoolList) Forget(n uint32) (forgotten bool) {
+	if c.tm[n].unmark() {
+		c.r.markForgotten()
+		return true
+	}
+	return false
+}
+
+func (c *checkerImplABoolList) walk(fn func(n uint32) bool) {
+	for i := range c.tm {
+		if c.tm[i].isMarked() && !fn(uint32(i)) {
+			return
+		}
+	}
+}
+
+func (c *checkerImplABoolList) countRange(from, to uint32) (count uint64) {
+	for i := uint64(from); i <= uint64(to); i++ {
+		if c.tm[i].isMarked() {
+			count++
+		}
+	}
+	return count
+}
+
+func (c *checkerImplABoolList) restore(n uint32) (restored bool) {
+	if restored = c.tm[n].mark(); restored {
+		c.r.markRestored()
+	}
+	return restored
+}
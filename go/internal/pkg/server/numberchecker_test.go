@@ -1,10 +1,14 @@
 package server
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"math/rand"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestAddOkay(t *testing.T) {
@@ -52,6 +56,126 @@ func TestAddDuplicateABool(t *testing.T) {
 	testAddDuplicate(t, c)
 }
 
+// smallSpace is the number of numbers held by the list checkers of the
+// tests, as the full sized ones take gigabytes.
+const smallSpace = 1 << 17
+
+func newSmallAltChecker(r Recorder) NumberChecker {
+	return &checkerImplList{
+		tm: make([]bool, smallSpace),
+		r:  r,
+	}
+}
+
+func newSmallBoolListChecker(r Recorder) NumberChecker {
+	return &checkerImplABoolList{
+		tm: make([]aBool, smallSpace),
+		r:  r,
+	}
+}
+
+// checkerCase is a NumberChecker every checker test runs against.
+type checkerCase struct {
+	name       string
+	newChecker func(t *testing.T, r Recorder) NumberChecker
+	// top is the highest number the checker holds.
+	top uint32
+}
+
+// checkerCases are the checkers built on every platform, the others add
+// themselves from their own test files.
+var checkerCases = []checkerCase{
+	{"Map", func(t *testing.T, r Recorder) NumberChecker { return newMapChecker(r) }, maxNumber},
+	{"Alt", func(t *testing.T, r Recorder) NumberChecker { return newSmallAltChecker(r) }, smallSpace - 1},
+	{"ABool", func(t *testing.T, r Recorder) NumberChecker { return newSmallBoolListChecker(r) }, smallSpace - 1},
+	{"Sharded", func(t *testing.T, r Recorder) NumberChecker { return newShardedChecker(r, 4) }, maxNumber},
+	{"Hash", func(t *testing.T, r Recorder) NumberChecker { return newHashChecker[uint32](r, 4) }, maxNumber},
+	{"Paged", func(t *testing.T, r Recorder) NumberChecker { return newPagedChecker(r) }, maxNumber},
+	{"Roaring", func(t *testing.T, r Recorder) NumberChecker { return newRoaringChecker(r) }, maxNumber},
+	{"Adaptive", func(t *testing.T, r Recorder) NumberChecker { return newAdaptiveChecker(r, 2) }, maxNumber},
+	{"Bloom", func(t *testing.T, r Recorder) NumberChecker { return newTestBloomChecker(t, r, 1000, 0.0001) }, maxNumber},
+	{"Window", func(t *testing.T, r Recorder) NumberChecker { return newWindowChecker(r, time.Hour, 0) }, maxNumber},
+	{"Counting", func(t *testing.T, r Recorder) NumberChecker {
+		c, err := newCountingChecker(newMapChecker(r), "exact", 0)
+		require.NoError(t, err)
+		return c
+	}, maxNumber},
+}
+
+func TestIsUniqueBatch(t *testing.T) {
+	for _, tc := range checkerCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testIsUniqueBatchUpTo(t, tc.checker(t), tc.top)
+		})
+	}
+}
+
+// checker returns the constructor of the checker for the tests taking one.
+func (tc checkerCase) checker(t *testing.T) func(r Recorder) NumberChecker {
+	return func(r Recorder) NumberChecker {
+		return tc.newChecker(t, r)
+	}
+}
+
+func TestBatchOrder(t *testing.T) {
+	assert.Equal(t, []uint64{3<<32 | 1, 3<<32 | 3, 5<<32 | 2, 9<<32 | 0}, batchOrder([]uint32{9, 3, 5, 3}))
+	assert.Empty(t, batchOrder(nil))
+}
+
+// testIsUniqueBatchUpTo checks a batch up to top, the highest number the
+// checker holds.
+func testIsUniqueBatchUpTo(t *testing.T, newChecker func(r Recorder) NumberChecker, top uint32) {
+	mr := &mockRecorder{}
+	mr.On("markUnique").Return()
+	mr.On("markDuplicate").Return()
+	mr.On("setMemory", mock.Anything).Maybe()
+	mr.On("setFalsePositiveRate", mock.Anything).Maybe()
+	a := newChecker(mr)
+	assert.True(t, a.IsUnique(7))
+	out := make([]bool, 6)
+	a.IsUniqueBatch([]uint32{top, 7, 3, top, 0, 3}, out)
+	assert.Equal(t, []bool{true, false, true, false, true, false}, out)
+	mr.AssertNumberOfCalls(t, "markUnique", 4)
+	mr.AssertNumberOfCalls(t, "markDuplicate", 3)
+}
+
+// testResetAndForgetUpTo checks the checker forgets numbers up to top and
+// keeps the Recorder total in line.
+func testResetAndForgetUpTo(t *testing.T, newChecker func(r Recorder) NumberChecker, top uint32) {
+	r := NewRecorder()
+	c := newChecker(r)
+	for _, n := range []uint32{1, 2, 70000, top} {
+		require.True(t, c.IsUnique(n))
+	}
+	assert.True(t, c.Forget(2))
+	assert.False(t, c.Forget(2))
+	assert.False(t, c.Forget(3))
+	assert.True(t, c.Forget(top))
+	assert.False(t, c.IsUnique(1))
+	assert.Contains(t, r.getReport(), "Unique total: 2. Forgotten numbers: 2")
+	assert.True(t, c.IsUnique(2))
+	assert.Contains(t, r.getReport(), "Unique total: 3")
+
+	c.Reset()
+	assert.Contains(t, r.getReport(), "Unique total: 0. Forgotten numbers: 2. Resets: 1")
+	for _, n := range []uint32{1, 2, 70000, top} {
+		assert.True(t, c.IsUnique(n), "number %v", n)
+	}
+	assert.False(t, c.IsUnique(70000))
+	assert.Contains(t, r.getReport(), "Unique total: 4")
+}
+
+func TestResetAndForget(t *testing.T) {
+	for _, tc := range checkerCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, ok := tc.newChecker(t, &noopRecorder{}).(interface{ cannotForget() }); ok {
+				t.Skip("the checker cannot forget numbers")
+			}
+			testResetAndForgetUpTo(t, tc.checker(t), tc.top)
+		})
+	}
+}
+
 func testAddOkay(t *testing.T, a NumberChecker) {
 	assert.Equal(t, true, a.IsUnique(1337))
 }
@@ -102,6 +226,39 @@ func BenchmarkChecker(b *testing.B) {
 	}
 }
 
+// BenchmarkCheckerBatch checks random numbers one at a time and in batches.
+func BenchmarkCheckerBatch(b *testing.B) {
+	benchmarks := []struct {
+		name    string
+		checker func() NumberChecker
+	}{
+		{"Map", func() NumberChecker { return newMapChecker(&noopRecorder{}) }},
+		{"Alt", func() NumberChecker { return newAltChecker(&noopRecorder{}) }},
+	}
+	ns := make([]uint32, 1<<20)
+	for i := range ns {
+		ns[i] = uint32(rand.Intn(numberSpace))
+	}
+	for _, bm := range benchmarks {
+		for _, size := range []int{1, 16, 256} {
+			b.Run(fmt.Sprintf("%s/Batch%v", bm.name, size), func(b *testing.B) {
+				c := bm.checker()
+				out := make([]bool, size)
+				b.ResetTimer()
+				// Each op is one number, however it is checked.
+				for i := 0; i < b.N; i += size {
+					start := i % len(ns)
+					if size == 1 {
+						c.IsUnique(ns[start])
+						continue
+					}
+					c.IsUniqueBatch(ns[start:start+size], out)
+				}
+			})
+		}
+	}
+}
+
 func BenchmarkRandomAdd(b *testing.B) {
 	benchmarks := []struct {
 		name    string
@@ -152,6 +309,42 @@ func (n *noopRecorder) markUnique() {
 }
 func (n *noopRecorder) markDuplicate() {
 
+}
+func (n *noopRecorder) markRestored() {
+
+}
+func (n *noopRecorder) addRestored(count uint64) {
+
+}
+func (n *noopRecorder) markRejected() {
+
+}
+func (n *noopRecorder) markDenied() {
+
+}
+func (n *noopRecorder) markThrottled() {
+
+}
+func (n *noopRecorder) markForgotten() {
+
+}
+func (n *noopRecorder) addExpired(count uint64) {
+
+}
+func (n *noopRecorder) markReset() {
+
+}
+func (n *noopRecorder) setMemory(bytes uint64) {
+
+}
+func (n *noopRecorder) setFalsePositiveRate(rate float64) {
+
+}
+func (n *noopRecorder) setDistinct(hour, window uint64, hours int) {
+
+}
+func (n *noopRecorder) getTotal() uint64 {
+	return 0
 }
 func (n *noopRecorder) getReport() string {
 	return "noop"
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"fmt"
+	"go.uber.org/atomic"
+	"math/bits"
+	syncatomic "sync/atomic"
+	"unsafe"
+)
+
+const (
+	// pagedPageBits is how many low bits of a number pick its bit within a
+	// page.
+	pagedPageBits  = 16
+	pagedPageSize  = 1 << pagedPageBits
+	pagedPageWords = pagedPageSize / 64
+	pagedPages     = (numberSpace + pagedPageSize - 1) / pagedPageSize
+	pagedPageBytes = pagedPageSize / 8
+)
+
+type pagedPage [pagedPageWords]uint64
+
+// pagedChecker is a bitset of every number split into pages of 65536 bits
+// that are only allocated once a number falls in them, so it starts with a
+// directory of page pointers and grows 8KB at a time with the ranges used.
+// Pages are installed and bits set with compare and swap, so it takes no
+// locks.
+type pagedChecker struct {
+	pages []unsafe.Pointer // *pagedPage
+	used  atomic.Int64
+	r     Recorder
+}
+
+func newPagedChecker(r Recorder) *pagedChecker {
+	return &pagedChecker{
+		pages: make([]unsafe.Pointer, pagedPages),
+		r:     r,
+	}
+}
+
+// page returns the page of n, installing a new one when absent.
+func (c *pagedChecker) page(n uint32) *pagedPage {
+	slot := &c.pages[n>>pagedPageBits]
+	if p := syncatomic.LoadPointer(slot); p != nil {
+		return (*pagedPage)(p)
+	}
+	p := new(pagedPage)
+	if !syncatomic.CompareAndSwapPointer(slot, nil, unsafe.Pointer(p)) {
+		// Another number of the page got there first.
+		return (*pagedPage)(syncatomic.LoadPointer(slot))
+	}
+	c.used.Inc()
+	return p
+}
+
+// mark sets the bit of n and reports whether it was unset.
+func (c *pagedChecker) mark(n uint32) bool {
+	x := n % pagedPageSize
+	word, bit := &c.page(n)[x/64], uint64(1)<<(x%64)
+	for {
+		old := syncatomic.LoadUint64(word)
+		if old&bit != 0 {
+			return false
+		}
+		if syncatomic.CompareAndSwapUint64(word, old, old|bit) {
+			return true
+		}
+	}
+}
+
+func (c *pagedChecker) IsUnique(n uint32) (unique bool) {
+	unique = c.mark(n)
+	c.record(unique)
+	return unique
+}
+
+func (c *pagedChecker) IsUniqueBatch(ns []uint32, out []bool) {
+	for _, o := range batchOrder(ns) {
+		n, i := uint32(o>>32), uint32(o)
+		out[i] = c.IsUnique(n)
+	}
+}
+
+func (c *pagedChecker) record(unique bool) {
+	if unique {
+		c.r.markUnique()
+		c.r.setMemory(uint64(c.bytes()))
+	} else {
+		c.r.markDuplicate()
+	}
+}
+
+// bytes is the memory held by the directory and the pages allocated.
+func (c *pagedChecker) bytes() int64 {
+	return int64(len(c.pages))*int64(unsafe.Sizeof(unsafe.Pointer(nil))) + c.used.Load()*pagedPageBytes
+}
+
+// Reset drops every page. A number checked against a page while it is
+// dropped counts as checked before the reset.
+func (c *pagedChecker) Reset() {
+	for i := range c.pages {
+		if syncatomic.SwapPointer(&c.pages[i], nil) != nil {
+			c.used.Dec()
+		}
+	}
+	c.r.markReset()
+	c.r.setMemory(uint64(c.bytes()))
+}
+
+func (c *pagedChecker) Forget(n uint32) (forgotten bool) {
+	p := (*pagedPage)(syncatomic.LoadPointer(&c.pages[n>>pagedPageBits]))
+	if p == nil {
+		return false
+	}
+	x := n % pagedPageSize
+	if clearBit(&p[x/64], uint64(1)<<(x%64)) {
+		c.r.markForgotten()
+		return true
+	}
+	return false
+}
+
+// clearBit clears bit in word and reports whether it was set.
+func clearBit(word *uint64, bit uint64) bool {
+	for {
+		old := syncatomic.LoadUint64(word)
+		if old&bit == 0 {
+			return false
+		}
+		if syncatomic.CompareAndSwapUint64(word, old, old&^bit) {
+			return true
+		}
+	}
+}
+
+func (c *pagedChecker) GetReport() string {
+	return c.r.getReport() + fmt.Sprintf(". Pages: %v of %v", c.used.Load(), len(c.pages))
+}
+
+func (c *pagedChecker) walk(fn func(n uint32) bool) {
+	for i := range c.pages {
+		p := (*pagedPage)(syncatomic.LoadPointer(&c.pages[i]))
+		if p == nil {
+			continue
+		}
+		hi := uint32(i) << pagedPageBits
+		for w := range p {
+			for word := syncatomic.LoadUint64(&p[w]); word != 0; word &= word - 1 {
+				if !fn(hi | uint32(w*64+bits.TrailingZeros64(word))) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c *pagedChecker) countRange(from, to uint32) (count uint64) {
+	for i := from >> pagedPageBits; i <= to>>pagedPageBits; i++ {
+		p := (*pagedPage)(syncatomic.LoadPointer(&c.pages[i]))
+		if p == nil {
+			continue
+		}
+		lo, hi := uint32(0), uint32(pagedPageSize-1)
+		if i == from>>pagedPageBits {
+			lo = from % pagedPageSize
+		}
+		if i == to>>pagedPageBits {
+			hi = to % pagedPageSize
+		}
+		count += countBits(p[:], lo, hi)
+	}
+	return count
+}
+
+func (c *pagedChecker) restore(n uint32) (restored bool) {
+	if restored = c.mark(n); restored {
+		c.r.markRestored()
+		c.r.setMemory(uint64(c.bytes()))
+	}
+	return restored
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestAddOkayPaged(t *testing.T) {
+	mr := &mockRecorder{}
+	mr.On("markUnique").Return()
+	mr.On("setMemory", mock.Anything).Return()
+	testAddOkay(t, newPagedChecker(mr))
+}
+
+func TestAddDuplicatePaged(t *testing.T) {
+	mr := &mockRecorder{}
+	mr.On("markUnique").Return()
+	mr.On("markDuplicate").Return()
+	mr.On("setMemory", mock.Anything).Return()
+	testAddDuplicate(t, newPagedChecker(mr))
+}
+
+func TestPagedChecker_pages(t *testing.T) {
+	r := NewRecorder()
+	c := newPagedChecker(r)
+	directory := int64(pagedPages) * 8
+	assert.Equal(t, directory, c.bytes())
+
+	for _, n := range []uint32{0, 1, pagedPageSize - 1, maxNumber} {
+		assert.True(t, c.IsUnique(n))
+	}
+	assert.False(t, c.IsUnique(1))
+	assert.Equal(t, directory+2*pagedPageBytes, c.bytes())
+	assert.Equal(t, uint64(c.bytes()), r.(*recorder).m.Load())
+	assert.Contains(t, c.GetReport(), ". Pages: 2 of 15259")
+
+	var walked []uint32
+	c.walk(func(n uint32) bool {
+		walked = append(walked, n)
+		return true
+	})
+	assert.Equal(t, []uint32{0, 1, pagedPageSize - 1, maxNumber}, walked)
+}
+
+func TestPagedChecker_concurrent(t *testing.T) {
+	c := newPagedChecker(&noopRecorder{})
+	var (
+		wg     sync.WaitGroup
+		unique = make([]int, 8)
+	)
+	// Every goroutine races for the same numbers, so for the same pages and
+	// words.
+	for g := range unique {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for n := uint32(0); n < 3*pagedPageSize; n += 7 {
+				if c.IsUnique(n) {
+					unique[g]++
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	total := 0
+	for _, u := range unique {
+		total += u
+	}
+	assert.Equal(t, (3*pagedPageSize+6)/7, total)
+	assert.Equal(t, int64(3), c.used.Load())
+}
+
+// TestStartupMemory checks that the checkers which grow with the numbers
+// seen take next to nothing before any arrive.
+func TestStartupMemory(t *testing.T) {
+	tests := []struct {
+		name    string
+		checker func(r Recorder) NumberChecker
+	}{
+		{name: "Paged", checker: func(r Recorder) NumberChecker { return newPagedChecker(r) }},
+		{name: "Map", checker: newMapChecker},
+		{name: "Sharded", checker: func(r Recorder) NumberChecker { return newShardedChecker(r, DefaultShards) }},
+		{name: "Roaring", checker: func(r Recorder) NumberChecker { return newRoaringChecker(r) }},
+		{name: "Adaptive", checker: func(r Recorder) NumberChecker { return newAdaptiveChecker(r, 0) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			c := tt.checker(&noopRecorder{})
+			runtime.ReadMemStats(&after)
+			require.NotNil(t, c)
+			assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+			runtime.KeepAlive(c)
+		})
+	}
+}
+
+func BenchmarkPagedChecker(b *testing.B) {
+	c := newPagedChecker(&noopRecorder{})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.IsUnique(uint32(i*7919) % numberSpace)
+	}
+	b.ReportMetric(float64(c.bytes()), "bytes")
+}
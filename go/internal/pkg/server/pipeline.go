@@ -0,0 +1,252 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/atomic"
+	"sync"
+)
+
+// QueueMode decides what a connection does with a number when the pipeline
+// queue is full.
+type QueueMode int
+
+const (
+	// QueueBlock waits for room in the queue, slowing the producer down.
+	QueueBlock QueueMode = iota
+	// QueueDrop drops the number and counts it.
+	QueueDrop
+)
+
+func ParseQueueMode(s string) (QueueMode, error) {
+	switch s {
+	case "block":
+		return QueueBlock, nil
+	case "drop":
+		return QueueDrop, nil
+	}
+	return QueueBlock, fmt.Errorf("unknown queue mode %q", s)
+}
+
+// PipelineConfig sizes the queues and batches of a Pipeline.
+type PipelineConfig struct {
+	// NumberQueue is how many parsed numbers wait for the dedup stage.
+	NumberQueue int
+	// WriteQueue is how many unique numbers wait for the writer stage.
+	WriteQueue int
+	// DedupBatch is the most numbers checked in one IsUniqueBatch call.
+	DedupBatch int
+	// WriteBatch is the most numbers written in one call to the writer.
+	WriteBatch int
+	// Full applies to the number queue only. The write queue always blocks
+	// as its numbers have already been marked as seen.
+	Full QueueMode
+}
+
+// PipelineDepths is a point in time view of the pipeline queues.
+type PipelineDepths struct {
+	Numbers        int    `json:"numbers"`
+	NumbersCap     int    `json:"numbersCapacity"`
+	Writes         int    `json:"writes"`
+	WritesCap      int    `json:"writesCapacity"`
+	Dropped        uint64 `json:"dropped"`
+	MaxNumbers     int    `json:"maxNumbers"`
+	MaxWrites      int    `json:"maxWrites"`
+	DedupBatches   uint64 `json:"dedupBatches"`
+	WrittenBatches uint64 `json:"writtenBatches"`
+}
+
+// Pipeline moves numbers from the connections through a dedup stage and a
+// writer stage, each fed by a bounded queue, so a slow writer only stalls
+// the producers once the queues are full.
+type Pipeline interface {
+	Depths() PipelineDepths
+	// Stop flushes every queued number and stops the stages. Nothing may be
+	// pushed once Stop has been called.
+	Stop()
+	push(ctx context.Context, n uint32, cs *connStats) bool
+	getReport() string
+}
+
+type queuedNumber struct {
+	n  uint32
+	cs *connStats
+}
+
+type pipeline struct {
+	nc  NumberChecker
+	w   log
+	cfg PipelineConfig
+
+	numbers chan queuedNumber
+	writes  chan uint32
+
+	dropped        atomic.Uint64
+	maxNumbers     atomic.Int64
+	maxWrites      atomic.Int64
+	dedupBatches   atomic.Uint64
+	writtenBatches atomic.Uint64
+
+	stopOnce sync.Once
+	done     sync.WaitGroup
+}
+
+func NewPipeline(nc NumberChecker, w log, cfg PipelineConfig) Pipeline {
+	p := newPipeline(nc, w, cfg)
+	p.start()
+	return p
+}
+
+func newPipeline(nc NumberChecker, w log, cfg PipelineConfig) *pipeline {
+	if cfg.DedupBatch < 1 {
+		cfg.DedupBatch = 1
+	}
+	if cfg.WriteBatch < 1 {
+		cfg.WriteBatch = 1
+	}
+	return &pipeline{
+		nc:      nc,
+		w:       w,
+		cfg:     cfg,
+		numbers: make(chan queuedNumber, cfg.NumberQueue),
+		writes:  make(chan uint32, cfg.WriteQueue),
+	}
+}
+
+func (p *pipeline) start() {
+	p.done.Add(2)
+	go p.dedup()
+	go p.write()
+}
+
+func (p *pipeline) push(ctx context.Context, n uint32, cs *connStats) bool {
+	q := queuedNumber{n: n, cs: cs}
+	if p.cfg.Full == QueueDrop {
+		select {
+		case p.numbers <- q:
+		default:
+			p.dropped.Inc()
+			return false
+		}
+	} else {
+		select {
+		case p.numbers <- q:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	updateMax(&p.maxNumbers, len(p.numbers))
+	return true
+}
+
+func (p *pipeline) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.numbers)
+	})
+	p.done.Wait()
+}
+
+func (p *pipeline) dedup() {
+	defer p.done.Done()
+	defer close(p.writes)
+	batch := make([]queuedNumber, 0, p.cfg.DedupBatch)
+	ns := make([]uint32, 0, p.cfg.DedupBatch)
+	unique := make([]bool, p.cfg.DedupBatch)
+	for q := range p.numbers {
+		batch = append(batch[:0], q)
+	fill:
+		for len(batch) < p.cfg.DedupBatch {
+			select {
+			case q, ok := <-p.numbers:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, q)
+			default:
+				break fill
+			}
+		}
+
+		ns = ns[:0]
+		for _, q := range batch {
+			ns = append(ns, q.n)
+		}
+		p.nc.IsUniqueBatch(ns, unique[:len(ns)])
+		p.dedupBatches.Inc()
+		for i, q := range batch {
+			if !unique[i] {
+				q.cs.duplicate.Inc()
+				continue
+			}
+			q.cs.unique.Inc()
+			p.writes <- q.n
+			updateMax(&p.maxWrites, len(p.writes))
+		}
+	}
+}
+
+// write appends the unique numbers to the writer, one line each, in as
+// few calls as possible.
+func (p *pipeline) write() {
+	defer p.done.Done()
+	buf := make([]byte, 0, p.cfg.WriteBatch*10)
+	for n := range p.writes {
+		buf = appendNumber(buf[:0], n)
+		count := 1
+	fill:
+		for count < p.cfg.WriteBatch {
+			select {
+			case n, ok := <-p.writes:
+				if !ok {
+					break fill
+				}
+				buf = append(buf, '\n')
+				buf = appendNumber(buf, n)
+				count++
+			default:
+				break fill
+			}
+		}
+		p.w.Info(string(buf))
+		p.writtenBatches.Inc()
+	}
+}
+
+func (p *pipeline) Depths() PipelineDepths {
+	return PipelineDepths{
+		Numbers:        len(p.numbers),
+		NumbersCap:     cap(p.numbers),
+		Writes:         len(p.writes),
+		WritesCap:      cap(p.writes),
+		Dropped:        p.dropped.Load(),
+		MaxNumbers:     int(p.maxNumbers.Load()),
+		MaxWrites:      int(p.maxWrites.Load()),
+		DedupBatches:   p.dedupBatches.Load(),
+		WrittenBatches: p.writtenBatches.Load(),
+	}
+}
+
+func (p *pipeline) getReport() string {
+	d := p.Depths()
+	return fmt.Sprintf("Pipeline: %v/%v numbers queued (max %v), %v/%v writes queued (max %v), %v dropped",
+		d.Numbers, d.NumbersCap, d.MaxNumbers, d.Writes, d.WritesCap, d.MaxWrites, d.Dropped)
+}
+
+// appendNumber appends n as the nine digits it was received as.
+func appendNumber(buf []byte, n uint32) []byte {
+	var digits [9]byte
+	for i := len(digits) - 1; i >= 0; i-- {
+		digits[i] = '0' + byte(n%10)
+		n /= 10
+	}
+	return append(buf, digits[:]...)
+}
+
+func updateMax(peak *atomic.Int64, depth int) {
+	for {
+		current := peak.Load()
+		if int64(depth) <= current || peak.CAS(current, int64(depth)) {
+			return
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseQueueMode(t *testing.T) {
+	m, err := ParseQueueMode("block")
+	assert.NoError(t, err)
+	assert.Equal(t, QueueBlock, m)
+	m, err = ParseQueueMode("drop")
+	assert.NoError(t, err)
+	assert.Equal(t, QueueDrop, m)
+	_, err = ParseQueueMode("wait")
+	assert.Error(t, err)
+}
+
+func TestPipeline(t *testing.T) {
+	nc := &batchCountingChecker{NumberChecker: newMapChecker(&noopRecorder{})}
+	w := &recordingLog{}
+	p := NewPipeline(nc, w, PipelineConfig{NumberQueue: 16, WriteQueue: 16, DedupBatch: 4, WriteBatch: 8})
+	cs := &connStats{}
+	for _, n := range []uint32{1, 2, 1, 999999999, 2, 3} {
+		assert.True(t, p.push(context.Background(), n, cs))
+	}
+	p.Stop()
+
+	assert.Equal(t, []string{"000000001", "000000002", "999999999", "000000003"}, w.lines())
+	assert.Equal(t, uint64(4), cs.unique.Load())
+	assert.Equal(t, uint64(2), cs.duplicate.Load())
+	assert.NotZero(t, nc.batches)
+	d := p.Depths()
+	assert.Equal(t, d.DedupBatches, nc.batches)
+	assert.NotZero(t, d.WrittenBatches)
+	assert.LessOrEqual(t, d.WrittenBatches, uint64(4))
+}
+
+func TestPipeline_drop(t *testing.T) {
+	// The stages are not started, so the queue never empties.
+	p := newPipeline(newMapChecker(&noopRecorder{}), new(mockLog), PipelineConfig{NumberQueue: 1, Full: QueueDrop})
+	assert.True(t, p.push(context.Background(), 1, &connStats{}))
+	assert.False(t, p.push(context.Background(), 2, &connStats{}))
+	assert.Equal(t, PipelineDepths{Numbers: 1, NumbersCap: 1, Dropped: 1, MaxNumbers: 1}, p.Depths())
+	assert.Equal(t, "Pipeline: 1/1 numbers queued (max 1), 0/0 writes queued (max 0), 1 dropped", p.getReport())
+}
+
+func TestPipeline_block(t *testing.T) {
+	p := newPipeline(newMapChecker(&noopRecorder{}), new(mockLog), PipelineConfig{NumberQueue: 1})
+	assert.True(t, p.push(context.Background(), 1, &connStats{}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pushed := make(chan bool, 1)
+	go func() {
+		pushed <- p.push(ctx, 2, &connStats{})
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("expected push to block on a full queue")
+	case <-time.After(20 * time.Millisecond):
+	}
+	cancel()
+	assert.False(t, <-pushed)
+	assert.Zero(t, p.Depths().Dropped)
+}
+
+func TestHandlerPipeline(t *testing.T) {
+	w := &recordingLog{}
+	p := NewPipeline(newMapChecker(&noopRecorder{}), w, PipelineConfig{NumberQueue: 4, WriteQueue: 4, DedupBatch: 2, WriteBatch: 2})
+	reg := NewRegistry()
+	h := NewHandler(new(mockRepo), new(mockLog), reg)
+	h.SetPipeline(p)
+
+	s, c := net.Pipe()
+	defer s.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- h.handle(context.Background(), func() {}, c)
+	}()
+	_, err := s.Write([]byte("000000007\n000000008\n000000007\n"))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		conns := reg.Connections()
+		return len(conns) == 1 && conns[0].Unique+conns[0].Duplicates == 3
+	}, time.Second, 10*time.Millisecond)
+	ci := reg.Connections()[0]
+	assert.Equal(t, uint64(3), ci.Received)
+	assert.Equal(t, uint64(2), ci.Unique)
+	assert.Equal(t, uint64(1), ci.Duplicates)
+
+	assert.True(t, reg.Disconnect(ci.ID))
+	assert.NoError(t, <-done)
+	p.Stop()
+	assert.Equal(t, []string{"000000007", "000000008"}, w.lines())
+}
+
+func TestAppendNumber(t *testing.T) {
+	assert.Equal(t, "000000000", string(appendNumber(nil, 0)))
+	assert.Equal(t, "000001234", string(appendNumber(nil, 1234)))
+	assert.Equal(t, "x999999999", string(appendNumber([]byte("x"), 999999999)))
+}
+
+type batchCountingChecker struct {
+	NumberChecker
+	batches uint64
+}
+
+func (c *batchCountingChecker) IsUniqueBatch(ns []uint32, out []bool) {
+	c.batches++
+	for i, n := range ns {
+		out[i] = c.IsUnique(n)
+	}
+}
+
+// recordingLog keeps everything written to it.
+type recordingLog struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *recordingLog) Info(msg string, fields ...zap.Field) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, msg)
+}
+
+func (l *recordingLog) lines() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Split(strings.Join(l.msgs, "\n"), "\n")
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	trusted, err := ParseTrustedProxies("10.0.0.1, 192.168.0.0/16,")
+	require.NoError(t, err)
+	require.Len(t, trusted, 2)
+	assert.Equal(t, "10.0.0.1/32", trusted[0].String())
+	assert.Equal(t, "192.168.0.0/16", trusted[1].String())
+
+	trusted, err = ParseTrustedProxies("")
+	assert.NoError(t, err)
+	assert.Empty(t, trusted)
+
+	_, err = ParseTrustedProxies("proxy.local")
+	assert.Error(t, err)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  []byte
+		want    string
+		wantErr bool
+	}{
+		{name: "V1TCP4", header: []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51000 4000\r\n"), want: "203.0.113.7:51000"},
+		{name: "V1TCP6", header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 51000 4000\r\n"), want: "[2001:db8::1]:51000"},
+		{name: "V1Unknown", header: []byte("PROXY UNKNOWN\r\n")},
+		{name: "V1NoCRLF", header: []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51000 4000\n"), wantErr: true},
+		{name: "V1BadAddress", header: []byte("PROXY TCP4 nope 10.0.0.1 51000 4000\r\n"), wantErr: true},
+		{name: "V1BadPort", header: []byte("PROXY TCP4 203.0.113.7 10.0.0.1 99999 4000\r\n"), wantErr: true},
+		{name: "V1TooLong", header: []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"), wantErr: true},
+		{name: "V2TCP4", header: proxyV2Header(proxyV2CommandProxy, proxyV2FamilyTCP4, net.ParseIP("203.0.113.7").To4(), 51000), want: "203.0.113.7:51000"},
+		{name: "V2TCP6", header: proxyV2Header(proxyV2CommandProxy, proxyV2FamilyTCP6, net.ParseIP("2001:db8::1"), 51000), want: "[2001:db8::1]:51000"},
+		{name: "V2Local", header: proxyV2Header(proxyV2CommandLocal, 0, nil, 0)},
+		{name: "V2ShortAddress", header: proxyV2Header(proxyV2CommandProxy, proxyV2FamilyTCP6, net.ParseIP("203.0.113.7").To4(), 51000), wantErr: true},
+		{name: "V2BadCommand", header: proxyV2Header(0x5, proxyV2FamilyTCP4, net.ParseIP("203.0.113.7").To4(), 51000), wantErr: true},
+		{name: "Missing", header: []byte("000000001\n"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(append(tt.header, []byte("000000001\n")...)))
+			addr, err := readProxyHeader(r)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			if tt.want == "" {
+				assert.Nil(t, addr)
+			} else {
+				assert.Equal(t, tt.want, addr.String())
+			}
+			rest, err := ioutil.ReadAll(r)
+			assert.NoError(t, err)
+			assert.Equal(t, "000000001\n", string(rest), "expected data after the header to be kept")
+		})
+	}
+}
+
+func TestAcceptProxy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	trusted, err := ParseTrustedProxies("127.0.0.1")
+	require.NoError(t, err)
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 51000 4000\r\n000000001\n"))
+	require.NoError(t, err)
+
+	conn, err := ln.Accept()
+	require.NoError(t, err)
+	pc, err := acceptProxy(conn, trusted)
+	require.NoError(t, err)
+	defer pc.Close()
+	assert.Equal(t, "203.0.113.7:51000", pc.RemoteAddr().String())
+	line, err := bufio.NewReader(pc).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "000000001\n", line)
+
+	untrusted, err := ParseTrustedProxies("10.0.0.1")
+	require.NoError(t, err)
+	client2, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer client2.Close()
+	_, err = client2.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 51000 4000\r\n"))
+	require.NoError(t, err)
+	conn2, err := ln.Accept()
+	require.NoError(t, err)
+	defer conn2.Close()
+	c, err := acceptProxy(conn2, untrusted)
+	require.NoError(t, err)
+	assert.Equal(t, conn2, c, "expected headers from untrusted clients to be ignored")
+	assert.Equal(t, client2.LocalAddr().String(), c.RemoteAddr().String())
+}
+
+func proxyV2Header(command, family byte, ip net.IP, port uint16) []byte {
+	var payload []byte
+	if ip != nil {
+		payload = append(payload, ip...)
+		payload = append(payload, ip...)
+		ports := make([]byte, 4)
+		binary.BigEndian.PutUint16(ports, port)
+		binary.BigEndian.PutUint16(ports[2:], 4000)
+		payload = append(payload, ports...)
+	}
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(payload)))
+	return append(header, payload...)
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	syncatomic "sync/atomic"
+)
+
+const (
+	// DefaultCoverageBlock is the size of the blocks of a coverage report.
+	DefaultCoverageBlock = 1000000
+	// maxCoverageBlocks bounds the blocks of a coverage report.
+	maxCoverageBlocks = 100000
+)
+
+var errRangeUnsupported = errors.New("number checker cannot count ranges")
+
+// rangeCounter is implemented by the paged, mmap, adaptive and roaring
+// checkers, which count the numbers seen in a range from their bits or
+// containers, and by the list and bool checkers, which test each number of
+// it. The map, sharded, bloom and window checkers cannot count ranges.
+type rangeCounter interface {
+	// countRange returns how many numbers from from to to, both included,
+	// have been seen.
+	countRange(from, to uint32) uint64
+}
+
+// BlockCoverage is how much of a block of numbers has been seen.
+type BlockCoverage struct {
+	// Start is the first number of the block.
+	Start uint32 `json:"start"`
+	// End is the last number of the block.
+	End  uint32  `json:"end"`
+	Seen uint64  `json:"seen"`
+	Fill float64 `json:"fill"`
+}
+
+// Coverage splits a range of numbers into blocks and tells how much of each
+// has been seen.
+type Coverage struct {
+	From      uint32 `json:"from"`
+	To        uint32 `json:"to"`
+	BlockSize uint32 `json:"blockSize"`
+	// Seen is how many numbers of the whole range have been seen.
+	Seen uint64 `json:"seen"`
+	// Full and Empty are how many blocks have every number or none seen.
+	Full   int             `json:"full"`
+	Empty  int             `json:"empty"`
+	Blocks []BlockCoverage `json:"blocks"`
+}
+
+// CountRange returns how many numbers from from to to, both included, nc
+// has seen.
+func CountRange(nc NumberChecker, from, to uint32) (uint64, error) {
+	rc, err := rangeCounterOf(nc, from, to)
+	if err != nil {
+		return 0, err
+	}
+	return rc.countRange(from, to), nil
+}
+
+// CoverageOf splits the numbers from from to to, both included, into blocks
+// of blockSize, the last one possibly shorter, and counts the numbers nc has
+// seen in each. The checker keeps accepting numbers meanwhile, so blocks
+// counted later may include numbers received after earlier ones were.
+func CoverageOf(nc NumberChecker, from, to, blockSize uint32) (Coverage, error) {
+	rc, err := rangeCounterOf(nc, from, to)
+	if err != nil {
+		return Coverage{}, err
+	}
+	if blockSize == 0 {
+		return Coverage{}, errors.New("block size has to be positive")
+	}
+	if blocks := (uint64(to)-uint64(from))/uint64(blockSize) + 1; blocks > maxCoverageBlocks {
+		return Coverage{}, fmt.Errorf("%v blocks of %v numbers, at most %v are reported", blocks, blockSize, maxCoverageBlocks)
+	}
+	c := Coverage{From: from, To: to, BlockSize: blockSize}
+	for start := uint64(from); start <= uint64(to); start += uint64(blockSize) {
+		end := start + uint64(blockSize) - 1
+		if end > uint64(to) {
+			end = uint64(to)
+		}
+		b := BlockCoverage{Start: uint32(start), End: uint32(end)}
+		b.Seen = rc.countRange(b.Start, b.End)
+		b.Fill = float64(b.Seen) / float64(end-start+1)
+		switch b.Seen {
+		case 0:
+			c.Empty++
+		case end - start + 1:
+			c.Full++
+		}
+		c.Seen += b.Seen
+		c.Blocks = append(c.Blocks, b)
+	}
+	return c, nil
+}
+
+func rangeCounterOf(nc NumberChecker, from, to uint32) (rangeCounter, error) {
+	rc, ok := baseChecker(nc).(rangeCounter)
+	if !ok {
+		return nil, errRangeUnsupported
+	}
+	if from > to || to > maxNumber {
+		return nil, fmt.Errorf("invalid range %09d-%09d", from, to)
+	}
+	return rc, nil
+}
+
+// countBits returns how many bits from bit from to bit to, both included,
+// are set in words.
+func countBits(words []uint64, from, to uint32) (count uint64) {
+	first, last := from/64, to/64
+	for w := first; w <= last; w++ {
+		word := syncatomic.LoadUint64(&words[w])
+		if w == first {
+			word &= ^uint64(0) << (from % 64)
+		}
+		if w == last {
+			word &= ^uint64(0) >> (63 - to%64)
+		}
+		count += uint64(bits.OnesCount64(word))
+	}
+	return count
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestCountBits(t *testing.T) {
+	words := []uint64{^uint64(0), 0x8000000000000001, 0xF0}
+	tests := []struct {
+		name     string
+		from, to uint32
+		expected uint64
+	}{
+		{name: "Bit", from: 3, to: 3, expected: 1},
+		{name: "Word", from: 0, to: 63, expected: 64},
+		{name: "Partial", from: 60, to: 64, expected: 5},
+		{name: "Across", from: 64, to: 135, expected: 6},
+		{name: "Unset", from: 65, to: 126, expected: 0},
+		{name: "All", from: 0, to: 191, expected: 70},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, countBits(words, tt.from, tt.to))
+		})
+	}
+}
+
+func testCountRange(t *testing.T, nc NumberChecker) {
+	numbers := []uint32{0, 1, 65535, 65536, 100000000, 150000000, 199999999, 200000000, maxNumber}
+	ranges := []struct {
+		from, to uint32
+		expected uint64
+	}{
+		{from: 0, to: maxNumber, expected: 9},
+		{from: 100000000, to: 199999999, expected: 3},
+		{from: 1, to: 65536, expected: 3},
+		{from: 65535, to: 65535, expected: 1},
+		{from: 2, to: 65534, expected: 0},
+		{from: 200000001, to: maxNumber - 1, expected: 0},
+	}
+	for _, n := range numbers {
+		nc.IsUnique(n)
+	}
+	for _, r := range ranges {
+		seen, err := CountRange(nc, r.from, r.to)
+		require.NoError(t, err)
+		assert.Equal(t, r.expected, seen, "%v-%v", r.from, r.to)
+	}
+}
+
+func TestCountRange(t *testing.T) {
+	checkers := []struct {
+		name string
+		nc   func() NumberChecker
+	}{
+		{name: "Paged", nc: func() NumberChecker { return newPagedChecker(&noopRecorder{}) }},
+		{name: "AdaptiveSparse", nc: func() NumberChecker { return newAdaptiveChecker(&noopRecorder{}, 0) }},
+		{name: "AdaptiveDense", nc: func() NumberChecker { return newAdaptiveChecker(&noopRecorder{}, 1) }},
+		{name: "Roaring", nc: func() NumberChecker { return newRoaringChecker(&noopRecorder{}) }},
+	}
+	for _, tt := range checkers {
+		t.Run(tt.name, func(t *testing.T) {
+			testCountRange(t, tt.nc())
+		})
+	}
+}
+
+// testCountRangeSmall counts ranges on a checker holding only the first
+// smallSpace numbers.
+func testCountRangeSmall(t *testing.T, nc NumberChecker) {
+	for _, n := range []uint32{0, 1, 65535, 65536, smallSpace - 1} {
+		nc.IsUnique(n)
+	}
+	ranges := []struct {
+		from, to uint32
+		expected uint64
+	}{
+		{from: 0, to: smallSpace - 1, expected: 5},
+		{from: 1, to: 65536, expected: 3},
+		{from: 65535, to: 65535, expected: 1},
+		{from: 2, to: 65534, expected: 0},
+		{from: 65537, to: smallSpace - 2, expected: 0},
+	}
+	for _, r := range ranges {
+		seen, err := CountRange(nc, r.from, r.to)
+		require.NoError(t, err)
+		assert.Equal(t, r.expected, seen, "%v-%v", r.from, r.to)
+	}
+}
+
+func TestCountRangeAlt(t *testing.T) {
+	testCountRangeSmall(t, newSmallAltChecker(&noopRecorder{}))
+}
+
+func TestCountRangeABool(t *testing.T) {
+	testCountRangeSmall(t, newSmallBoolListChecker(&noopRecorder{}))
+}
+
+func TestCountRange_errors(t *testing.T) {
+	_, err := CountRange(newMapChecker(&noopRecorder{}), 0, 1)
+	assert.Equal(t, errRangeUnsupported, err)
+	_, err = CountRange(newPagedChecker(&noopRecorder{}), 2, 1)
+	assert.EqualError(t, err, "invalid range 000000002-000000001")
+	_, err = CountRange(newPagedChecker(&noopRecorder{}), 0, numberSpace)
+	assert.EqualError(t, err, "invalid range 000000000-1000000000")
+
+	c, err := newCountingChecker(newPagedChecker(&noopRecorder{}), "exact", 0)
+	require.NoError(t, err)
+	c.IsUnique(5)
+	seen, err := CountRange(c, 0, 9)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), seen, "decorators are unwrapped")
+}
+
+func TestCoverageOf(t *testing.T) {
+	c := newPagedChecker(&noopRecorder{})
+	for n := uint32(1000); n < 1100; n++ {
+		c.IsUnique(n)
+	}
+	c.IsUnique(1150)
+
+	cov, err := CoverageOf(c, 1000, 1249, 100)
+	require.NoError(t, err)
+	assert.Equal(t, Coverage{
+		From:      1000,
+		To:        1249,
+		BlockSize: 100,
+		Seen:      101,
+		Full:      1,
+		Empty:     1,
+		Blocks: []BlockCoverage{
+			{Start: 1000, End: 1099, Seen: 100, Fill: 1},
+			{Start: 1100, End: 1199, Seen: 1, Fill: 0.01},
+			{Start: 1200, End: 1249, Seen: 0, Fill: 0},
+		},
+	}, cov)
+
+	cov, err = CoverageOf(c, 0, maxNumber, DefaultCoverageBlock)
+	require.NoError(t, err)
+	assert.Len(t, cov.Blocks, 1000)
+	assert.Equal(t, uint64(101), cov.Seen)
+	assert.Equal(t, 999, cov.Empty)
+	assert.Equal(t, uint32(maxNumber), cov.Blocks[999].End)
+
+	_, err = CoverageOf(c, 0, maxNumber, 0)
+	assert.EqualError(t, err, "block size has to be positive")
+	_, err = CoverageOf(c, 0, maxNumber, 1000)
+	assert.EqualError(t, err, "1000000 blocks of 1000 numbers, at most 100000 are reported")
+	_, err = CoverageOf(newMapChecker(&noopRecorder{}), 0, maxNumber, 1000)
+	assert.Equal(t, errRangeUnsupported, err)
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ThrottleMode decides what happens to numbers above the configured rate.
+type ThrottleMode int
+
+const (
+	// ThrottleBackpressure stops reading from the connection until tokens are
+	// available, letting TCP flow control slow the producer down.
+	ThrottleBackpressure ThrottleMode = iota
+	// ThrottleReject drops the numbers above the rate.
+	ThrottleReject
+)
+
+func ParseThrottleMode(s string) (ThrottleMode, error) {
+	switch s {
+	case "backpressure":
+		return ThrottleBackpressure, nil
+	case "reject":
+		return ThrottleReject, nil
+	}
+	return ThrottleBackpressure, fmt.Errorf("unknown throttle mode %q", s)
+}
+
+// RateLimit is a token bucket refilled with Rate numbers per second that
+// holds at most Burst tokens. A zero Rate disables the limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+func newTokenBucket(l RateLimit) *tokenBucket {
+	if l.Rate <= 0 {
+		return nil
+	}
+	burst := float64(l.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   l.Rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+		now:    time.Now,
+	}
+}
+
+func (b *tokenBucket) refill() {
+	now := b.now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// allow takes a token if one is available.
+func (b *tokenBucket) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// reserve takes a token, going into debt if needed, and returns how long
+// the caller has to wait before using it.
+func (b *tokenBucket) reserve() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// refund gives back a token taken by allow.
+func (b *tokenBucket) refund() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens++; b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
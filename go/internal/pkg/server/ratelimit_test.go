@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseThrottleMode(t *testing.T) {
+	m, err := ParseThrottleMode("backpressure")
+	assert.NoError(t, err)
+	assert.Equal(t, ThrottleBackpressure, m)
+	m, err = ParseThrottleMode("reject")
+	assert.NoError(t, err)
+	assert.Equal(t, ThrottleReject, m)
+	_, err = ParseThrottleMode("drop")
+	assert.Error(t, err)
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newTokenBucket(RateLimit{Rate: 10, Burst: 2})
+	b.last = now
+	b.now = func() time.Time { return now }
+
+	assert.True(t, b.allow())
+	assert.True(t, b.allow())
+	assert.False(t, b.allow(), "expected burst to be used up")
+
+	now = now.Add(100 * time.Millisecond)
+	assert.True(t, b.allow(), "expected a token after 1/rate")
+	assert.False(t, b.allow())
+
+	now = now.Add(time.Hour)
+	assert.True(t, b.allow())
+	assert.True(t, b.allow())
+	assert.False(t, b.allow(), "expected refill to be capped at burst")
+
+	b.refund()
+	assert.True(t, b.allow())
+
+	assert.Equal(t, 100*time.Millisecond, b.reserve())
+	assert.Equal(t, 200*time.Millisecond, b.reserve())
+}
+
+func TestTokenBucket_disabled(t *testing.T) {
+	b := newTokenBucket(RateLimit{})
+	assert.Nil(t, b)
+	assert.True(t, b.allow())
+	assert.Equal(t, time.Duration(0), b.reserve())
+	b.refund()
+}
+
+func TestHandlerRateLimit_reject(t *testing.T) {
+	m := new(mockRepo)
+	m.On("IsUnique", uint32(1)).Return(true)
+	l := new(mockLog)
+	l.On("Info", "000000001", []zapcore.Field(nil))
+	mr := &mockRecorder{}
+	mr.On("markThrottled").Return()
+	r := NewRegistry()
+	h := NewHandler(m, l, r)
+	h.SetRateLimit(RateLimit{}, RateLimit{Rate: 0.001, Burst: 1}, ThrottleReject, mr)
+
+	s, c := net.Pipe()
+	defer s.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- h.handle(context.Background(), func() {}, c)
+	}()
+	_, err := s.Write([]byte("000000001\n000000002\n000000003\n"))
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		conns := r.Connections()
+		return len(conns) == 1 && conns[0].Received == 3
+	}, time.Second, 10*time.Millisecond)
+	ci := r.Connections()[0]
+	assert.Equal(t, uint64(1), ci.Unique)
+	assert.Equal(t, uint64(2), ci.Throttled)
+
+	require.NoError(t, s.Close())
+	assert.NoError(t, <-done)
+	m.AssertExpectations(t)
+	l.AssertExpectations(t)
+	mr.AssertNumberOfCalls(t, "markThrottled", 2)
+}
+
+func TestHandlerRateLimit_backpressure(t *testing.T) {
+	m := new(mockRepo)
+	m.On("IsUnique", uint32(1)).Return(true)
+	m.On("IsUnique", uint32(2)).Return(true)
+	logged := make(chan struct{}, 2)
+	l := new(mockLog)
+	l.On("Info", "000000001", []zapcore.Field(nil)).Run(func(mock.Arguments) { logged <- struct{}{} })
+	l.On("Info", "000000002", []zapcore.Field(nil)).Run(func(mock.Arguments) { logged <- struct{}{} })
+	mr := &mockRecorder{}
+	mr.On("markThrottled").Return()
+	h := NewHandler(m, l, NewRegistry())
+	h.SetRateLimit(RateLimit{Rate: 10, Burst: 1}, RateLimit{}, ThrottleBackpressure, mr)
+
+	s, c := net.Pipe()
+	defer s.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- h.handle(context.Background(), func() {}, c)
+	}()
+	start := time.Now()
+	_, err := s.Write([]byte("000000001\n000000002\n"))
+	require.NoError(t, err)
+	<-logged
+	<-logged
+	assert.True(t, time.Since(start) >= 90*time.Millisecond, "expected the second number to wait for a token")
+
+	require.NoError(t, s.Close())
+	assert.NoError(t, <-done)
+	m.AssertExpectations(t)
+	mr.AssertNumberOfCalls(t, "markThrottled", 1)
+}
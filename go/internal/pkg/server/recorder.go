@@ -8,6 +8,30 @@ import (
 type Recorder interface {
 	markUnique()
 	markDuplicate()
+	markRestored()
+	// addRestored counts n restored numbers at once.
+	addRestored(n uint64)
+	markRejected()
+	markDenied()
+	markThrottled()
+	// markForgotten takes a number forgotten by the checker off the total.
+	markForgotten()
+	// addExpired takes n numbers the checker stopped remembering on its own
+	// off the total.
+	addExpired(n uint64)
+	// markReset zeroes the total once the checker forgot every number.
+	markReset()
+	// setMemory records how many bytes the checker holds.
+	setMemory(bytes uint64)
+	// setFalsePositiveRate records that the checker is probabilistic along
+	// with its estimated false positive rate.
+	setFalsePositiveRate(rate float64)
+	// setDistinct records the estimated distinct numbers accepted in the
+	// current hour and in the hours kept by the Estimator.
+	setDistinct(hour, window uint64, hours int)
+	// getTotal returns the numbers the checker holds, received or restored
+	// and not forgotten, reset or expired since.
+	getTotal() uint64
 	getReport() string
 }
 
@@ -19,6 +43,19 @@ type recorder struct {
 	u atomic.Uint32
 	d atomic.Uint32
 	t atomic.Uint32
+	r atomic.Uint32
+	a atomic.Uint32
+	h atomic.Uint32
+	m atomic.Uint64
+	p atomic.Bool
+	f atomic.Float64
+	// Numbers forgotten and resets since the start.
+	g atomic.Uint32
+	e atomic.Uint32
+	// Estimated distinct numbers, once an Estimator recorded them.
+	dh atomic.Uint64
+	dw atomic.Uint64
+	dn atomic.Int64
 }
 
 func (r *recorder) markUnique() {
@@ -28,8 +65,74 @@ func (r *recorder) markUnique() {
 func (r *recorder) markDuplicate() {
 	r.d.Inc()
 }
+func (r *recorder) markRestored() {
+	r.t.Inc()
+}
+func (r *recorder) addRestored(n uint64) {
+	r.t.Add(uint32(n))
+}
+func (r *recorder) markRejected() {
+	r.r.Inc()
+}
+func (r *recorder) markDenied() {
+	r.a.Inc()
+}
+func (r *recorder) markThrottled() {
+	r.h.Inc()
+}
+func (r *recorder) markForgotten() {
+	r.t.Dec()
+	r.g.Inc()
+}
+func (r *recorder) addExpired(n uint64) {
+	r.t.Sub(uint32(n))
+}
+func (r *recorder) markReset() {
+	r.t.Store(0)
+	r.e.Inc()
+}
+func (r *recorder) setMemory(bytes uint64) {
+	r.m.Store(bytes)
+}
+func (r *recorder) setFalsePositiveRate(rate float64) {
+	r.f.Store(rate)
+	r.p.Store(true)
+}
+func (r *recorder) setDistinct(hour, window uint64, hours int) {
+	r.dh.Store(hour)
+	r.dw.Store(window)
+	r.dn.Store(int64(hours))
+}
+func (r *recorder) getTotal() uint64 {
+	return uint64(r.t.Load())
+}
 func (r *recorder) getReport() string {
-	return fmt.Sprintf(
+	report := fmt.Sprintf(
 		"Received %v unique numbers, %v duplicates. Unique total: %v",
 		r.u.Swap(0), r.d.Swap(0), r.t.Load())
+	if rejected := r.r.Load(); rejected > 0 {
+		report += fmt.Sprintf(". Rejected connections: %v", rejected)
+	}
+	if denied := r.a.Load(); denied > 0 {
+		report += fmt.Sprintf(". Denied connections: %v", denied)
+	}
+	if throttled := r.h.Load(); throttled > 0 {
+		report += fmt.Sprintf(". Throttled numbers: %v", throttled)
+	}
+	if forgotten := r.g.Load(); forgotten > 0 {
+		report += fmt.Sprintf(". Forgotten numbers: %v", forgotten)
+	}
+	if resets := r.e.Load(); resets > 0 {
+		report += fmt.Sprintf(". Resets: %v", resets)
+	}
+	if memory := r.m.Load(); memory > 0 {
+		report += fmt.Sprintf(". Checker memory: %v bytes", memory)
+	}
+	if r.p.Load() {
+		report += fmt.Sprintf(". Probabilistic, estimated false positive rate: %.4f%%", r.f.Load()*100)
+	}
+	if hours := r.dn.Load(); hours > 0 {
+		report += fmt.Sprintf(". Estimated distinct numbers: %v this hour, %v in the last %v hours", r.dh.Load(), r.dw.Load(), hours)
+	}
+	return report
 }
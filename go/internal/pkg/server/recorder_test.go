@@ -20,6 +20,54 @@ func (mr *mockRecorder) markDuplicate() {
 	mr.Called()
 }
 
+func (mr *mockRecorder) markRestored() {
+	mr.Called()
+}
+
+func (mr *mockRecorder) addRestored(n uint64) {
+	mr.Called(n)
+}
+
+func (mr *mockRecorder) markRejected() {
+	mr.Called()
+}
+
+func (mr *mockRecorder) markDenied() {
+	mr.Called()
+}
+
+func (mr *mockRecorder) markThrottled() {
+	mr.Called()
+}
+
+func (mr *mockRecorder) markForgotten() {
+	mr.Called()
+}
+
+func (mr *mockRecorder) addExpired(n uint64) {
+	mr.Called(n)
+}
+
+func (mr *mockRecorder) markReset() {
+	mr.Called()
+}
+
+func (mr *mockRecorder) setMemory(bytes uint64) {
+	mr.Called(bytes)
+}
+
+func (mr *mockRecorder) setFalsePositiveRate(rate float64) {
+	mr.Called(rate)
+}
+
+func (mr *mockRecorder) setDistinct(hour, window uint64, hours int) {
+	mr.Called(hour, window, hours)
+}
+
+func (mr *mockRecorder) getTotal() uint64 {
+	return mr.Called().Get(0).(uint64)
+}
+
 func (mr *mockRecorder) getReport() string {
 	return mr.Called().String(0)
 }
@@ -62,3 +110,91 @@ func Test_recorder_getReport(t *testing.T) {
 		})
 	}
 }
+
+func Test_recorder_getReport_rejected(t *testing.T) {
+	r := NewRecorder()
+	r.markRejected()
+	r.markRejected()
+	assert.Equal(t, "Received 0 unique numbers, 0 duplicates. Unique total: 0. Rejected connections: 2", r.getReport())
+}
+
+func Test_recorder_getReport_denied(t *testing.T) {
+	r := NewRecorder()
+	r.markDenied()
+	assert.Equal(t, "Received 0 unique numbers, 0 duplicates. Unique total: 0. Denied connections: 1", r.getReport())
+}
+
+func Test_recorder_getReport_throttled(t *testing.T) {
+	r := NewRecorder()
+	r.markThrottled()
+	assert.Equal(t, "Received 0 unique numbers, 0 duplicates. Unique total: 0. Throttled numbers: 1", r.getReport())
+}
+
+func Test_recorder_getReport_restored(t *testing.T) {
+	r := NewRecorder()
+	r.markRestored()
+	r.markUnique()
+	assert.Equal(t, "Received 1 unique numbers, 0 duplicates. Unique total: 2", r.getReport())
+}
+
+func Test_recorder_addRestored(t *testing.T) {
+	r := NewRecorder()
+	r.addRestored(1000)
+	r.markUnique()
+	assert.Equal(t, "Received 1 unique numbers, 0 duplicates. Unique total: 1001", r.getReport())
+}
+
+func Test_recorder_getReport_memory(t *testing.T) {
+	r := NewRecorder()
+	r.setMemory(100)
+	r.setMemory(8192)
+	assert.Equal(t, "Received 0 unique numbers, 0 duplicates. Unique total: 0. Checker memory: 8192 bytes", r.getReport())
+}
+
+func Test_recorder_forgottenAndReset(t *testing.T) {
+	r := NewRecorder()
+	r.markUnique()
+	r.markUnique()
+	r.markRestored()
+	r.markForgotten()
+	assert.Equal(t, "Received 2 unique numbers, 0 duplicates. Unique total: 2. Forgotten numbers: 1", r.getReport())
+	r.markReset()
+	r.markUnique()
+	assert.Equal(t, "Received 1 unique numbers, 0 duplicates. Unique total: 1. Forgotten numbers: 1. Resets: 1", r.getReport())
+}
+
+func Test_recorder_addExpired(t *testing.T) {
+	r := NewRecorder()
+	r.markUnique()
+	r.markUnique()
+	r.markUnique()
+	r.addExpired(2)
+	assert.Equal(t, "Received 3 unique numbers, 0 duplicates. Unique total: 1", r.getReport())
+}
+
+func Test_recorder_getTotal(t *testing.T) {
+	r := NewRecorder()
+	r.addRestored(3)
+	r.markUnique()
+	r.markForgotten()
+	r.addExpired(1)
+	assert.Equal(t, uint64(2), r.getTotal())
+	r.getReport()
+	assert.Equal(t, uint64(2), r.getTotal(), "the total is not reset by a report")
+	r.markReset()
+	assert.Equal(t, uint64(0), r.getTotal())
+}
+
+func Test_recorder_getReport_falsePositiveRate(t *testing.T) {
+	r := NewRecorder()
+	r.setFalsePositiveRate(0)
+	assert.Equal(t, "Received 0 unique numbers, 0 duplicates. Unique total: 0. Probabilistic, estimated false positive rate: 0.0000%", r.getReport())
+	r.setFalsePositiveRate(0.00123)
+	assert.Equal(t, "Received 0 unique numbers, 0 duplicates. Unique total: 0. Probabilistic, estimated false positive rate: 0.1230%", r.getReport())
+}
+
+func Test_recorder_getReport_distinct(t *testing.T) {
+	r := NewRecorder()
+	r.setDistinct(120, 4500, 24)
+	assert.Equal(t, "Received 0 unique numbers, 0 duplicates. Unique total: 0. Estimated distinct numbers: 120 this hour, 4500 in the last 24 hours", r.getReport())
+}
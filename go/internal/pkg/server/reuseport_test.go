@@ -0,0 +1,117 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAcceptors(t *testing.T) {
+	h := &countingHandleConn{}
+	l := NewServer(2, "127.0.0.1", 0, h, time.Minute)
+	l.SetAcceptors(3)
+	l.SetOverflowPolicy(OverflowReject, 0, &noopRecorder{})
+	require.NoError(t, l.Start())
+	require.Len(t, l.listeners, 3)
+	addr := l.listeners[0].Addr().String()
+	for _, ln := range l.listeners {
+		assert.Equal(t, addr, ln.Addr().String(), "expected every acceptor on the same port")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- l.Process()
+	}()
+
+	for i := 0; i < 20; i++ {
+		c, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		require.NoError(t, c.Close())
+	}
+	assert.Eventually(t, func() bool {
+		return h.handled.Load() == 20
+	}, time.Second, 10*time.Millisecond)
+
+	// The connection limit is shared by all acceptors.
+	var open []net.Conn
+	for len(open) < 2 {
+		c, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer c.Close()
+		open = append(open, c)
+	}
+	assert.Eventually(t, func() bool {
+		return h.active.Load() == 2
+	}, time.Second, 10*time.Millisecond)
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	msg, err := bufio.NewReader(c).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, busyMessage, msg)
+
+	require.NoError(t, l.Shutdown())
+	assert.NoError(t, <-done)
+}
+
+// BenchmarkAcceptors measures how fast connections are accepted and
+// closed with one or more SO_REUSEPORT accept loops.
+func BenchmarkAcceptors(b *testing.B) {
+	for _, acceptors := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("Acceptors%v", acceptors), func(b *testing.B) {
+			h := &countingHandleConn{}
+			l := NewServer(1024, "127.0.0.1", 0, h, time.Minute)
+			l.SetAcceptors(acceptors)
+			require.NoError(b, l.Start())
+			addr := l.listeners[0].Addr().String()
+			go func() {
+				_ = l.Process()
+			}()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					c, err := net.Dial("tcp", addr)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					_ = c.Close()
+				}
+			})
+			b.StopTimer()
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "conns/s")
+			_ = l.Shutdown()
+		})
+	}
+}
+
+type countingHandleConn struct {
+	handled atomic.Uint64
+	active  atomic.Int64
+}
+
+func (h *countingHandleConn) handle(ctx context.Context, cancel context.CancelFunc, conn net.Conn) error {
+	h.active.Inc()
+	defer h.active.Dec()
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+	_, _ = io.Copy(ioutil.Discard, conn)
+	h.handled.Inc()
+	return conn.Close()
+}
+
+func (h *countingHandleConn) printReport() {}
@@ -0,0 +1,799 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"sort"
+	"sync"
+)
+
+// The roaring bitmap splits every number into its high 16 bits, which pick
+// a container, and its low 16 bits, which the container holds as either a
+// sorted array, a 65536 bit bitmap or a list of runs, whichever is smaller.
+// Snapshots use the portable roaring format shared by the Java, C and Go
+// implementations (https://github.com/RoaringBitmap/RoaringFormatSpec).
+const (
+	// roaringArrayMax is the most values an array container holds before a
+	// bitmap is smaller.
+	roaringArrayMax = 4096
+	// roaringMaxRuns is the most runs a run container holds before a bitmap
+	// is smaller.
+	roaringMaxRuns     = 2047
+	roaringBitmapWords = 1024
+	roaringBitmapBytes = roaringBitmapWords * 8
+
+	roaringCookieNoRuns      = 12346
+	roaringCookie            = 12347
+	roaringNoOffsetThreshold = 4
+)
+
+var errRoaringFormat = errors.New("not a portable roaring bitmap")
+
+type roaringContainer interface {
+	// add returns the container holding x afterwards, which is a new one
+	// when the container had to change type, and whether x was new.
+	add(x uint16) (roaringContainer, bool)
+	// remove returns the container holding the values left, which is a new
+	// one when the container had to change type, and whether x was held.
+	remove(x uint16) (roaringContainer, bool)
+	contains(x uint16) bool
+	cardinality() int
+	// countRange returns how many values from lo to hi, both included, are
+	// held.
+	countRange(lo, hi uint16) int
+	// each calls fn for every value in ascending order until fn returns false.
+	each(fn func(x uint16) bool) bool
+	// size is the number of bytes held in memory.
+	size() int
+}
+
+type arrayContainer struct {
+	vals []uint16
+}
+
+func (a *arrayContainer) search(x uint16) int {
+	return sort.Search(len(a.vals), func(i int) bool {
+		return a.vals[i] >= x
+	})
+}
+
+func (a *arrayContainer) add(x uint16) (roaringContainer, bool) {
+	i := a.search(x)
+	if i < len(a.vals) && a.vals[i] == x {
+		return a, false
+	}
+	if len(a.vals) >= roaringArrayMax {
+		b := &bitmapContainer{}
+		for _, v := range a.vals {
+			b.set(v)
+		}
+		b.set(x)
+		return b.optimize(), true
+	}
+	a.vals = append(a.vals, 0)
+	copy(a.vals[i+1:], a.vals[i:])
+	a.vals[i] = x
+	return a, true
+}
+
+func (a *arrayContainer) remove(x uint16) (roaringContainer, bool) {
+	i := a.search(x)
+	if i == len(a.vals) || a.vals[i] != x {
+		return a, false
+	}
+	a.vals = append(a.vals[:i], a.vals[i+1:]...)
+	return a, true
+}
+
+func (a *arrayContainer) contains(x uint16) bool {
+	i := a.search(x)
+	return i < len(a.vals) && a.vals[i] == x
+}
+
+func (a *arrayContainer) cardinality() int {
+	return len(a.vals)
+}
+
+func (a *arrayContainer) countRange(lo, hi uint16) int {
+	end := sort.Search(len(a.vals), func(i int) bool {
+		return a.vals[i] > hi
+	})
+	return end - a.search(lo)
+}
+
+func (a *arrayContainer) each(fn func(x uint16) bool) bool {
+	for _, v := range a.vals {
+		if !fn(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *arrayContainer) size() int {
+	return 2 * cap(a.vals)
+}
+
+type bitmapContainer struct {
+	words [roaringBitmapWords]uint64
+	card  int
+}
+
+func (b *bitmapContainer) set(x uint16) bool {
+	w, bit := x/64, uint64(1)<<(x%64)
+	if b.words[w]&bit != 0 {
+		return false
+	}
+	b.words[w] |= bit
+	b.card++
+	return true
+}
+
+func (b *bitmapContainer) add(x uint16) (roaringContainer, bool) {
+	if !b.set(x) {
+		return b, false
+	}
+	// Counting the runs is cheap but not free, so it is only done now and
+	// then. A full container is always a single run.
+	if b.card%roaringArrayMax == 0 {
+		return b.optimize(), true
+	}
+	return b, true
+}
+
+func (b *bitmapContainer) remove(x uint16) (roaringContainer, bool) {
+	w, bit := x/64, uint64(1)<<(x%64)
+	if b.words[w]&bit == 0 {
+		return b, false
+	}
+	b.words[w] &^= bit
+	b.card--
+	if b.card <= roaringArrayMax {
+		// The portable format tells bitmaps from arrays by their cardinality.
+		return b.toArray(), true
+	}
+	return b, true
+}
+
+func (b *bitmapContainer) toArray() *arrayContainer {
+	a := &arrayContainer{vals: make([]uint16, 0, b.card)}
+	b.each(func(x uint16) bool {
+		a.vals = append(a.vals, x)
+		return true
+	})
+	return a
+}
+
+// optimize returns the container as runs when that is smaller.
+func (b *bitmapContainer) optimize() roaringContainer {
+	if runs := b.numRuns(); runs <= roaringMaxRuns && 2+4*runs < roaringBitmapBytes {
+		return b.toRuns(runs)
+	}
+	return b
+}
+
+func (b *bitmapContainer) numRuns() int {
+	runs := 0
+	prev := uint64(0)
+	for _, w := range b.words {
+		// A run starts at every set bit whose lower neighbour is clear.
+		runs += bits.OnesCount64(w &^ (w<<1 | prev>>63))
+		prev = w
+	}
+	return runs
+}
+
+func (b *bitmapContainer) toRuns(runs int) *runContainer {
+	r := &runContainer{runs: make([]roaringRun, 0, runs)}
+	b.each(func(x uint16) bool {
+		if n := len(r.runs); n > 0 && int(r.runs[n-1].last())+1 == int(x) {
+			r.runs[n-1].length++
+		} else {
+			r.runs = append(r.runs, roaringRun{start: x})
+		}
+		return true
+	})
+	return r
+}
+
+func (b *bitmapContainer) contains(x uint16) bool {
+	return b.words[x/64]&(uint64(1)<<(x%64)) != 0
+}
+
+func (b *bitmapContainer) cardinality() int {
+	return b.card
+}
+
+func (b *bitmapContainer) countRange(lo, hi uint16) int {
+	return int(countBits(b.words[:], uint32(lo), uint32(hi)))
+}
+
+func (b *bitmapContainer) each(fn func(x uint16) bool) bool {
+	for i, w := range b.words {
+		for w != 0 {
+			t := bits.TrailingZeros64(w)
+			if !fn(uint16(i*64 + t)) {
+				return false
+			}
+			w &= w - 1
+		}
+	}
+	return true
+}
+
+func (b *bitmapContainer) size() int {
+	return roaringBitmapBytes
+}
+
+// roaringRun holds start and the length-1 following values, as stored in
+// the portable format.
+type roaringRun struct {
+	start, length uint16
+}
+
+func (r roaringRun) last() uint16 {
+	return r.start + r.length
+}
+
+type runContainer struct {
+	runs []roaringRun
+}
+
+// search returns the index of the first run starting after x.
+func (r *runContainer) search(x uint16) int {
+	return sort.Search(len(r.runs), func(i int) bool {
+		return r.runs[i].start > x
+	})
+}
+
+func (r *runContainer) add(x uint16) (roaringContainer, bool) {
+	i := r.search(x)
+	if i > 0 && x <= r.runs[i-1].last() {
+		return r, false
+	}
+	extendsPrev := i > 0 && int(r.runs[i-1].last())+1 == int(x)
+	extendsNext := i < len(r.runs) && int(x)+1 == int(r.runs[i].start)
+	switch {
+	case extendsPrev && extendsNext:
+		r.runs[i-1].length += r.runs[i].length + 2
+		r.runs = append(r.runs[:i], r.runs[i+1:]...)
+	case extendsPrev:
+		r.runs[i-1].length++
+	case extendsNext:
+		r.runs[i].start--
+		r.runs[i].length++
+	default:
+		if len(r.runs) >= roaringMaxRuns {
+			// Bitmaps always hold more values than arrays can, as the
+			// portable format tells them apart by their cardinality.
+			if r.cardinality() < roaringArrayMax {
+				a := &arrayContainer{vals: make([]uint16, 0, roaringArrayMax)}
+				r.each(func(v uint16) bool {
+					a.vals = append(a.vals, v)
+					return true
+				})
+				return a.add(x)
+			}
+			b := r.toBitmap()
+			b.set(x)
+			return b, true
+		}
+		r.runs = append(r.runs, roaringRun{})
+		copy(r.runs[i+1:], r.runs[i:])
+		r.runs[i] = roaringRun{start: x}
+	}
+	return r, true
+}
+
+func (r *runContainer) remove(x uint16) (roaringContainer, bool) {
+	i := r.search(x) - 1
+	if i < 0 || x > r.runs[i].last() {
+		return r, false
+	}
+	run := r.runs[i]
+	switch {
+	case run.length == 0:
+		r.runs = append(r.runs[:i], r.runs[i+1:]...)
+	case x == run.start:
+		r.runs[i].start++
+		r.runs[i].length--
+	case x == run.last():
+		r.runs[i].length--
+	default:
+		if len(r.runs) >= roaringMaxRuns {
+			// Splitting the run would make too many.
+			if r.cardinality() <= roaringArrayMax {
+				a := &arrayContainer{}
+				r.each(func(v uint16) bool {
+					a.vals = append(a.vals, v)
+					return true
+				})
+				return a.remove(x)
+			}
+			return r.toBitmap().remove(x)
+		}
+		r.runs = append(r.runs, roaringRun{})
+		copy(r.runs[i+2:], r.runs[i+1:])
+		r.runs[i] = roaringRun{start: run.start, length: x - run.start - 1}
+		r.runs[i+1] = roaringRun{start: x + 1, length: run.last() - x - 1}
+	}
+	return r, true
+}
+
+func (r *runContainer) toBitmap() *bitmapContainer {
+	b := &bitmapContainer{}
+	r.each(func(x uint16) bool {
+		b.set(x)
+		return true
+	})
+	return b
+}
+
+func (r *runContainer) contains(x uint16) bool {
+	i := r.search(x)
+	return i > 0 && x <= r.runs[i-1].last()
+}
+
+func (r *runContainer) cardinality() int {
+	card := 0
+	for _, run := range r.runs {
+		card += int(run.length) + 1
+	}
+	return card
+}
+
+func (r *runContainer) countRange(lo, hi uint16) int {
+	count := 0
+	for _, run := range r.runs {
+		if run.start > hi {
+			break
+		}
+		start, last := run.start, run.last()
+		if last < lo {
+			continue
+		}
+		if start < lo {
+			start = lo
+		}
+		if last > hi {
+			last = hi
+		}
+		count += int(last-start) + 1
+	}
+	return count
+}
+
+func (r *runContainer) each(fn func(x uint16) bool) bool {
+	for _, run := range r.runs {
+		for x := int(run.start); x <= int(run.last()); x++ {
+			if !fn(uint16(x)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (r *runContainer) size() int {
+	return 4 * cap(r.runs)
+}
+
+// roaringBitmap is not safe for concurrent use.
+type roaringBitmap struct {
+	keys       []uint16
+	containers []roaringContainer
+	// bytes is kept up to date with the size of every container.
+	bytes int
+}
+
+func (rb *roaringBitmap) add(n uint32) bool {
+	hi, lo := uint16(n>>16), uint16(n)
+	i := sort.Search(len(rb.keys), func(i int) bool {
+		return rb.keys[i] >= hi
+	})
+	if i == len(rb.keys) || rb.keys[i] != hi {
+		rb.keys = append(rb.keys, 0)
+		copy(rb.keys[i+1:], rb.keys[i:])
+		rb.keys[i] = hi
+		rb.containers = append(rb.containers, nil)
+		copy(rb.containers[i+1:], rb.containers[i:])
+		rb.containers[i] = &arrayContainer{}
+	}
+	c := rb.containers[i]
+	before := c.size()
+	c, added := c.add(lo)
+	rb.containers[i] = c
+	rb.bytes += c.size() - before
+	return added
+}
+
+func (rb *roaringBitmap) remove(n uint32) bool {
+	hi := uint16(n >> 16)
+	i := sort.Search(len(rb.keys), func(i int) bool {
+		return rb.keys[i] >= hi
+	})
+	if i == len(rb.keys) || rb.keys[i] != hi {
+		return false
+	}
+	c := rb.containers[i]
+	before := c.size()
+	c, removed := c.remove(uint16(n))
+	rb.bytes += c.size() - before
+	if c.cardinality() == 0 {
+		rb.bytes -= c.size()
+		rb.keys = append(rb.keys[:i], rb.keys[i+1:]...)
+		rb.containers = append(rb.containers[:i], rb.containers[i+1:]...)
+		return removed
+	}
+	rb.containers[i] = c
+	return removed
+}
+
+func (rb *roaringBitmap) contains(n uint32) bool {
+	hi := uint16(n >> 16)
+	i := sort.Search(len(rb.keys), func(i int) bool {
+		return rb.keys[i] >= hi
+	})
+	return i < len(rb.keys) && rb.keys[i] == hi && rb.containers[i].contains(uint16(n))
+}
+
+func (rb *roaringBitmap) cardinality() uint64 {
+	card := uint64(0)
+	for _, c := range rb.containers {
+		card += uint64(c.cardinality())
+	}
+	return card
+}
+
+// countRange returns how many numbers from from to to, both included, are
+// held, only looking into the containers cut by the range.
+func (rb *roaringBitmap) countRange(from, to uint32) (count uint64) {
+	first, last := uint16(from>>16), uint16(to>>16)
+	i := sort.Search(len(rb.keys), func(i int) bool {
+		return rb.keys[i] >= first
+	})
+	for ; i < len(rb.keys) && rb.keys[i] <= last; i++ {
+		lo, hi := uint16(0), uint16(0xffff)
+		if rb.keys[i] == first {
+			lo = uint16(from)
+		}
+		if rb.keys[i] == last {
+			hi = uint16(to)
+		}
+		if lo == 0 && hi == 0xffff {
+			count += uint64(rb.containers[i].cardinality())
+			continue
+		}
+		count += uint64(rb.containers[i].countRange(lo, hi))
+	}
+	return count
+}
+
+func (rb *roaringBitmap) each(fn func(n uint32) bool) {
+	for i, c := range rb.containers {
+		hi := uint32(rb.keys[i]) << 16
+		if !c.each(func(x uint16) bool {
+			return fn(hi | uint32(x))
+		}) {
+			return
+		}
+	}
+}
+
+// size is the number of bytes held, counting 16 bytes for each container
+// reference and 2 for each key.
+func (rb *roaringBitmap) size() int {
+	return rb.bytes + 2*cap(rb.keys) + 16*cap(rb.containers)
+}
+
+// writeTo writes the bitmap in the portable roaring format.
+func (rb *roaringBitmap) writeTo(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	n := len(rb.containers)
+	hasRuns := false
+	for _, c := range rb.containers {
+		if _, ok := c.(*runContainer); ok {
+			hasRuns = true
+		}
+	}
+
+	var header []byte
+	headerSize := 0
+	if hasRuns {
+		runFlags := make([]byte, (n+7)/8)
+		for i, c := range rb.containers {
+			if _, ok := c.(*runContainer); ok {
+				runFlags[i/8] |= 1 << (i % 8)
+			}
+		}
+		header = appendUint32(nil, roaringCookie|uint32(n-1)<<16)
+		header = append(header, runFlags...)
+		headerSize = len(header) + 4*n
+		if n >= roaringNoOffsetThreshold {
+			headerSize += 4 * n
+		}
+	} else {
+		header = appendUint32(nil, roaringCookieNoRuns)
+		header = appendUint32(header, uint32(n))
+		headerSize = len(header) + 8*n
+	}
+	for i, c := range rb.containers {
+		header = appendUint16(header, rb.keys[i])
+		header = appendUint16(header, uint16(c.cardinality()-1))
+	}
+	if !hasRuns || n >= roaringNoOffsetThreshold {
+		offset := headerSize
+		for _, c := range rb.containers {
+			header = appendUint32(header, uint32(offset))
+			offset += serializedSize(c)
+		}
+	}
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 0, roaringBitmapBytes)
+	for _, c := range rb.containers {
+		buf = buf[:0]
+		switch c := c.(type) {
+		case *arrayContainer:
+			for _, v := range c.vals {
+				buf = appendUint16(buf, v)
+			}
+		case *bitmapContainer:
+			for _, word := range c.words {
+				buf = appendUint64(buf, word)
+			}
+		case *runContainer:
+			buf = appendUint16(buf, uint16(len(c.runs)))
+			for _, run := range c.runs {
+				buf = appendUint16(buf, run.start)
+				buf = appendUint16(buf, run.length)
+			}
+		}
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v), byte(v>>8))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v)), uint32(v>>32))
+}
+
+func serializedSize(c roaringContainer) int {
+	switch c := c.(type) {
+	case *arrayContainer:
+		return 2 * len(c.vals)
+	case *runContainer:
+		return 2 + 4*len(c.runs)
+	}
+	return roaringBitmapBytes
+}
+
+// readRoaring reads a bitmap in the portable roaring format.
+func readRoaring(r io.Reader) (*roaringBitmap, error) {
+	var cookie uint32
+	if err := binary.Read(r, binary.LittleEndian, &cookie); err != nil {
+		return nil, err
+	}
+	var n int
+	var runFlags []byte
+	switch {
+	case cookie&0xffff == roaringCookie:
+		n = int(cookie>>16) + 1
+		runFlags = make([]byte, (n+7)/8)
+		if _, err := io.ReadFull(r, runFlags); err != nil {
+			return nil, err
+		}
+	case cookie == roaringCookieNoRuns:
+		var count uint32
+		if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+			return nil, err
+		}
+		n = int(count)
+	default:
+		return nil, errRoaringFormat
+	}
+	if n > 1<<16 {
+		return nil, fmt.Errorf("roaring bitmap with %v containers", n)
+	}
+
+	header := make([]uint16, 2*n)
+	if err := binary.Read(r, binary.LittleEndian, header); err != nil {
+		return nil, err
+	}
+	if runFlags == nil || n >= roaringNoOffsetThreshold {
+		// The offsets only matter for random access.
+		if _, err := io.CopyN(io.Discard, r, int64(4*n)); err != nil {
+			return nil, err
+		}
+	}
+
+	rb := &roaringBitmap{
+		keys:       make([]uint16, n),
+		containers: make([]roaringContainer, n),
+	}
+	for i := 0; i < n; i++ {
+		rb.keys[i] = header[2*i]
+		if i > 0 && rb.keys[i] <= rb.keys[i-1] {
+			return nil, errors.New("roaring bitmap keys out of order")
+		}
+		card := int(header[2*i+1]) + 1
+		var c roaringContainer
+		switch {
+		case runFlags != nil && runFlags[i/8]&(1<<(i%8)) != 0:
+			var count uint16
+			if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+				return nil, err
+			}
+			raw := make([]uint16, 2*int(count))
+			if err := binary.Read(r, binary.LittleEndian, raw); err != nil {
+				return nil, err
+			}
+			runs := make([]roaringRun, count)
+			for j := range runs {
+				runs[j] = roaringRun{start: raw[2*j], length: raw[2*j+1]}
+				if int(runs[j].start)+int(runs[j].length) > 0xffff || (j > 0 && int(runs[j-1].last()) >= int(runs[j].start)) {
+					return nil, errors.New("roaring runs overlap or overflow")
+				}
+			}
+			c = &runContainer{runs: runs}
+		case card <= roaringArrayMax:
+			vals := make([]uint16, card)
+			if err := binary.Read(r, binary.LittleEndian, vals); err != nil {
+				return nil, err
+			}
+			c = &arrayContainer{vals: vals}
+		default:
+			b := &bitmapContainer{}
+			if err := binary.Read(r, binary.LittleEndian, b.words[:]); err != nil {
+				return nil, err
+			}
+			for _, w := range b.words {
+				b.card += bits.OnesCount64(w)
+			}
+			c = b
+		}
+		if c.cardinality() != card {
+			return nil, fmt.Errorf("roaring container %v holds %v values, expected %v", rb.keys[i], c.cardinality(), card)
+		}
+		rb.containers[i] = c
+		rb.bytes += c.size()
+	}
+	return rb, nil
+}
+
+type roaringChecker struct {
+	mu sync.Mutex
+	rb roaringBitmap
+	r  Recorder
+}
+
+func newRoaringChecker(r Recorder) *roaringChecker {
+	return &roaringChecker{r: r}
+}
+
+func (c *roaringChecker) IsUnique(n uint32) (unique bool) {
+	c.mu.Lock()
+	unique = c.rb.add(n)
+	size := c.rb.size()
+	c.mu.Unlock()
+	if unique {
+		c.r.markUnique()
+		c.r.setMemory(uint64(size))
+	} else {
+		c.r.markDuplicate()
+	}
+	return unique
+}
+
+func (c *roaringChecker) IsUniqueBatch(ns []uint32, out []bool) {
+	order := batchOrder(ns)
+	c.mu.Lock()
+	for _, o := range order {
+		n, i := uint32(o>>32), uint32(o)
+		out[i] = c.rb.add(n)
+	}
+	size := c.rb.size()
+	c.mu.Unlock()
+	for _, unique := range out[:len(ns)] {
+		if unique {
+			c.r.markUnique()
+		} else {
+			c.r.markDuplicate()
+		}
+	}
+	c.r.setMemory(uint64(size))
+}
+
+func (c *roaringChecker) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rb = roaringBitmap{}
+	c.r.markReset()
+	c.r.setMemory(uint64(c.rb.size()))
+}
+
+func (c *roaringChecker) Forget(n uint32) (forgotten bool) {
+	c.mu.Lock()
+	forgotten = c.rb.remove(n)
+	size := c.rb.size()
+	c.mu.Unlock()
+	if forgotten {
+		c.r.markForgotten()
+		c.r.setMemory(uint64(size))
+	}
+	return forgotten
+}
+
+func (c *roaringChecker) GetReport() string {
+	return c.r.getReport()
+}
+
+// walk holds the lock per container, so numbers added meanwhile to
+// containers not yet walked are included.
+func (c *roaringChecker) walk(fn func(n uint32) bool) {
+	var seen []uint32
+	next := 0
+	for {
+		seen = seen[:0]
+		c.mu.Lock()
+		i := sort.Search(len(c.rb.keys), func(i int) bool {
+			return int(c.rb.keys[i]) >= next
+		})
+		if i == len(c.rb.keys) {
+			c.mu.Unlock()
+			return
+		}
+		hi := uint32(c.rb.keys[i]) << 16
+		c.rb.containers[i].each(func(x uint16) bool {
+			seen = append(seen, hi|uint32(x))
+			return true
+		})
+		c.mu.Unlock()
+		for _, n := range seen {
+			if !fn(n) {
+				return
+			}
+		}
+		next = int(hi>>16) + 1
+	}
+}
+
+func (c *roaringChecker) countRange(from, to uint32) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rb.countRange(from, to)
+}
+
+func (c *roaringChecker) restore(n uint32) (restored bool) {
+	c.mu.Lock()
+	restored = c.rb.add(n)
+	size := c.rb.size()
+	c.mu.Unlock()
+	if restored {
+		c.r.markRestored()
+		c.r.setMemory(uint64(size))
+	}
+	return restored
+}
+
+func (c *roaringChecker) writeSnapshot(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rb.writeTo(w)
+}
@@ -0,0 +1,376 @@
+package server
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestAddOkayRoaring(t *testing.T) {
+	mr := &mockRecorder{}
+	mr.On("markUnique").Return()
+	mr.On("setMemory", mock.Anything).Return()
+	testAddOkay(t, newRoaringChecker(mr))
+}
+
+func TestAddDuplicateRoaring(t *testing.T) {
+	mr := &mockRecorder{}
+	mr.On("markUnique").Return()
+	mr.On("markDuplicate").Return()
+	mr.On("setMemory", mock.Anything).Return()
+	testAddDuplicate(t, newRoaringChecker(mr))
+}
+
+func TestRoaringBitmap(t *testing.T) {
+	rnd := rand.New(rand.NewSource(42))
+	tests := []struct {
+		name      string
+		numbers   func() []uint32
+		container roaringContainer
+	}{
+		{name: "Sparse", container: &arrayContainer{}, numbers: func() []uint32 {
+			ns := make([]uint32, 1000)
+			for i := range ns {
+				ns[i] = 7<<16 | uint32(rnd.Intn(1<<16))
+			}
+			return ns
+		}},
+		{name: "Dense", container: &bitmapContainer{}, numbers: func() []uint32 {
+			ns := make([]uint32, 30000)
+			for i := range ns {
+				ns[i] = 7<<16 | uint32(rnd.Intn(1<<16))
+			}
+			return ns
+		}},
+		{name: "Clustered", container: &runContainer{}, numbers: func() []uint32 {
+			var ns []uint32
+			for start := uint32(0); start < 1<<16; start += 1000 {
+				for n := start; n < start+500; n++ {
+					ns = append(ns, 7<<16|n)
+				}
+			}
+			rnd.Shuffle(len(ns), func(i, j int) {
+				ns[i], ns[j] = ns[j], ns[i]
+			})
+			return ns
+		}},
+		{name: "ManyRuns", container: &bitmapContainer{}, numbers: func() []uint32 {
+			var ns []uint32
+			for n := uint32(0); n < 1<<16; n += 3 {
+				ns = append(ns, 7<<16|n)
+			}
+			return ns
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rb := &roaringBitmap{}
+			seen := make(map[uint32]bool)
+			for _, n := range tt.numbers() {
+				assert.Equal(t, !seen[n], rb.add(n), "number %v", n)
+				seen[n] = true
+			}
+			require.Len(t, rb.containers, 1)
+			assert.IsType(t, tt.container, rb.containers[0])
+			assert.Equal(t, uint64(len(seen)), rb.cardinality())
+
+			expected := make([]uint32, 0, len(seen))
+			for n := range seen {
+				expected = append(expected, n)
+				assert.True(t, rb.contains(n))
+			}
+			sort.Slice(expected, func(i, j int) bool {
+				return expected[i] < expected[j]
+			})
+			var walked []uint32
+			rb.each(func(n uint32) bool {
+				walked = append(walked, n)
+				return true
+			})
+			assert.Equal(t, expected, walked)
+			assert.False(t, rb.contains(8<<16))
+
+			sizes := 0
+			for _, c := range rb.containers {
+				sizes += c.size()
+			}
+			assert.Equal(t, sizes, rb.bytes)
+		})
+	}
+}
+
+func TestRunContainer_add(t *testing.T) {
+	r := &runContainer{}
+	for _, x := range []uint16{5, 7, 6, 3, 9, 2, 65535, 0} {
+		c, added := r.add(x)
+		assert.True(t, added)
+		r = c.(*runContainer)
+	}
+	_, added := r.add(6)
+	assert.False(t, added)
+	assert.Equal(t, []roaringRun{{0, 0}, {2, 1}, {5, 2}, {9, 0}, {65535, 0}}, r.runs)
+
+	// 4 joins the runs on either side of it.
+	_, added = r.add(4)
+	assert.True(t, added)
+	assert.Equal(t, []roaringRun{{0, 0}, {2, 5}, {9, 0}, {65535, 0}}, r.runs)
+	assert.Equal(t, 9, r.cardinality())
+}
+
+func TestRoaringContainer_remove(t *testing.T) {
+	manyRuns := func() *runContainer {
+		r := &runContainer{}
+		for x := 0; x < 4*roaringMaxRuns; x += 4 {
+			r.runs = append(r.runs, roaringRun{start: uint16(x)})
+		}
+		r.runs[0].length = 2
+		return r
+	}
+	bigRuns := manyRuns()
+	bigRuns.runs[len(bigRuns.runs)-1] = roaringRun{start: 10000, length: 9000}
+	tests := []struct {
+		name      string
+		container roaringContainer
+		x         uint16
+		removed   bool
+		expected  roaringContainer
+	}{
+		{name: "ArrayMissing", container: &arrayContainer{vals: []uint16{1, 3}}, x: 2, expected: &arrayContainer{vals: []uint16{1, 3}}},
+		{name: "Array", container: &arrayContainer{vals: []uint16{1, 2, 3}}, x: 2, removed: true, expected: &arrayContainer{vals: []uint16{1, 3}}},
+		{name: "RunMissing", container: &runContainer{runs: []roaringRun{{5, 3}}}, x: 9, expected: &runContainer{runs: []roaringRun{{5, 3}}}},
+		{name: "RunSingle", container: &runContainer{runs: []roaringRun{{1, 0}, {5, 3}}}, x: 1, removed: true, expected: &runContainer{runs: []roaringRun{{5, 3}}}},
+		{name: "RunStart", container: &runContainer{runs: []roaringRun{{5, 3}}}, x: 5, removed: true, expected: &runContainer{runs: []roaringRun{{6, 2}}}},
+		{name: "RunEnd", container: &runContainer{runs: []roaringRun{{5, 3}}}, x: 8, removed: true, expected: &runContainer{runs: []roaringRun{{5, 2}}}},
+		{name: "RunSplit", container: &runContainer{runs: []roaringRun{{5, 3}, {20, 0}}}, x: 6, removed: true, expected: &runContainer{runs: []roaringRun{{5, 0}, {7, 1}, {20, 0}}}},
+		{name: "RunSplitTooMany", container: manyRuns(), x: 1, removed: true, expected: &arrayContainer{}},
+		{name: "RunSplitTooManyBig", container: bigRuns, x: 1, removed: true, expected: &bitmapContainer{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			card := tt.container.cardinality()
+			c, removed := tt.container.remove(tt.x)
+			assert.Equal(t, tt.removed, removed)
+			assert.False(t, c.contains(tt.x))
+			if removed {
+				card--
+			}
+			assert.Equal(t, card, c.cardinality())
+			switch tt.expected.(type) {
+			case *arrayContainer, *bitmapContainer:
+				assert.IsType(t, tt.expected, c)
+			default:
+				assert.Equal(t, tt.expected, c)
+			}
+		})
+	}
+
+	// Below the array limit a bitmap becomes an array again, as the portable
+	// format requires.
+	b := &bitmapContainer{}
+	for x := 0; x <= roaringArrayMax; x++ {
+		b.set(uint16(x * 3))
+	}
+	c, removed := b.remove(3)
+	assert.True(t, removed)
+	require.IsType(t, &arrayContainer{}, c)
+	assert.Equal(t, roaringArrayMax, c.cardinality())
+}
+
+func TestRoaringBitmap_remove(t *testing.T) {
+	rb := &roaringBitmap{}
+	rb.add(1)
+	rb.add(70000)
+	assert.True(t, rb.remove(70000))
+	assert.False(t, rb.remove(70000))
+	assert.False(t, rb.remove(5<<16))
+	assert.Equal(t, []uint16{0}, rb.keys, "empty containers are dropped")
+	assert.True(t, rb.remove(1))
+	assert.Empty(t, rb.keys)
+	assert.Zero(t, rb.bytes)
+}
+
+func TestRoaringBitmap_portableFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		rb       *roaringBitmap
+		expected []byte
+	}{
+		{
+			name: "Array",
+			rb: &roaringBitmap{
+				keys:       []uint16{0},
+				containers: []roaringContainer{&arrayContainer{vals: []uint16{1, 2, 3}}},
+			},
+			expected: []byte{
+				0x3a, 0x30, 0, 0, // cookie without runs
+				1, 0, 0, 0, // containers
+				0, 0, 2, 0, // key 0, cardinality 3
+				16, 0, 0, 0, // offset
+				1, 0, 2, 0, 3, 0,
+			},
+		},
+		{
+			name: "Run",
+			rb: &roaringBitmap{
+				keys:       []uint16{1},
+				containers: []roaringContainer{&runContainer{runs: []roaringRun{{start: 0, length: 99}}}},
+			},
+			expected: []byte{
+				0x3b, 0x30, 0, 0, // cookie with runs and 1 container
+				1,           // run flags
+				1, 0, 99, 0, // key 1, cardinality 100
+				1, 0, 0, 0, 99, 0, // 1 run of 100 from 0
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, tt.rb.writeTo(&buf))
+			assert.Equal(t, tt.expected, buf.Bytes())
+
+			rb, err := readRoaring(&buf)
+			require.NoError(t, err)
+			assert.Equal(t, tt.rb.keys, rb.keys)
+			assert.Equal(t, tt.rb.containers, rb.containers)
+		})
+	}
+}
+
+func TestRoaringBitmap_roundTrip(t *testing.T) {
+	// Enough containers of every kind to need offsets with runs.
+	rb := &roaringBitmap{}
+	for n := uint32(0); n < 200000; n++ {
+		rb.add(n)
+	}
+	for i := 0; i < 5000; i++ {
+		rb.add(5<<16 | uint32(i*13))
+	}
+	for i := 0; i < 100; i++ {
+		rb.add(9<<16 | uint32(i*7))
+	}
+	var buf bytes.Buffer
+	require.NoError(t, rb.writeTo(&buf))
+	read, err := readRoaring(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, rb.keys, read.keys)
+	assert.Equal(t, rb.cardinality(), read.cardinality())
+	for i := range rb.containers {
+		assert.IsType(t, rb.containers[i], read.containers[i])
+	}
+}
+
+func TestReadRoaring_errors(t *testing.T) {
+	valid := func() []byte {
+		var buf bytes.Buffer
+		rb := &roaringBitmap{}
+		rb.add(1)
+		rb.add(2)
+		require.NoError(t, rb.writeTo(&buf))
+		return buf.Bytes()
+	}()
+	wrongCardinality := append([]byte{}, valid...)
+	wrongCardinality[10] = 5
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{name: "Empty", in: nil},
+		{name: "BadCookie", in: []byte{1, 2, 3, 4, 0, 0, 0, 0}},
+		{name: "Truncated", in: valid[:len(valid)-1]},
+		{name: "WrongCardinality", in: wrongCardinality},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readRoaring(bytes.NewReader(tt.in))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestRoaringChecker_memory(t *testing.T) {
+	r := NewRecorder()
+	c := newRoaringChecker(r)
+	// A million numbers in a row fit in a handful of runs.
+	for n := uint32(0); n < 1000000; n++ {
+		c.IsUnique(123000000 + n)
+	}
+	memory := r.(*recorder).m.Load()
+	assert.NotZero(t, memory)
+	assert.Less(t, memory, uint64(2048))
+	assert.Equal(t, uint64(c.rb.size()), memory)
+	assert.Contains(t, r.getReport(), ". Checker memory: ")
+}
+
+func TestSnapshot_acrossCheckers(t *testing.T) {
+	numbers := []uint32{3, 70000, 123456789, maxNumber}
+	roaring := newRoaringChecker(&noopRecorder{})
+	for _, n := range numbers {
+		roaring.IsUnique(n)
+	}
+	var buf bytes.Buffer
+	require.NoError(t, WriteSnapshot(roaring, &buf))
+	assert.Equal(t, []byte{0x3a, 0x30}, buf.Bytes()[:2], "expected the portable roaring format")
+
+	m := newMapChecker(&noopRecorder{})
+	n, err := ReadSnapshot(m, &buf)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(len(numbers)), n)
+	for _, n := range numbers {
+		assert.False(t, m.IsUnique(n))
+	}
+
+	buf.Reset()
+	require.NoError(t, WriteSnapshot(m, &buf))
+	restored := newRoaringChecker(&noopRecorder{})
+	n, err = ReadSnapshot(restored, &buf)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(len(numbers)), n)
+	assert.Equal(t, roaring.rb.keys, restored.rb.keys)
+}
+
+func BenchmarkRoaringChecker(b *testing.B) {
+	c := newRoaringChecker(&noopRecorder{})
+	rnd := rand.New(rand.NewSource(42))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Clustered around a few thousand ranges.
+		c.IsUnique(uint32(rnd.Intn(5000))*199999 + uint32(rnd.Intn(1000)))
+	}
+	b.ReportMetric(float64(c.rb.size()), "bytes")
+}
+
+func TestRoaringBitmap_countRange(t *testing.T) {
+	var rb roaringBitmap
+	// A run container, a bitmap container and an array container.
+	for n := uint32(0); n < 10000; n++ {
+		rb.add(n)
+	}
+	for n := uint32(1 << 17); n < 1<<17+30000; n += 3 {
+		rb.add(n)
+	}
+	for _, n := range []uint32{3 << 16, 3<<16 + 7, 3<<16 + 65535} {
+		rb.add(n)
+	}
+	require.IsType(t, &runContainer{}, rb.containers[0])
+	require.IsType(t, &bitmapContainer{}, rb.containers[1])
+	require.IsType(t, &arrayContainer{}, rb.containers[2])
+
+	for _, r := range [][2]uint32{
+		{0, maxNumber}, {0, 9999}, {5, 5}, {10000, 1<<17 - 1}, {9000, 1<<17 + 100},
+		{1<<17 + 1, 1<<17 + 64}, {1<<17 + 100, 3<<16 + 7}, {3<<16 + 1, 3<<16 + 65535},
+	} {
+		expected := uint64(0)
+		rb.each(func(n uint32) bool {
+			if n >= r[0] && n <= r[1] {
+				expected++
+			}
+			return true
+		})
+		assert.Equal(t, expected, rb.countRange(r[0], r[1]), "%v-%v", r[0], r[1])
+	}
+}
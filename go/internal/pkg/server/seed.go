@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// seedProgressLines is how many lines of a seed file are loaded between
+// progress reports.
+const seedProgressLines = 1 << 20
+
+// maxSeedErrors is how many invalid lines are described in a summary.
+const maxSeedErrors = 10
+
+var errSeedUnsupported = errors.New("number checker does not support seeding")
+
+// SeedProgress is how far loading a seed file got.
+type SeedProgress struct {
+	File string
+	// Read and Size are the bytes read so far and in the whole file.
+	Read, Size int64
+	Loaded     uint64
+	Skipped    uint64
+}
+
+// SeedSummary is what loading a seed file did. A snapshot seed only counts
+// the numbers it holds as loaded.
+type SeedSummary struct {
+	File       string
+	Loaded     uint64
+	Duplicates uint64
+	Invalid    uint64
+	// Errors describes the first invalid lines.
+	Errors []string
+}
+
+func (s SeedSummary) String() string {
+	return fmt.Sprintf("Seeded %v numbers from %s, skipped %v duplicates and %v invalid lines",
+		s.Loaded, s.File, s.Duplicates, s.Invalid)
+}
+
+// LoadSeed marks the numbers of file as seen, so they are duplicates from
+// the first one received. The file is either a snapshot or a list of
+// numbers in the numbers.log format, nine digits per line, whose invalid
+// lines are skipped. progress, when not nil, is called as the file is read
+// and once it is done.
+func LoadSeed(nc NumberChecker, file string, progress func(SeedProgress)) (SeedSummary, error) {
+	summary := SeedSummary{File: file}
+	f, err := os.Open(file)
+	if err != nil {
+		return summary, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return summary, err
+	}
+	or := &offsetReader{r: f}
+	br := bufio.NewReader(or)
+	p := SeedProgress{File: file, Size: info.Size()}
+	report := func() {
+		if progress != nil {
+			p.Read = or.n - int64(br.Buffered())
+			p.Loaded, p.Skipped = summary.Loaded, summary.Duplicates+summary.Invalid
+			progress(p)
+		}
+	}
+
+	if isSnapshot(br) {
+		summary.Loaded, err = ReadSnapshot(nc, br)
+		report()
+		return summary, err
+	}
+	r, ok := baseChecker(nc).(restorer)
+	if !ok {
+		return summary, errSeedUnsupported
+	}
+	s := bufio.NewScanner(br)
+	for line := 1; s.Scan(); line++ {
+		v := string(bytes.TrimSuffix(s.Bytes(), []byte("\r")))
+		if v == "" {
+			continue
+		}
+		n, err := parseNumber(v)
+		switch {
+		case err != nil:
+			summary.Invalid++
+			if len(summary.Errors) < maxSeedErrors {
+				summary.Errors = append(summary.Errors, fmt.Sprintf("line %v: %v", line, err))
+			}
+		case r.restore(n):
+			summary.Loaded++
+		default:
+			summary.Duplicates++
+		}
+		if line%seedProgressLines == 0 {
+			report()
+		}
+	}
+	if err := s.Err(); err != nil {
+		return summary, err
+	}
+	report()
+	return summary, nil
+}
+
+// isSnapshot reports whether r starts like a snapshot in any of the formats
+// ReadSnapshot knows.
+func isSnapshot(r *bufio.Reader) bool {
+	magic, _ := r.Peek(len(snapshotMagic))
+	if bytes.Equal(magic, snapshotMagic) || bytes.Equal(magic, bloomMagic) {
+		return true
+	}
+	if len(magic) < 4 {
+		return false
+	}
+	cookie := uint32(magic[0]) | uint32(magic[1])<<8 | uint32(magic[2])<<16 | uint32(magic[3])<<24
+	return cookie == roaringCookieNoRuns || cookie&0xffff == roaringCookie
+}
+
+// offsetReader keeps track of how far into r it has read.
+type offsetReader struct {
+	r io.Reader
+	n int64
+}
+
+func (o *offsetReader) Read(p []byte) (int, error) {
+	n, err := o.r.Read(p)
+	o.n += int64(n)
+	return n, err
+}
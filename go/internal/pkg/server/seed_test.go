@@ -0,0 +1,132 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeSeed(t *testing.T, contents []byte) string {
+	dir, err := ioutil.TempDir("", "Seed")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	file := filepath.Join(dir, "numbers.seed")
+	require.NoError(t, ioutil.WriteFile(file, contents, 0644))
+	return file
+}
+
+func TestLoadSeed_text(t *testing.T) {
+	file := writeSeed(t, []byte("000000042\r\n000001337\n\nabc\n000000042\n12345\n999999999\n1234567890\n"))
+	r := NewRecorder()
+	nc := newMapChecker(r)
+	var progress []SeedProgress
+	summary, err := LoadSeed(nc, file, func(p SeedProgress) {
+		progress = append(progress, p)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, SeedSummary{
+		File:       file,
+		Loaded:     3,
+		Duplicates: 1,
+		Invalid:    3,
+		Errors: []string{
+			`line 4: invalid number "abc"`,
+			`line 6: invalid number "12345"`,
+			`line 8: invalid number "1234567890"`,
+		},
+	}, summary)
+	assert.Equal(t, fmt.Sprintf("Seeded 3 numbers from %s, skipped 1 duplicates and 3 invalid lines", file), summary.String())
+	assert.Equal(t, []SeedProgress{{File: file, Read: 63, Size: 63, Loaded: 3, Skipped: 4}}, progress)
+
+	for _, n := range []uint32{42, 1337, maxNumber} {
+		assert.False(t, nc.IsUnique(n))
+	}
+	assert.Equal(t, "Received 0 unique numbers, 3 duplicates. Unique total: 3", r.getReport())
+}
+
+func TestLoadSeed_progress(t *testing.T) {
+	var b strings.Builder
+	for i := 0; i < seedProgressLines+10; i++ {
+		fmt.Fprintf(&b, "%09d\n", i)
+	}
+	file := writeSeed(t, []byte(b.String()))
+	var progress []SeedProgress
+	summary, err := LoadSeed(newPagedChecker(&noopRecorder{}), file, func(p SeedProgress) {
+		progress = append(progress, p)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(seedProgressLines+10), summary.Loaded)
+	require.Len(t, progress, 2)
+	assert.Equal(t, uint64(seedProgressLines), progress[0].Loaded)
+	assert.Less(t, progress[0].Read, progress[0].Size)
+	assert.Equal(t, progress[1].Size, progress[1].Read)
+}
+
+func TestLoadSeed_tooManyErrors(t *testing.T) {
+	file := writeSeed(t, []byte(strings.Repeat("x\n", 2*maxSeedErrors)))
+	summary, err := LoadSeed(newMapChecker(&noopRecorder{}), file, nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2*maxSeedErrors), summary.Invalid)
+	assert.Len(t, summary.Errors, maxSeedErrors)
+}
+
+func TestLoadSeed_snapshot(t *testing.T) {
+	sharded := func() NumberChecker { return newShardedChecker(&noopRecorder{}, 4) }
+	bloom := func() NumberChecker { return newTestBloomChecker(t, &noopRecorder{}, 1000, 0.01) }
+	tests := []struct {
+		name string
+		src  NumberChecker
+		dst  func() NumberChecker
+	}{
+		{name: "Snapshot", src: newMapChecker(&noopRecorder{}), dst: sharded},
+		{name: "Roaring", src: newRoaringChecker(&noopRecorder{}), dst: sharded},
+		{name: "SnapshotIntoBloom", src: newMapChecker(&noopRecorder{}), dst: bloom},
+		{name: "RoaringIntoBloom", src: newRoaringChecker(&noopRecorder{}), dst: bloom},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.src.IsUnique(7)
+			tt.src.IsUnique(123456789)
+			var buf bytes.Buffer
+			require.NoError(t, WriteSnapshot(tt.src, &buf))
+			file := writeSeed(t, buf.Bytes())
+
+			dst := tt.dst()
+			calls := 0
+			summary, err := LoadSeed(dst, file, func(p SeedProgress) {
+				calls++
+				assert.Equal(t, p.Size, p.Read)
+			})
+			require.NoError(t, err)
+			assert.Equal(t, SeedSummary{File: file, Loaded: 2}, summary)
+			assert.Equal(t, 1, calls)
+			assert.False(t, dst.IsUnique(123456789))
+		})
+	}
+}
+
+func TestLoadSeed_checkers(t *testing.T) {
+	file := writeSeed(t, []byte("000000001\n000000002\n"))
+	bloom := newTestBloomChecker(t, &noopRecorder{}, 1000, 0.01)
+	counting, err := newCountingChecker(newMapChecker(&noopRecorder{}), "exact", 0)
+	require.NoError(t, err)
+	for _, nc := range []NumberChecker{bloom, counting} {
+		summary, err := LoadSeed(nc, file, nil)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(2), summary.Loaded)
+		assert.False(t, nc.IsUnique(2))
+	}
+
+	_, err = LoadSeed(&mockRepo{}, file, nil)
+	assert.Equal(t, errSeedUnsupported, err)
+	_, err = LoadSeed(newMapChecker(&noopRecorder{}), file+".missing", nil)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -2,48 +2,247 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"golang.org/x/net/netutil"
 	"net"
+	"os"
+	"sync"
 	"time"
 )
 
 type listening struct {
-	listener        net.Listener
+	listeners       []net.Listener
+	raws            []net.Listener
+	extra           []net.Listener
+	acceptors       int
 	connectionCount int
 	h               handleConn
 	host            string
 	port            int
 	tickerDuration  time.Duration
+	overflow        OverflowPolicy
+	maxWait         time.Duration
+	maxWaiting      int
+	r               Recorder
+	access          AccessControl
+	trustedProxies  []*net.IPNet
+	resumed         []net.Conn
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	paused bool
 }
 
 func NewServer(connectionCount int, host string, port int, handler handleConn, tickerDuration time.Duration) *listening {
 	return &listening{
+		acceptors:       1,
 		connectionCount: connectionCount,
 		h:               handler,
 		host:            host,
 		port:            port,
 		tickerDuration:  tickerDuration,
+		maxWaiting:      DefaultMaxWaiting,
 	}
 }
 
+// SetOverflowPolicy configures how connections beyond connectionCount are
+// treated. maxWait is only used by OverflowWait and rejected connections are
+// counted by the given Recorder.
+func (l *listening) SetOverflowPolicy(policy OverflowPolicy, maxWait time.Duration, r Recorder) {
+	l.overflow = policy
+	l.maxWait = maxWait
+	l.r = r
+}
+
+// SetMaxWaiting limits the connections waiting for a slot with
+// OverflowWait across all listeners, the others are rejected.
+func (l *listening) SetMaxWaiting(n int) {
+	l.maxWaiting = n
+}
+
+// SetAccessControl makes every accepted connection pass the given access
+// rules before it is handled.
+func (l *listening) SetAccessControl(ac AccessControl) {
+	l.access = ac
+}
+
+// SetProxyProtocol expects a PROXY protocol v1 or v2 header on every
+// connection from the trusted proxies and uses the client address it carries.
+func (l *listening) SetProxyProtocol(trusted []*net.IPNet) {
+	l.trustedProxies = trusted
+}
+
+// SetListeners makes Start use already open listeners, such as the ones
+// passed in by systemd, instead of opening host:port.
+func (l *listening) SetListeners(listeners ...net.Listener) {
+	l.raws = listeners
+}
+
+// AddListeners makes Start accept connections on listeners besides the ones
+// on host:port. Like those, they are passed to a successor.
+func (l *listening) AddListeners(listeners ...net.Listener) {
+	l.extra = append(l.extra, listeners...)
+}
+
+// SetAcceptors opens n listeners on host:port with SO_REUSEPORT, each with
+// its own accept loop, so the kernel spreads new connections across them.
+// connectionCount still applies to all of them together.
+func (l *listening) SetAcceptors(n int) {
+	l.acceptors = n
+}
+
+// ResumeConns makes Process serve connections handed over by a previous
+// process. They take connection slots like the ones accepted.
+func (l *listening) ResumeConns(conns ...net.Conn) {
+	l.resumed = append(l.resumed, conns...)
+}
+
 func (l *listening) Start() (err error) {
-	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%v", l.host, l.port))
-	if err != nil {
-		return err
+	if len(l.raws) == 0 {
+		l.raws, err = l.listen()
+		if err != nil {
+			return err
+		}
+	}
+	l.raws = append(l.raws, l.extra...)
+	sem := make(chan struct{}, l.connectionCount)
+	waiting := make(chan struct{}, l.maxWaiting)
+	l.listeners = make([]net.Listener, len(l.raws))
+	for i, raw := range l.raws {
+		l.listeners[i] = newLimitListener(raw, sem, waiting, l.overflow, l.maxWait, l.r)
+	}
+	for i, conn := range l.resumed {
+		// Connections beyond the limit are served all the same, they were
+		// accepted already.
+		select {
+		case sem <- struct{}{}:
+			l.resumed[i] = &releaseConn{Conn: conn, release: func() { <-sem }}
+		default:
+		}
 	}
-	l.listener = netutil.LimitListener(listener, l.connectionCount)
 	return err
 }
 
+func (l *listening) listen() ([]net.Listener, error) {
+	addr := fmt.Sprintf("%s:%v", l.host, l.port)
+	if l.acceptors <= 1 {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	}
+	raws := make([]net.Listener, 0, l.acceptors)
+	for i := 0; i < l.acceptors; i++ {
+		ln, err := listenReusePort(addr)
+		if err != nil {
+			for _, opened := range raws {
+				_ = opened.Close()
+			}
+			return nil, err
+		}
+		raws = append(raws, ln)
+		// Port 0 has to resolve to the same port for every listener.
+		addr = ln.Addr().String()
+	}
+	return raws, nil
+}
+
 func (l *listening) Stop() (err error) {
-	return l.listener.Close()
+	for _, ln := range l.listeners {
+		if errClose := ln.Close(); errClose != nil && err == nil {
+			err = errClose
+		}
+	}
+	return err
+}
+
+// ListenerFiles returns duplicates of the listening sockets that keep them
+// open after this process stops, so they can be passed to a successor.
+func (l *listening) ListenerFiles() ([]*os.File, error) {
+	files := make([]*os.File, 0, len(l.raws))
+	for _, raw := range l.raws {
+		ln, ok := raw.(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, errors.New("listener cannot be handed over")
+		}
+		f, err := ln.File()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// Shutdown stops accepting and disconnects every producer. Process returns
+// once all of their handlers have finished.
+func (l *listening) Shutdown() error {
+	l.mu.Lock()
+	cancel := l.cancel
+	l.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	return l.Stop()
+}
+
+// Pause stops accepting and has every handler stop reading from its
+// connection at a line boundary, without closing it. Process returns once
+// they all have, and PausedConns then returns the connections to hand over.
+func (l *listening) Pause() error {
+	p, ok := l.h.(pauser)
+	if !ok {
+		return errors.New("connections cannot be handed over")
+	}
+	l.mu.Lock()
+	l.paused = true
+	l.mu.Unlock()
+	p.pause()
+	return l.Stop()
+}
+
+// PausedConns returns the connections paused by Pause.
+func (l *listening) PausedConns() []HandedConn {
+	if p, ok := l.h.(pauser); ok {
+		return p.pausedConns()
+	}
+	return nil
+}
+
+func (l *listening) isPaused() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.paused
 }
 
 func (l *listening) Process() (err error) {
 	ctx, cancel := context.WithCancel(context.Background())
-	c := make(chan net.Conn, 1)
-	e := make(chan error, 1)
+	l.mu.Lock()
+	l.cancel = cancel
+	l.mu.Unlock()
+
+	// accepting makes sure no handler is added once Process has started
+	// waiting for them.
+	accepting := sync.Mutex{}
+	closing := false
+	handlers := sync.WaitGroup{}
+	defer func() {
+		// Paused handlers return on their own, keeping their connections.
+		paused := l.isPaused()
+		if !paused {
+			cancel()
+		}
+		accepting.Lock()
+		closing = true
+		accepting.Unlock()
+		handlers.Wait()
+		cancel()
+		if d, ok := l.h.(drainer); ok {
+			d.drain()
+		}
+	}()
+	e := make(chan error, len(l.listeners))
 	ticker := time.NewTicker(l.tickerDuration)
 
 	go func() {
@@ -58,29 +257,99 @@ func (l *listening) Process() (err error) {
 		}
 	}()
 
-	for {
-		go func() {
-			conn, err := l.listener.Accept()
-			if err != nil {
-				e <- err
-			} else {
-				c <- conn
+	serve := func(cn net.Conn) {
+		defer handlers.Done()
+		if err := l.h.handle(ctx, cancel, cn); err != nil {
+			select {
+			case e <- err:
+			case <-ctx.Done():
 			}
-		}()
-		select {
-		case <-ctx.Done():
-			return nil
-		case conn := <-c:
-			go func(cn net.Conn) {
-				if err := l.h.handle(ctx, cancel, cn); err != nil {
-					e <- err
+		}
+	}
+	handlers.Add(len(l.resumed))
+	for _, conn := range l.resumed {
+		go func(cn net.Conn) {
+			cn, ok := l.allow(cn)
+			if !ok {
+				handlers.Done()
+				return
+			}
+			serve(cn)
+		}(conn)
+	}
+	l.resumed = nil
+
+	for _, ln := range l.listeners {
+		go func(ln net.Listener) {
+			for ctx.Err() == nil {
+				conn, err := ln.Accept()
+				if err != nil {
+					select {
+					case e <- err:
+					case <-ctx.Done():
+					}
+					return
+				}
+				accepting.Lock()
+				if closing || ctx.Err() != nil {
+					accepting.Unlock()
+					_ = conn.Close()
+					return
 				}
-			}(conn)
-		case err := <-e:
-			if err != nil {
-				fmt.Println(err)
-				return err
+				handlers.Add(1)
+				accepting.Unlock()
+				go func(cn net.Conn) {
+					cn, ok := l.admit(cn)
+					if !ok {
+						handlers.Done()
+						return
+					}
+					serve(cn)
+				}(conn)
+			}
+		}(ln)
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-e:
+		if ctx.Err() != nil || l.isPaused() {
+			// Shutdown or Pause closed the listeners.
+			return nil
+		}
+		fmt.Println(err)
+		return err
+	}
+}
+
+func (l *listening) admit(conn net.Conn) (net.Conn, bool) {
+	if len(l.trustedProxies) > 0 {
+		pc, err := acceptProxy(conn, l.trustedProxies)
+		if err != nil {
+			fmt.Printf("Invalid PROXY header from %s: %v\n", conn.RemoteAddr(), err)
+			if errConn := conn.Close(); errConn != nil {
+				fmt.Println(errConn)
 			}
+			return nil, false
+		}
+		conn = pc
+	}
+	return l.allow(conn)
+}
+
+// allow applies the access rules to a connection.
+func (l *listening) allow(conn net.Conn) (net.Conn, bool) {
+	if l.access == nil {
+		return conn, true
+	}
+	release, err := l.access.admit(conn.RemoteAddr())
+	if err != nil {
+		fmt.Printf("Denied connection from %s: %v\n", conn.RemoteAddr(), err)
+		if errConn := conn.Close(); errConn != nil {
+			fmt.Println(errConn)
 		}
+		return nil, false
 	}
+	return &releaseConn{Conn: conn, release: release}, true
 }
@@ -22,7 +22,7 @@ func TestStartAndStop(t *testing.T) {
 func TestStopReturnsError(t *testing.T) {
 	l := NewServer(1, "127.0.0.1", 0, &handler{}, time.Minute)
 	ml := new(mockListener)
-	l.listener = ml
+	l.listeners = []net.Listener{ml}
 	expectedErr := errors.New("some error")
 	ml.On("Close").Return(expectedErr)
 	assert.EqualError(t, l.Stop(), "some error")
@@ -32,12 +32,12 @@ func TestProcess(t *testing.T) {
 	ml := new(mockListener)
 	hm := new(mockHandleConn)
 	l := &listening{
-		listener:       ml,
+		listeners:      []net.Listener{ml},
 		h:              hm,
 		tickerDuration: time.Minute,
 	}
 	var once sync.Once
-	ml.On("Accept").Return(getConn(), nil)
+	ml.On("Accept").Return(getConn, nil)
 	hm.On("handle", mock.Anything, mock.AnythingOfType("context.CancelFunc"), mock.Anything).Return(nil).
 		Run(func(args mock.Arguments) {
 			once.Do(args.Get(1).(context.CancelFunc))
@@ -52,11 +52,11 @@ func TestProcess_handle_error(t *testing.T) {
 	ml := new(mockListener)
 	hm := new(mockHandleConn)
 	l := &listening{
-		listener:       ml,
+		listeners:      []net.Listener{ml},
 		h:              hm,
 		tickerDuration: time.Minute,
 	}
-	ml.On("Accept").Return(getConn(), nil)
+	ml.On("Accept").Return(getConn, nil)
 	hm.On("handle", mock.Anything, mock.AnythingOfType("context.CancelFunc"), mock.Anything).Return(errors.New("some error"))
 	err := l.Process()
 	assert.Errorf(t, err, "some error", "expected an error")
@@ -68,7 +68,7 @@ func TestProcess_accept_error(t *testing.T) {
 	ml := new(mockListener)
 	hm := new(mockHandleConn)
 	l := &listening{
-		listener:       ml,
+		listeners:      []net.Listener{ml},
 		h:              hm,
 		tickerDuration: time.Minute,
 	}
@@ -83,7 +83,7 @@ func TestProcess_tick(t *testing.T) {
 	ml := new(mockListener)
 	hm := new(mockHandleConn)
 	l := &listening{
-		listener:       ml,
+		listeners:      []net.Listener{ml},
 		h:              hm,
 		tickerDuration: time.Second,
 	}
@@ -91,7 +91,7 @@ func TestProcess_tick(t *testing.T) {
 	asertWg := sync.WaitGroup{}
 	asertWg.Add(1)
 
-	ml.On("Accept").Return(getConn(), nil)
+	ml.On("Accept").Return(getConn, nil)
 	var printOne = sync.Once{}
 	hm.On("printReport").Return().Run(func(args mock.Arguments) {
 		defer printOne.Do(asertWg.Done)
@@ -122,6 +122,9 @@ type mockListener struct {
 
 func (m *mockListener) Accept() (net.Conn, error) {
 	args := m.Called()
+	if f, ok := args.Get(0).(func() net.Conn); ok {
+		return f(), args.Error(1)
+	}
 	return args.Get(0).(net.Conn), args.Error(1)
 }
 
@@ -146,3 +149,121 @@ func (m *mockHandleConn) printReport() {
 func (m *mockHandleConn) handle(ctx context.Context, cancel context.CancelFunc, conn net.Conn) error {
 	return m.Called(ctx, cancel, conn).Error(0)
 }
+
+func TestAdmit(t *testing.T) {
+	l := NewServer(1, "127.0.0.1", 0, &handler{}, time.Minute)
+	cn, ok := l.admit(getConn())
+	assert.True(t, ok, "expected connection to be admitted without access rules")
+	assert.NotNil(t, cn)
+
+	mr := &mockRecorder{}
+	mr.On("markDenied").Return()
+	l.SetAccessControl(newTestAccessControl(t, "allow 10.0.0.0/8", mr))
+	s, c := net.Pipe()
+	defer s.Close()
+	cn, ok = l.admit(c)
+	assert.False(t, ok, "expected connection to be denied")
+	assert.Nil(t, cn)
+	_, err := s.Write([]byte("000000001\n"))
+	assert.Error(t, err, "expected denied connection to be closed")
+	mr.AssertExpectations(t)
+}
+
+func TestAdmit_proxyProtocol(t *testing.T) {
+	l := NewServer(1, "127.0.0.1", 0, &handler{}, time.Minute)
+	trusted, err := ParseTrustedProxies("127.0.0.1")
+	assert.NoError(t, err)
+	l.SetProxyProtocol(trusted)
+	mr := &mockRecorder{}
+	mr.On("markDenied").Return()
+	l.SetAccessControl(newTestAccessControl(t, "deny 203.0.113.7", mr))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	for _, header := range []string{"000000001\n", "PROXY TCP4 203.0.113.7 10.0.0.1 51000 4000\r\n"} {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		assert.NoError(t, err)
+		_, err = client.Write([]byte(header))
+		assert.NoError(t, err)
+		assert.NoError(t, client.(*net.TCPConn).CloseWrite())
+		conn, err := ln.Accept()
+		assert.NoError(t, err)
+		cn, ok := l.admit(conn)
+		assert.False(t, ok, "expected %q to be refused", header)
+		assert.Nil(t, cn)
+		assert.NoError(t, client.Close())
+	}
+	mr.AssertNumberOfCalls(t, "markDenied", 1)
+}
+
+func TestSetListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	l := NewServer(1, "127.0.0.1", 1, &handler{}, time.Minute)
+	l.SetListeners(ln)
+	assert.NoError(t, l.Start())
+	assert.Len(t, l.listeners, 1)
+	assert.Equal(t, ln.Addr(), l.listeners[0].Addr())
+
+	files, err := l.ListenerFiles()
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	assert.NoError(t, l.Stop())
+	fl, err := net.FileListener(files[0])
+	assert.NoError(t, err, "expected duplicate to keep the socket listening")
+	assert.NoError(t, files[0].Close())
+	c, err := net.Dial("tcp", ln.Addr().String())
+	assert.NoError(t, err)
+	assert.NoError(t, c.Close())
+	assert.NoError(t, fl.Close())
+
+	l.SetListeners(new(mockListener))
+	_, err = l.ListenerFiles()
+	assert.Error(t, err)
+}
+
+func TestAddListeners(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	l := NewServer(1, "127.0.0.1", 0, &handler{}, time.Minute)
+	l.AddListeners(ln)
+	assert.NoError(t, l.Start())
+	assert.Len(t, l.listeners, 2, "expected host:port to be listened on as well")
+	assert.Equal(t, ln.Addr(), l.listeners[1].Addr())
+
+	files, err := l.ListenerFiles()
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+	for _, f := range files {
+		assert.NoError(t, f.Close())
+	}
+	assert.NoError(t, l.Stop())
+}
+
+func TestShutdown(t *testing.T) {
+	l := NewServer(1, "127.0.0.1", 0, nil, time.Minute)
+	hm := new(mockHandleConn)
+	l.h = hm
+	handling := make(chan struct{})
+	hm.On("handle", mock.Anything, mock.AnythingOfType("context.CancelFunc"), mock.Anything).Return(nil).
+		Run(func(args mock.Arguments) {
+			close(handling)
+			<-args.Get(0).(context.Context).Done()
+		})
+	assert.NoError(t, l.Start())
+
+	done := make(chan error, 1)
+	go func() {
+		done <- l.Process()
+	}()
+	c, err := net.Dial("tcp", l.listeners[0].Addr().String())
+	assert.NoError(t, err)
+	defer c.Close()
+	<-handling
+
+	assert.NoError(t, l.Shutdown())
+	assert.NoError(t, <-done)
+	hm.AssertExpectations(t)
+}
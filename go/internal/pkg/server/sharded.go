@@ -0,0 +1,195 @@
+package server
+
+import (
+	"sort"
+	"sync"
+)
+
+// DefaultShards is the number of shards used when none are configured.
+const DefaultShards = 64
+
+// shardedSet spreads the keys seen over maps that each have their own lock,
+// so connections only contend when their keys hash to the same shard. It
+// only holds the keys actually seen.
+type shardedSet[K comparable] struct {
+	shards []mapShard[K]
+	shift  uint32
+	// hash picks the shard of a key from its top bits.
+	hash func(k K) uint64
+	r    Recorder
+}
+
+type mapShard[K comparable] struct {
+	mu sync.Mutex
+	tm map[K]struct{}
+	// Keeps the locks of neighbouring shards on different cache lines.
+	_ [48]byte
+}
+
+// newShardedSet creates a set with shards rounded up to a power of two.
+func newShardedSet[K comparable](r Recorder, shards int, hash func(k K) uint64) *shardedSet[K] {
+	bits := uint32(0)
+	for 1<<bits < shards {
+		bits++
+	}
+	c := &shardedSet[K]{
+		shards: make([]mapShard[K], 1<<bits),
+		shift:  64 - bits,
+		hash:   hash,
+		r:      r,
+	}
+	for i := range c.shards {
+		c.shards[i].tm = make(map[K]struct{})
+	}
+	return c
+}
+
+func (c *shardedSet[K]) shard(k K) int {
+	return int(c.hash(k) >> c.shift)
+}
+
+func (c *shardedSet[K]) IsUnique(k K) (unique bool) {
+	s := &c.shards[c.shard(k)]
+	s.mu.Lock()
+	unique = s.mark(k)
+	s.mu.Unlock()
+	c.record(unique)
+	return unique
+}
+
+// IsUniqueBatch groups the keys by shard so each shard is locked once.
+func (c *shardedSet[K]) IsUniqueBatch(ks []K, out []bool) {
+	order := make([]uint64, len(ks))
+	for i, k := range ks {
+		order[i] = uint64(c.shard(k))<<32 | uint64(i)
+	}
+	sort.Sort(packedNumbers(order))
+	for start := 0; start < len(order); {
+		shard := order[start] >> 32
+		s := &c.shards[shard]
+		s.mu.Lock()
+		end := start
+		for ; end < len(order) && order[end]>>32 == shard; end++ {
+			i := uint32(order[end])
+			out[i] = s.mark(ks[i])
+		}
+		s.mu.Unlock()
+		start = end
+	}
+	for _, unique := range out[:len(ks)] {
+		c.record(unique)
+	}
+}
+
+func (c *shardedSet[K]) record(unique bool) {
+	if unique {
+		c.r.markUnique()
+	} else {
+		c.r.markDuplicate()
+	}
+}
+
+func (c *shardedSet[K]) GetReport() string {
+	return c.r.getReport()
+}
+
+// Reset empties the shards one at a time, so keys received meanwhile may or
+// may not be kept.
+func (c *shardedSet[K]) Reset() {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		s.tm = make(map[K]struct{})
+		s.mu.Unlock()
+	}
+	c.r.markReset()
+}
+
+func (c *shardedSet[K]) Forget(k K) (forgotten bool) {
+	s := &c.shards[c.shard(k)]
+	s.mu.Lock()
+	_, forgotten = s.tm[k]
+	delete(s.tm, k)
+	s.mu.Unlock()
+	if forgotten {
+		c.r.markForgotten()
+	}
+	return forgotten
+}
+
+// walkKeys holds the lock of one shard at a time.
+func (c *shardedSet[K]) walkKeys(fn func(k K) bool) {
+	var seen []K
+	for i := range c.shards {
+		s := &c.shards[i]
+		seen = seen[:0]
+		s.mu.Lock()
+		for k := range s.tm {
+			seen = append(seen, k)
+		}
+		s.mu.Unlock()
+		for _, k := range seen {
+			if !fn(k) {
+				return
+			}
+		}
+	}
+}
+
+func (c *shardedSet[K]) restoreKey(k K) (restored bool) {
+	s := &c.shards[c.shard(k)]
+	s.mu.Lock()
+	restored = s.mark(k)
+	s.mu.Unlock()
+	if restored {
+		c.r.markRestored()
+	}
+	return restored
+}
+
+// mark adds k to the shard and reports whether it was new. The shard lock
+// has to be held.
+func (s *mapShard[K]) mark(k K) bool {
+	if _, ok := s.tm[k]; ok {
+		return false
+	}
+	s.tm[k] = struct{}{}
+	return true
+}
+
+// shardedChecker is the sharded set of nine digit numbers.
+type shardedChecker struct {
+	*shardedSet[uint32]
+}
+
+// newShardedChecker creates a checker with shards rounded up to a power of
+// two.
+func newShardedChecker(r Recorder, shards int) *shardedChecker {
+	return &shardedChecker{newShardedSet(r, shards, fibonacciHash)}
+}
+
+// fibonacciHash spreads runs of consecutive numbers across every shard.
+func fibonacciHash(n uint32) uint64 {
+	return uint64(n*2654435769) << 32
+}
+
+// walk goes through the numbers in ascending order.
+func (c *shardedChecker) walk(fn func(n uint32) bool) {
+	var seen []uint32
+	c.walkKeys(func(n uint32) bool {
+		seen = append(seen, n)
+		return true
+	})
+	sort.Slice(seen, func(i, j int) bool {
+		return seen[i] < seen[j]
+	})
+	for _, n := range seen {
+		if !fn(n) {
+			return
+		}
+	}
+}
+
+func (c *shardedChecker) restore(n uint32) (restored bool) {
+	return c.restoreKey(n)
+}
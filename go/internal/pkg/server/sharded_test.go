@@ -0,0 +1,117 @@
+package server
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestAddOkaySharded(t *testing.T) {
+	mr := &mockRecorder{}
+	mr.On("markUnique").Return()
+	testAddOkay(t, newShardedChecker(mr, 4))
+}
+
+func TestAddDuplicateSharded(t *testing.T) {
+	mr := &mockRecorder{}
+	mr.On("markUnique").Return()
+	mr.On("markDuplicate").Return()
+	testAddDuplicate(t, newShardedChecker(mr, 4))
+}
+
+func TestNewShardedChecker(t *testing.T) {
+	tests := []struct {
+		shards, expected int
+	}{
+		{shards: 0, expected: 1},
+		{shards: 1, expected: 1},
+		{shards: 3, expected: 4},
+		{shards: 64, expected: 64},
+		{shards: 100, expected: 128},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.shards), func(t *testing.T) {
+			c := newShardedChecker(&noopRecorder{}, tt.shards)
+			assert.Len(t, c.shards, tt.expected)
+			for n := uint32(0); n < 1000; n++ {
+				assert.Less(t, c.shard(n), tt.expected)
+			}
+		})
+	}
+}
+
+func TestShardedChecker_spread(t *testing.T) {
+	c := newShardedChecker(&noopRecorder{}, 16)
+	for n := uint32(0); n < 16000; n++ {
+		c.IsUnique(n)
+	}
+	// Consecutive numbers end up evenly spread.
+	for i := range c.shards {
+		assert.InDelta(t, 1000, len(c.shards[i].tm), 100, "shard %v", i)
+	}
+}
+
+func TestNewNumberCheckerWith(t *testing.T) {
+	tests := []struct {
+		cfg      CheckerConfig
+		expected interface{}
+	}{
+		{cfg: CheckerConfig{Kind: "paged"}, expected: &pagedChecker{}},
+		{cfg: CheckerConfig{Kind: "map"}, expected: &checker{}},
+		{cfg: CheckerConfig{Kind: "sharded"}, expected: &shardedChecker{}},
+		{cfg: CheckerConfig{Kind: "sharded", Shards: 8}, expected: &shardedChecker{}},
+		{cfg: CheckerConfig{Kind: "adaptive", DenseThreshold: 100}, expected: &adaptiveChecker{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cfg.Kind, func(t *testing.T) {
+			nc, err := NewNumberCheckerWith(tt.cfg, &noopRecorder{})
+			require.NoError(t, err)
+			assert.IsType(t, tt.expected, nc)
+		})
+	}
+	nc, err := NewNumberCheckerWith(CheckerConfig{Kind: "sharded"}, &noopRecorder{})
+	require.NoError(t, err)
+	assert.Len(t, nc.(*shardedChecker).shards, DefaultShards)
+
+	_, err = NewNumberCheckerWith(CheckerConfig{Kind: "tree"}, &noopRecorder{})
+	assert.EqualError(t, err, `unknown checker "tree"`)
+}
+
+// BenchmarkConcurrentCheckers checks random numbers from 1 to 64
+// connections at once. Each op is one number.
+func BenchmarkConcurrentCheckers(b *testing.B) {
+	checkers := []struct {
+		name    string
+		checker func() NumberChecker
+	}{
+		{"Map", func() NumberChecker { return newMapChecker(&noopRecorder{}) }},
+		{"Sharded", func() NumberChecker { return newShardedChecker(&noopRecorder{}, DefaultShards) }},
+	}
+	ns := make([]uint32, 1<<20)
+	for i := range ns {
+		ns[i] = uint32(rand.Intn(numberSpace))
+	}
+	for _, bm := range checkers {
+		for _, conns := range []int{1, 4, 16, 64} {
+			b.Run(fmt.Sprintf("%s/Conns%v", bm.name, conns), func(b *testing.B) {
+				c := bm.checker()
+				per := b.N/conns + 1
+				wg := sync.WaitGroup{}
+				wg.Add(conns)
+				b.ResetTimer()
+				for i := 0; i < conns; i++ {
+					go func(offset int) {
+						defer wg.Done()
+						for j := 0; j < per; j++ {
+							c.IsUnique(ns[(offset+j)%len(ns)])
+						}
+					}(i * len(ns) / conns)
+				}
+				wg.Wait()
+			})
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A snapshot holds every number seen by a NumberChecker in ascending order:
+// the snapshotMagic header, one uvarint per number holding its distance from
+// the previous one (the first is measured from -1 so no distance is ever 0),
+// a 0 terminator and finally the uvarint count of numbers as a checksum.
+//
+// The roaring checker writes its snapshots in the portable roaring format
+// instead. Snapshots in either format can be read into any checker. The
+// bloom checker has no numbers to walk, so it snapshots its bits, which can
+// only be read into a bloom checker of the same size. A bloom checker reads
+// the other formats too.
+var snapshotMagic = []byte("NLSNAP01")
+
+var errSnapshotUnsupported = errors.New("number checker does not support snapshots")
+
+// snapshotter is implemented by the checkers whose state can be saved and
+// restored.
+type snapshotter interface {
+	// walk calls fn for every seen number in ascending order until fn
+	// returns false.
+	walk(fn func(n uint32) bool)
+	restorer
+}
+
+// restorer is implemented by the checkers numbers can be loaded into.
+type restorer interface {
+	// restore marks n as seen without counting it as a received number and
+	// reports whether it was new.
+	restore(n uint32) (restored bool)
+}
+
+func WriteSnapshot(nc NumberChecker, w io.Writer) error {
+	nc = baseChecker(nc)
+	if rc, ok := nc.(*roaringChecker); ok {
+		return rc.writeSnapshot(w)
+	}
+	if bc, ok := nc.(*bloomChecker); ok {
+		return bc.writeSnapshot(w)
+	}
+	s, ok := nc.(snapshotter)
+	if !ok {
+		return errSnapshotUnsupported
+	}
+	_, err := writeDeltas(s, w)
+	return err
+}
+
+// ReadSnapshot restores the numbers of a snapshot into the checker and
+// returns how many were read.
+func ReadSnapshot(nc NumberChecker, r io.Reader) (count uint64, err error) {
+	nc = baseChecker(nc)
+	s, ok := nc.(restorer)
+	if !ok {
+		return 0, errSnapshotUnsupported
+	}
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(snapshotMagic))
+	if err != nil {
+		return 0, err
+	}
+	if bc, ok := nc.(*bloomChecker); ok && bytes.Equal(magic, bloomMagic) {
+		return bc.readSnapshot(br)
+	}
+	if !bytes.Equal(magic, snapshotMagic) {
+		return readRoaringSnapshot(s, br)
+	}
+	if _, err := br.Discard(len(snapshotMagic)); err != nil {
+		return 0, err
+	}
+	n := int64(-1)
+	for {
+		d, err := binary.ReadUvarint(br)
+		if err != nil {
+			return count, fmt.Errorf("truncated snapshot: %w", err)
+		}
+		if d == 0 {
+			break
+		}
+		if n += int64(d); n > maxNumber {
+			return count, fmt.Errorf("snapshot number %v out of range", n)
+		}
+		s.restore(uint32(n))
+		count++
+	}
+	expected, err := binary.ReadUvarint(br)
+	if err != nil {
+		return count, fmt.Errorf("truncated snapshot: %w", err)
+	}
+	if expected != count {
+		return count, fmt.Errorf("snapshot holds %v numbers, expected %v", count, expected)
+	}
+	return count, nil
+}
+
+func readRoaringSnapshot(s restorer, r io.Reader) (count uint64, err error) {
+	rb, err := readRoaring(r)
+	if err == errRoaringFormat {
+		return 0, errors.New("not a numbers snapshot")
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid roaring snapshot: %w", err)
+	}
+	rb.each(func(n uint32) bool {
+		if n > maxNumber {
+			err = fmt.Errorf("snapshot number %v out of range", n)
+			return false
+		}
+		s.restore(n)
+		count++
+		return true
+	})
+	return count, err
+}
+
+func SaveSnapshot(nc NumberChecker, file string) error {
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := WriteSnapshot(nc, f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func LoadSnapshot(nc NumberChecker, file string) (uint64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return ReadSnapshot(nc, f)
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	numbers := []uint32{0, 1, 2, 1337, 65535, 65536, 123456789, maxNumber}
+	tests := []struct {
+		name    string
+		checker func(r Recorder) NumberChecker
+		numbers []uint32
+	}{
+		{name: "Map", checker: newMapChecker},
+		{name: "Alt", checker: newSmallAltChecker, numbers: []uint32{0, 1, 2, 1337, 65535, 65536, smallSpace - 1}},
+		{name: "Sharded", checker: func(r Recorder) NumberChecker {
+			return newShardedChecker(r, 8)
+		}},
+		{name: "Roaring", checker: func(r Recorder) NumberChecker {
+			return newRoaringChecker(r)
+		}},
+		{name: "Paged", checker: func(r Recorder) NumberChecker {
+			return newPagedChecker(r)
+		}},
+		{name: "Adaptive", checker: func(r Recorder) NumberChecker {
+			return newAdaptiveChecker(r, 2)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			numbers := numbers
+			if tt.numbers != nil {
+				numbers = tt.numbers
+			}
+			src := tt.checker(&noopRecorder{})
+			for i := len(numbers) - 1; i >= 0; i-- {
+				src.IsUnique(numbers[i])
+			}
+			var buf bytes.Buffer
+			require.NoError(t, WriteSnapshot(src, &buf))
+
+			mr := &mockRecorder{}
+			mr.On("markRestored").Return()
+			mr.On("setMemory", mock.Anything).Maybe()
+			dst := tt.checker(mr)
+			n, err := ReadSnapshot(dst, &buf)
+			require.NoError(t, err)
+			assert.Equal(t, uint64(len(numbers)), n)
+			mr.AssertNumberOfCalls(t, "markRestored", len(numbers))
+
+			var walked []uint32
+			dst.(snapshotter).walk(func(n uint32) bool {
+				walked = append(walked, n)
+				return true
+			})
+			assert.Equal(t, numbers, walked)
+		})
+	}
+}
+
+func TestReadSnapshot_errors(t *testing.T) {
+	valid := func() []byte {
+		var buf bytes.Buffer
+		c := newMapChecker(&noopRecorder{})
+		c.IsUnique(7)
+		c.IsUnique(9)
+		require.NoError(t, WriteSnapshot(c, &buf))
+		return buf.Bytes()
+	}()
+	wrongCount := append([]byte{}, valid[:len(valid)-1]...)
+	wrongCount = append(wrongCount, 3)
+	outOfRange := append([]byte{}, snapshotMagic...)
+	outOfRange = append(outOfRange, make([]byte, binary.MaxVarintLen64)...)
+	l := binary.PutUvarint(outOfRange[len(snapshotMagic):], numberSpace+1)
+	outOfRange = append(outOfRange[:len(snapshotMagic)+l], 0, 1)
+
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{name: "Empty", in: nil},
+		{name: "BadMagic", in: []byte("NOTSNAP0")},
+		{name: "Truncated", in: valid[:len(valid)-2]},
+		{name: "WrongCount", in: wrongCount},
+		{name: "OutOfRange", in: outOfRange},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadSnapshot(newMapChecker(&noopRecorder{}), bytes.NewReader(tt.in))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestSnapshot_unsupported(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Equal(t, errSnapshotUnsupported, WriteSnapshot(&mockRepo{}, &buf))
+	_, err := ReadSnapshot(&mockRepo{}, &buf)
+	assert.Equal(t, errSnapshotUnsupported, err)
+}
+
+func TestSaveAndLoadSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "Snapshot")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "numbers.state")
+
+	src := newMapChecker(&noopRecorder{})
+	src.IsUnique(42)
+	require.NoError(t, SaveSnapshot(src, file))
+	_, err = os.Stat(file + ".tmp")
+	assert.True(t, os.IsNotExist(err), "expected temporary file to be renamed")
+
+	dst := newMapChecker(&noopRecorder{})
+	n, err := LoadSnapshot(dst, file)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), n)
+	assert.False(t, dst.IsUnique(42))
+
+	_, err = LoadSnapshot(dst, filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultWindowGenerations is the number of generations a window checker
+// splits its window into when none is configured.
+const DefaultWindowGenerations = 4
+
+// windowChecker only remembers the numbers seen within a window. The window
+// is split into generations that each hold the numbers last seen during
+// their share of it. When a generation has been over for a whole window it
+// is dropped along with its numbers, so a number is unique again between
+// window and window plus a generation after it was last seen, and memory
+// only holds the numbers of the last window.
+type windowChecker struct {
+	mu     sync.Mutex
+	window time.Duration
+	step   time.Duration
+	start  time.Time
+	now    func() time.Time
+	// gens[0] is the current generation and gens[len(gens)-1] the oldest.
+	// A number is in at most one of them.
+	gens    []map[uint32]struct{}
+	epoch   int64
+	expired uint64
+	r       Recorder
+}
+
+func newWindowChecker(r Recorder, window time.Duration, generations int) *windowChecker {
+	return newWindowCheckerAt(r, window, generations, time.Now)
+}
+
+func newWindowCheckerAt(r Recorder, window time.Duration, generations int, now func() time.Time) *windowChecker {
+	if generations <= 0 {
+		generations = DefaultWindowGenerations
+	}
+	step := window / time.Duration(generations)
+	if step <= 0 {
+		step = 1
+	}
+	c := &windowChecker{
+		window: window,
+		step:   step,
+		start:  now(),
+		now:    now,
+		gens:   make([]map[uint32]struct{}, generations+1),
+		r:      r,
+	}
+	for i := range c.gens {
+		c.gens[i] = make(map[uint32]struct{})
+	}
+	return c
+}
+
+// rotate drops the generations that have been over for a whole window. The
+// lock has to be held.
+func (c *windowChecker) rotate() {
+	epoch := int64(c.now().Sub(c.start) / c.step)
+	steps := epoch - c.epoch
+	if steps > int64(len(c.gens)) {
+		// Every generation is over, there is no need to rotate more.
+		steps = int64(len(c.gens))
+	}
+	for ; steps > 0; steps-- {
+		last := len(c.gens) - 1
+		if expired := uint64(len(c.gens[last])); expired > 0 {
+			c.expired += expired
+			c.r.addExpired(expired)
+		}
+		copy(c.gens[1:], c.gens[:last])
+		c.gens[0] = make(map[uint32]struct{})
+	}
+	if epoch > c.epoch {
+		c.epoch = epoch
+	}
+}
+
+// mark moves n to the current generation and reports whether it was not in
+// any. The lock has to be held.
+func (c *windowChecker) mark(n uint32) bool {
+	if _, ok := c.gens[0][n]; ok {
+		return false
+	}
+	c.gens[0][n] = struct{}{}
+	for _, g := range c.gens[1:] {
+		if _, ok := g[n]; ok {
+			delete(g, n)
+			return false
+		}
+	}
+	return true
+}
+
+func (c *windowChecker) IsUnique(n uint32) (unique bool) {
+	c.mu.Lock()
+	c.rotate()
+	unique = c.mark(n)
+	c.mu.Unlock()
+	c.record(unique)
+	return unique
+}
+
+func (c *windowChecker) IsUniqueBatch(ns []uint32, out []bool) {
+	c.mu.Lock()
+	c.rotate()
+	for i, n := range ns {
+		out[i] = c.mark(n)
+	}
+	c.mu.Unlock()
+	for _, unique := range out[:len(ns)] {
+		c.record(unique)
+	}
+}
+
+func (c *windowChecker) record(unique bool) {
+	if unique {
+		c.r.markUnique()
+	} else {
+		c.r.markDuplicate()
+	}
+}
+
+// Reset forgets every number, as if the window had just started.
+func (c *windowChecker) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rotate()
+	for i := range c.gens {
+		c.gens[i] = make(map[uint32]struct{})
+	}
+	c.r.markReset()
+}
+
+func (c *windowChecker) Forget(n uint32) (forgotten bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, g := range c.gens {
+		if _, ok := g[n]; ok {
+			delete(g, n)
+			c.r.markForgotten()
+			return true
+		}
+	}
+	return false
+}
+
+// WindowCounts are the numbers a window checker currently remembers and how
+// many it has forgotten.
+type WindowCounts struct {
+	InWindow uint64 `json:"inWindow"`
+	Expired  uint64 `json:"expired"`
+}
+
+// Counts returns how many numbers are remembered and how many expired.
+func (c *windowChecker) Counts() WindowCounts {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rotate()
+	counts := WindowCounts{Expired: c.expired}
+	for _, g := range c.gens {
+		counts.InWindow += uint64(len(g))
+	}
+	return counts
+}
+
+func (c *windowChecker) GetReport() string {
+	counts := c.Counts()
+	return c.r.getReport() + fmt.Sprintf(". Numbers in the last %v: %v, expired: %v", c.window, counts.InWindow, counts.Expired)
+}
+
+func (c *windowChecker) walk(fn func(n uint32) bool) {
+	c.mu.Lock()
+	var seen []uint32
+	for _, g := range c.gens {
+		for n := range g {
+			seen = append(seen, n)
+		}
+	}
+	c.mu.Unlock()
+	sort.Slice(seen, func(i, j int) bool {
+		return seen[i] < seen[j]
+	})
+	for _, n := range seen {
+		if !fn(n) {
+			return
+		}
+	}
+}
+
+// restore marks n as seen now, as snapshots do not say when numbers were
+// seen.
+func (c *windowChecker) restore(n uint32) (restored bool) {
+	c.mu.Lock()
+	c.rotate()
+	restored = c.mark(n)
+	c.mu.Unlock()
+	if restored {
+		c.r.markRestored()
+	}
+	return restored
+}
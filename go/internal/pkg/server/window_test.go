@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (f *fakeClock) now() time.Time {
+	return f.t
+}
+
+func (f *fakeClock) advance(d time.Duration) {
+	f.t = f.t.Add(d)
+}
+
+func newTestWindowChecker(r Recorder) (*windowChecker, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1600000000, 0)}
+	return newWindowCheckerAt(r, 4*time.Hour, 4, clock.now), clock
+}
+
+func TestAddOkayWindow(t *testing.T) {
+	mr := &mockRecorder{}
+	mr.On("markUnique").Return()
+	testAddOkay(t, newWindowChecker(mr, time.Hour, 0))
+}
+
+func TestAddDuplicateWindow(t *testing.T) {
+	mr := &mockRecorder{}
+	mr.On("markUnique").Return()
+	mr.On("markDuplicate").Return()
+	testAddDuplicate(t, newWindowChecker(mr, time.Hour, 0))
+}
+
+func TestWindowChecker_expiry(t *testing.T) {
+	tests := []struct {
+		name string
+		// after is how long after the first sighting the number is sent
+		// again.
+		after  []time.Duration
+		unique []bool
+	}{
+		{name: "WithinWindow", after: []time.Duration{3*time.Hour + 59*time.Minute}, unique: []bool{false}},
+		{name: "JustPastWindow", after: []time.Duration{4 * time.Hour}, unique: []bool{false}},
+		{name: "PastWindowAndGeneration", after: []time.Duration{5 * time.Hour}, unique: []bool{true}},
+		{name: "LongAfter", after: []time.Duration{100 * time.Hour}, unique: []bool{true}},
+		{
+			name: "SightingsExtendTheWindow",
+			// Seen again every 3 hours, so it never gets 4 hours old.
+			after:  []time.Duration{3 * time.Hour, 6 * time.Hour, 9 * time.Hour, 14 * time.Hour},
+			unique: []bool{false, false, false, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, clock := newTestWindowChecker(&noopRecorder{})
+			start := clock.t
+			require.True(t, c.IsUnique(42))
+			for i, after := range tt.after {
+				clock.t = start.Add(after)
+				assert.Equal(t, tt.unique[i], c.IsUnique(42), "after %v", after)
+			}
+		})
+	}
+}
+
+func TestWindowChecker_counts(t *testing.T) {
+	r := NewRecorder()
+	c, clock := newTestWindowChecker(r)
+	for n := uint32(0); n < 10; n++ {
+		c.IsUnique(n)
+	}
+	clock.advance(2 * time.Hour)
+	c.IsUniqueBatch([]uint32{5, 6, 10, 11}, make([]bool, 4))
+	assert.Equal(t, WindowCounts{InWindow: 12}, c.Counts())
+	// 0-4 and 7-9 were last seen in the first hour, 5, 6, 10 and 11 in the
+	// third.
+	assert.Len(t, c.gens[0], 4)
+	assert.Len(t, c.gens[2], 8)
+
+	clock.advance(3 * time.Hour)
+	assert.Equal(t, WindowCounts{InWindow: 4, Expired: 8}, c.Counts())
+	assert.Equal(t, "Received 12 unique numbers, 2 duplicates. Unique total: 4. Numbers in the last 4h0m0s: 4, expired: 8", c.GetReport())
+
+	clock.advance(48 * time.Hour)
+	assert.Equal(t, WindowCounts{Expired: 12}, c.Counts())
+	for _, g := range c.gens {
+		assert.Empty(t, g)
+	}
+}
+
+func TestWindowChecker_snapshot(t *testing.T) {
+	src, _ := newTestWindowChecker(&noopRecorder{})
+	src.IsUnique(7)
+	src.IsUnique(3)
+	var buf bytes.Buffer
+	require.NoError(t, WriteSnapshot(src, &buf))
+
+	dst, clock := newTestWindowChecker(&noopRecorder{})
+	n, err := ReadSnapshot(dst, &buf)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), n)
+	assert.False(t, dst.IsUnique(7))
+	// Restored numbers count as seen when restored.
+	clock.advance(5 * time.Hour)
+	assert.True(t, dst.IsUnique(3))
+}
+
+func TestNewNumberCheckerWith_window(t *testing.T) {
+	nc, err := NewNumberCheckerWith(CheckerConfig{Kind: "window", Window: time.Hour}, &noopRecorder{})
+	require.NoError(t, err)
+	c := nc.(*windowChecker)
+	assert.Len(t, c.gens, DefaultWindowGenerations+1)
+	assert.Equal(t, 15*time.Minute, c.step)
+
+	_, err = NewNumberCheckerWith(CheckerConfig{Kind: "window"}, &noopRecorder{})
+	assert.EqualError(t, err, "window 0s must be positive")
+}
@@ -14,6 +14,16 @@ type Writer interface {
 }
 
 func GetWriter(file string) Writer {
+	if _, err := os.Stat(file); err == nil {
+		if err := os.Remove(file); err != nil {
+			panic(err)
+		}
+	}
+	return GetAppendWriter(file)
+}
+
+// GetAppendWriter keeps the numbers already in file and appends to them.
+func GetAppendWriter(file string) Writer {
 	cfgJson := fmt.Sprintf(`{
 	  "level": "info",
 	  "encoding": "console",
@@ -33,11 +43,6 @@ func GetWriter(file string) Writer {
 		panic(err)
 	}
 
-	if _, err := os.Stat(file); err == nil {
-		if err := os.Remove(file); err != nil {
-			panic(err)
-		}
-	}
 	logger, err := cfg.Build()
 	if err != nil {
 		panic(err)